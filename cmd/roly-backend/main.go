@@ -6,8 +6,10 @@ import (
 	"log/slog"
 	"os"
 
+	"github.com/roly-backend/internal/ai"
 	"github.com/roly-backend/internal/config"
 	"github.com/roly-backend/internal/database"
+	"github.com/roly-backend/internal/moderation"
 	"github.com/roly-backend/internal/server"
 )
 
@@ -22,6 +24,12 @@ func main() {
 
 	slog.LogAttrs(context.Background(), slog.LevelInfo, fmt.Sprintf("Application started in %v mode", config.Env.AppEnv))
 
+	// Creates the AI provider that answers the chats
+	ai.Setup()
+
+	// Creates the moderation that checks user messages and AI answers
+	moderation.Setup()
+
 	// Connects to the Database
 	database.Connect()
 
@@ -1,101 +1,122 @@
 package ai
 
 import (
-	"bufio"
 	"context"
-	"fmt"
-	"log"
-	"os"
-	"strings"
+	"log/slog"
+	"sync"
 
-	"github.com/openai/openai-go"
-	"github.com/openai/openai-go/option"
+	"github.com/roly-backend/internal/config"
 )
 
-// This will make the prompts to ai
-// TODO: do a proper implementation
+// One message of a conversation that is sent to the AI
+type ChatMessage struct {
+	Role       string // "system", "user", "assistant" or "tool"
+	Content    string
+	ToolCalls  []ToolCall // Tools the assistant wants to call (only for assistant messages)
+	ToolCallID string     // The call this message is the result of (only for tool messages)
+}
 
-var availableModels = map[string]string{
-	"1": openai.ChatModelGPT4_1Nano, // 0.1$ - 0-4$ cost
-	"2": openai.ChatModelGPT4_1Mini, // 0.4$ - 1.6$ cost
-	"3": openai.ChatModelO3Mini,     // 1.1$ - 4.4$ cost
+// A call of a tool that the model requested
+type ToolCall struct {
+	ID        string `json:"id"`
+	Name      string `json:"name"`
+	Arguments string `json:"arguments"` // JSON object that matches the parameters of the tool
 }
 
-func selectModel(reader *bufio.Reader) string {
-	fmt.Println("Wähle ein Modell:")
-	fmt.Println("1. gpt-4.1-nano")
-	fmt.Println("2. gpt-4.1-mini")
-	fmt.Println("3. o3-mini")
-	fmt.Print("Modellnummer > ")
+// Everything that is needed for one AI request
+type Request struct {
+	Model        string
+	Messages     []ChatMessage
+	MaxTokens    int64            // 0 means the limit of the model
+	Tools        []ToolDefinition // Tools the model may call
+	DisableTools bool             // Forbids the model to call any of the tools (but the tool messages in the history still work)
+	Format       *ResponseFormat  // Forces the model to answer with JSON that matches the schema
+}
 
-	choice, _ := reader.ReadString('\n')
-	choice = strings.TrimSpace(choice)
+// Token usage of one AI request
+type Usage struct {
+	PromptTokens     int64 `json:"prompt_tokens"`
+	CompletionTokens int64 `json:"completion_tokens"`
+	TotalTokens      int64 `json:"total_tokens"`
+}
 
-	model, ok := availableModels[choice]
-	if !ok {
-		fmt.Println("Ungültige Auswahl, Standard: gpt-4.1-nano")
-		model = openai.ChatModelGPT4_1Nano
-	}
-	return model
+// Answer of the AI to a request
+type Response struct {
+	Content      string
+	ToolCalls    []ToolCall // Tools the model wants to call before it answers
+	Model        string     // The model that actually answered
+	ChainModel   string     // The model of the request or its fallbacks that answered, Model can be a dated version of it
+	FinishReason string
+	Usage        Usage
+}
+
+// Provider is a LLM backend. The rest of the backend only talks to the AI through this interface
+type Provider interface {
+	// Sends the request and waits for the complete answer
+	Complete(ctx context.Context, req Request) (Response, error)
+
+	// Sends the request and calls onDelta for every piece of text as soon as it arrives.
+	// When onDelta returns an error the stream is stopped and the error is returned together with the text received so far
+	Stream(ctx context.Context, req Request, onDelta func(delta string) error) (Response, error)
+
+	// Returns how many prompt tokens the messages need for the given model
+	CountTokens(model string, messages []ChatMessage) int
 }
 
-func main() {
-	apiKey := os.Getenv("OPENAI_API_KEY")
-	if apiKey == "" {
-		log.Fatal("Fehler: OPENAI_API_KEY ist nicht gesetzt.")
+var (
+	currentProvider Provider
+	providerMutex   sync.RWMutex
+)
+
+// Creates the provider that is configured in the ENV (has to be called once on startup after the ENV is loaded)
+func Setup() {
+	providerName := config.Env.AIProvider
+	switch providerName {
+	case "fake":
+		SetProvider(NewFakeProvider())
+	case "local":
+		SetProvider(NewReliableProvider(NewOpenAICompatibleProvider(config.Env.AIBaseURL, config.Env.AIAPIKey)))
+	default:
+		providerName = "openai"
+		SetProvider(NewReliableProvider(NewOpenAIProvider(config.Env.OpenAIAPIKey)))
 	}
 
-	client := openai.NewClient(option.WithAPIKey(apiKey))
-	reader := bufio.NewReader(os.Stdin)
-
-	fmt.Println("🧠 ChatGPT CLI – mit Modellwahl und Konversation")
-	fmt.Println("------------------------------------------------")
-
-	// Modell wählen
-	model := selectModel(reader)
-
-	// System-Rolle setzen
-	fmt.Print("Welche Rolle soll der Assistent übernehmen? > ")
-	systemPrompt, _ := reader.ReadString('\n')
-	systemPrompt = strings.TrimSpace(systemPrompt)
-
-	// Nachrichtenverlauf vorbereiten
-	var messages []openai.ChatCompletionMessageParamUnion
-	messages = append(messages, openai.SystemMessage(systemPrompt))
-
-	fmt.Println("\nStarte die Konversation! (Tippe 'exit' zum Beenden)")
-	fmt.Println("-----------------------------------------------------")
-
-	for {
-		fmt.Print("\nDu > ")
-		userInput, _ := reader.ReadString('\n')
-		userInput = strings.TrimSpace(userInput)
-
-		if strings.EqualFold(userInput, "exit") {
-			fmt.Println("🛑 Konversation beendet.")
-			break
-		}
-
-		// Nutzerfrage hinzufügen
-		messages = append(messages, openai.UserMessage(userInput))
-
-		// Anfrage an OpenAI senden
-		resp, err := client.Chat.Completions.New(context.Background(), openai.ChatCompletionNewParams{
-			Model:    model,
-			Messages: messages,
-		})
-		if err != nil {
-			log.Fatalf("API-Fehler: %v", err)
-		}
-
-		if len(resp.Choices) > 0 {
-			reply := resp.Choices[0].Message.Content
-			fmt.Printf("\n🧠 Modell > %s\n", reply)
-
-			// Antwort auch zum Verlauf hinzufügen
-			messages = append(messages, openai.AssistantMessage(resp.Choices[0].Message.Content))
-		} else {
-			fmt.Println("⚠️ Keine Antwort erhalten.")
-		}
+	LoadModels(config.Models)
+
+	// A local server only knows its own models, so the configured model becomes the default
+	if config.Env.AIModel != "" {
+		setDefaultModel(config.Env.AIModel)
 	}
+
+	slog.LogAttrs(context.Background(), slog.LevelInfo, "AI provider is set up",
+		slog.String("provider", providerName),
+		slog.String("default_model", DefaultModel()),
+	)
+}
+
+// Replaces the provider that is used for all AI requests
+func SetProvider(provider Provider) {
+	providerMutex.Lock()
+	defer providerMutex.Unlock()
+	currentProvider = provider
+}
+
+// Returns the provider that is used for all AI requests
+func Current() Provider {
+	providerMutex.RLock()
+	defer providerMutex.RUnlock()
+	return currentProvider
+}
+
+// Result of a moderation classifier
+type ModerationResult struct {
+	Flagged    bool
+	Categories []string // Categories the text was flagged for
+	Model      string
+	Usage      Usage // The moderation endpoint doesn't report tokens, so they are estimated
+}
+
+// Provider that can classify texts for harmful content. It is optional, not every provider has a classifier
+type Moderator interface {
+	Moderate(ctx context.Context, text string) (ModerationResult, error)
 }
@@ -0,0 +1,55 @@
+package ai
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+)
+
+func init() {
+	RegisterTool(currentTimeTool{})
+}
+
+// Tells the model the current date and time, which it can't know by itself
+type currentTimeTool struct{}
+
+func (currentTimeTool) Name() string {
+	return "current_time"
+}
+
+func (currentTimeTool) Description() string {
+	return "Returns the current date and time. Use it whenever the answer depends on today's date or the time."
+}
+
+func (currentTimeTool) Parameters() map[string]any {
+	return map[string]any{
+		"type": "object",
+		"properties": map[string]any{
+			"timezone": map[string]any{
+				"type":        "string",
+				"description": "IANA time zone, for example Europe/Berlin. Defaults to UTC.",
+			},
+		},
+	}
+}
+
+func (currentTimeTool) Call(ctx context.Context, arguments json.RawMessage) (string, error) {
+	var args struct {
+		Timezone string `json:"timezone"`
+	}
+	if len(arguments) > 0 {
+		if err := json.Unmarshal(arguments, &args); err != nil {
+			return "", err
+		}
+	}
+
+	location := time.UTC
+	if args.Timezone != "" {
+		loaded, err := time.LoadLocation(args.Timezone)
+		if err != nil {
+			return "", err
+		}
+		location = loaded
+	}
+	return time.Now().In(location).Format("Monday, 2006-01-02 15:04:05 MST"), nil
+}
@@ -0,0 +1,89 @@
+package ai
+
+import (
+	"sync"
+	"time"
+)
+
+// States of a circuit breaker
+const (
+	circuitClosed   = "closed"    // Requests are sent normally
+	circuitOpen     = "open"      // Requests are rejected without contacting the provider
+	circuitHalfOpen = "half_open" // One test request is allowed to check if the model works again
+)
+
+// Stops sending requests to a model that keeps failing so users get an error at once instead of waiting for every retry
+type circuitBreaker struct {
+	mutex            sync.Mutex
+	state            string
+	failures         int // Failures in a row
+	openedAt         time.Time
+	failureThreshold int
+	openDuration     time.Duration
+}
+
+// Creates a closed circuit breaker
+func newCircuitBreaker(failureThreshold int, openDuration time.Duration) *circuitBreaker {
+	return &circuitBreaker{
+		state:            circuitClosed,
+		failureThreshold: failureThreshold,
+		openDuration:     openDuration,
+	}
+}
+
+// Checks if a request may be sent. After the open duration one test request is let through
+func (b *circuitBreaker) allow() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	switch b.state {
+	case circuitOpen:
+		if time.Since(b.openedAt) < b.openDuration {
+			return false
+		}
+		b.state = circuitHalfOpen
+		return true
+	case circuitHalfOpen:
+		// The test request is still running
+		return false
+	default:
+		return true
+	}
+}
+
+// Closes the circuit after a successful request
+func (b *circuitBreaker) success() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.state = circuitClosed
+	b.failures = 0
+}
+
+// Counts a failed request and opens the circuit when there were too many failures in a row
+func (b *circuitBreaker) failure() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.failures++
+	if b.state == circuitHalfOpen || b.failures >= b.failureThreshold {
+		b.state = circuitOpen
+		b.openedAt = time.Now()
+	}
+}
+
+// Lets the next request through after a request ended without telling anything about the health of the model (for example it was canceled)
+func (b *circuitBreaker) release() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.state == circuitHalfOpen {
+		b.state = circuitOpen
+		b.openedAt = time.Now().Add(-b.openDuration)
+	}
+}
+
+// Checks if requests are rejected at the moment
+func (b *circuitBreaker) isOpen() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.state == circuitOpen && time.Since(b.openedAt) < b.openDuration
+}
@@ -0,0 +1,100 @@
+package ai
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/openai/openai-go"
+)
+
+// What went wrong with an AI request
+type ErrorKind string
+
+const (
+	ErrKindRateLimited    ErrorKind = "rate_limited"    // The provider gets too many requests (429)
+	ErrKindUnavailable    ErrorKind = "unavailable"     // The provider has problems (5xx, network errors)
+	ErrKindCircuitOpen    ErrorKind = "circuit_open"    // The model failed too often recently, so no request was sent
+	ErrKindInvalidRequest ErrorKind = "invalid_request" // The provider rejected the request (4xx), retrying doesn't help
+	ErrKindCanceled       ErrorKind = "canceled"        // The request was canceled by the caller
+	ErrKindUnknown        ErrorKind = "unknown"
+)
+
+// Error of an AI request. The websocket layer uses the kind to tell the user what happened
+type Error struct {
+	Kind       ErrorKind
+	Model      string
+	StatusCode int           // HTTP status code of the provider (0 if there was no response)
+	RetryAfter time.Duration // How long the provider asked us to wait (0 if it didn't say)
+	Err        error
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("ai request to %s failed (%s): %v", e.Model, e.Kind, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Checks if sending the same request again can succeed
+func (e *Error) Retryable() bool {
+	return e.Kind == ErrKindRateLimited || e.Kind == ErrKindUnavailable
+}
+
+// Converts any error of a provider into an Error
+func classifyError(model string, err error) *Error {
+	var aiErr *Error
+	if errors.As(err, &aiErr) {
+		return aiErr
+	}
+
+	classified := &Error{Kind: ErrKindUnknown, Model: model, Err: err}
+
+	var apiErr *openai.Error
+	var netErr net.Error
+	switch {
+	case errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded):
+		classified.Kind = ErrKindCanceled
+	case errors.As(err, &apiErr):
+		classified.StatusCode = apiErr.StatusCode
+		switch {
+		case apiErr.StatusCode == http.StatusTooManyRequests:
+			classified.Kind = ErrKindRateLimited
+		case apiErr.StatusCode == http.StatusRequestTimeout || apiErr.StatusCode >= 500:
+			classified.Kind = ErrKindUnavailable
+		default:
+			classified.Kind = ErrKindInvalidRequest
+		}
+		if apiErr.Response != nil {
+			classified.RetryAfter = parseRetryAfter(apiErr.Response.Header)
+		}
+	case errors.As(err, &netErr):
+		classified.Kind = ErrKindUnavailable
+	}
+	return classified
+}
+
+// Reads how long the provider wants us to wait from the response headers.
+// OpenAI sends "retry-after-ms", the standard header "Retry-After" can be seconds or a HTTP date
+func parseRetryAfter(header http.Header) time.Duration {
+	if ms, err := strconv.ParseFloat(header.Get("Retry-After-Ms"), 64); err == nil && ms > 0 {
+		return time.Duration(ms * float64(time.Millisecond))
+	}
+
+	value := header.Get("Retry-After")
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil && seconds > 0 {
+		return time.Duration(seconds * float64(time.Second))
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return max(time.Until(date), 0)
+	}
+	return 0
+}
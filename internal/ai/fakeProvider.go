@@ -0,0 +1,125 @@
+package ai
+
+import (
+	"context"
+	"strings"
+	"sync"
+)
+
+// FakeProvider answers deterministically without any network access so the chat pipeline can be tested offline
+type FakeProvider struct {
+	mutex    sync.Mutex
+	replies  []FakeReply
+	requests []Request
+}
+
+// A scripted answer of the fake provider. The tool calls are only returned if the request allows tools, like a real model would
+type FakeReply struct {
+	Content   string
+	ToolCalls []ToolCall
+}
+
+// Creates a fake provider. The given replies are returned one after another and the last one is repeated.
+// Without replies the provider echoes the last user message
+func NewFakeProvider(replies ...string) *FakeProvider {
+	scripted := make([]FakeReply, 0, len(replies))
+	for _, reply := range replies {
+		scripted = append(scripted, FakeReply{Content: reply})
+	}
+	return &FakeProvider{replies: scripted}
+}
+
+// Creates a fake provider with scripted answers that can call tools. Works like NewFakeProvider otherwise
+func NewFakeToolProvider(replies ...FakeReply) *FakeProvider {
+	return &FakeProvider{replies: replies}
+}
+
+// Returns the next answer at once
+func (p *FakeProvider) Complete(ctx context.Context, req Request) (Response, error) {
+	if err := ctx.Err(); err != nil {
+		return Response{Model: req.Model}, err
+	}
+	reply := p.nextReply(req)
+	response := p.response(req, reply.Content)
+	p.addToolCalls(req, reply, &response)
+	return response, nil
+}
+
+// Returns the next answer word by word
+func (p *FakeProvider) Stream(ctx context.Context, req Request, onDelta func(delta string) error) (Response, error) {
+	reply := p.nextReply(req)
+	content := reply.Content
+
+	var sent strings.Builder
+	for _, word := range strings.SplitAfter(content, " ") {
+		if err := ctx.Err(); err != nil {
+			return p.response(req, sent.String()), err
+		}
+		if err := onDelta(word); err != nil {
+			return p.response(req, sent.String()), err
+		}
+		sent.WriteString(word)
+	}
+	response := p.response(req, content)
+	p.addToolCalls(req, reply, &response)
+	return response, nil
+}
+
+// Estimates the prompt tokens of the messages
+func (p *FakeProvider) CountTokens(model string, messages []ChatMessage) int {
+	return EstimateTokens(messages)
+}
+
+// Returns all requests the provider received
+func (p *FakeProvider) Requests() []Request {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return append([]Request(nil), p.requests...)
+}
+
+// Remembers the request and returns the answer for it
+func (p *FakeProvider) nextReply(req Request) FakeReply {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.requests = append(p.requests, req)
+
+	if len(p.replies) == 0 {
+		for i := len(req.Messages) - 1; i >= 0; i-- {
+			if req.Messages[i].Role == "user" {
+				return FakeReply{Content: "echo: " + req.Messages[i].Content}
+			}
+		}
+		return FakeReply{Content: "echo:"}
+	}
+
+	index := len(p.requests) - 1
+	if index >= len(p.replies) {
+		index = len(p.replies) - 1
+	}
+	return p.replies[index]
+}
+
+// Adds the tool calls of the reply to the response if the request allows tools
+func (p *FakeProvider) addToolCalls(req Request, reply FakeReply, response *Response) {
+	if len(reply.ToolCalls) == 0 || len(req.Tools) == 0 || req.DisableTools {
+		return
+	}
+	response.ToolCalls = append([]ToolCall(nil), reply.ToolCalls...)
+	response.FinishReason = "tool_calls"
+}
+
+// Builds the response with the estimated token usage
+func (p *FakeProvider) response(req Request, content string) Response {
+	promptTokens := int64(EstimateTokens(req.Messages))
+	completionTokens := int64(EstimateTextTokens(content))
+	return Response{
+		Content:      content,
+		Model:        req.Model,
+		FinishReason: "stop",
+		Usage: Usage{
+			PromptTokens:     promptTokens,
+			CompletionTokens: completionTokens,
+			TotalTokens:      promptTokens + completionTokens,
+		},
+	}
+}
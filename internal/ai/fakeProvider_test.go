@@ -0,0 +1,101 @@
+package ai
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+// The fake provider has to behave like every other provider
+var _ Provider = (*FakeProvider)(nil)
+
+func TestFakeProviderReplies(t *testing.T) {
+	provider := NewFakeProvider("First", "Second")
+	ctx := context.Background()
+
+	for _, expected := range []string{"First", "Second", "Second"} {
+		response, err := provider.Complete(ctx, testRequest)
+		if err != nil || response.Content != expected {
+			t.Errorf("expected %q, got %q (%v)", expected, response.Content, err)
+		}
+		if response.Model != testRequest.Model || response.FinishReason != "stop" {
+			t.Errorf("unexpected response %+v", response)
+		}
+		prompt := int64(EstimateTokens(testRequest.Messages))
+		if response.Usage.PromptTokens != prompt || response.Usage.TotalTokens != prompt+int64(EstimateTextTokens(expected)) {
+			t.Errorf("expected the estimated usage, got %+v", response.Usage)
+		}
+	}
+	if requests := provider.Requests(); len(requests) != 3 || requests[0].Messages[0].Content != "Hi" {
+		t.Errorf("expected every request to be recorded, got %+v", requests)
+	}
+
+	echo, _ := NewFakeProvider().Complete(ctx, testRequest)
+	if echo.Content != "echo: Hi" {
+		t.Errorf("expected the last user message to be echoed, got %q", echo.Content)
+	}
+	if tokens := provider.CountTokens("any-model", testRequest.Messages); tokens != EstimateTokens(testRequest.Messages) {
+		t.Errorf("expected the estimated tokens, got %d", tokens)
+	}
+}
+
+func TestFakeProviderStream(t *testing.T) {
+	provider := NewFakeProvider("One two three")
+
+	var deltas []string
+	response, err := provider.Stream(context.Background(), testRequest, func(delta string) error {
+		deltas = append(deltas, delta)
+		return nil
+	})
+	if err != nil || response.Content != "One two three" || len(deltas) != 3 || deltas[1] != "two " {
+		t.Errorf("expected the answer word by word, got %q %q (%v)", deltas, response.Content, err)
+	}
+
+	// A failing callback stops the stream, the text that was passed on until then is returned
+	stop := errors.New("stop")
+	response, err = provider.Stream(context.Background(), testRequest, func(delta string) error {
+		if delta == "two " {
+			return stop
+		}
+		return nil
+	})
+	if !errors.Is(err, stop) || response.Content != "One " {
+		t.Errorf("expected the text before the error, got %q (%v)", response.Content, err)
+	}
+
+	// A canceled context stops the stream before the next word
+	ctx, cancel := context.WithCancel(context.Background())
+	response, err = provider.Stream(ctx, testRequest, func(delta string) error {
+		cancel()
+		return nil
+	})
+	if !errors.Is(err, context.Canceled) || response.Content != "One " {
+		t.Errorf("expected the text before the cancel, got %q (%v)", response.Content, err)
+	}
+	if _, err := provider.Complete(ctx, testRequest); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected Complete to fail with a canceled context, got %v", err)
+	}
+}
+
+func TestFakeProviderToolCalls(t *testing.T) {
+	call := ToolCall{ID: "call-1", Name: "current_time", Arguments: "{}"}
+	provider := NewFakeToolProvider(FakeReply{Content: "Let me look.", ToolCalls: []ToolCall{call}})
+
+	// Like a real model the provider only calls tools the request offers
+	response, _ := provider.Complete(context.Background(), testRequest)
+	if len(response.ToolCalls) != 0 || response.FinishReason != "stop" {
+		t.Errorf("expected no tool calls without tools, got %+v", response)
+	}
+
+	req := testRequest
+	req.Tools = ToolDefinitions([]string{"current_time"})
+	response, _ = provider.Stream(context.Background(), req, func(delta string) error { return nil })
+	if len(response.ToolCalls) != 1 || response.ToolCalls[0] != call || response.FinishReason != "tool_calls" || response.Content != "Let me look." {
+		t.Errorf("expected the scripted tool call, got %+v", response)
+	}
+
+	req.DisableTools = true
+	if response, _ = provider.Complete(context.Background(), req); len(response.ToolCalls) != 0 {
+		t.Errorf("expected no tool calls when tools are disabled, got %+v", response)
+	}
+}
@@ -0,0 +1,106 @@
+package ai
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+)
+
+// Provider that can tell if the circuit breaker of a model is open (implemented by the ReliableProvider)
+type circuitChecker interface {
+	IsCircuitOpen(model string) bool
+}
+
+// Sends the request to the model of the request and, if that fails or is paused, to the fallback models in the given order.
+// The Model of the response is the model that actually answered, the ChainModel is the model of the chain that was sent
+func CompleteWithFallback(ctx context.Context, provider Provider, req Request, fallbacks []string) (Response, error) {
+	return withFallback(ctx, provider, req, fallbacks, func(req Request) (Response, error) {
+		return provider.Complete(ctx, req)
+	}, func() bool { return true })
+}
+
+// Streams the request like CompleteWithFallback. A fallback model is only used as long as no text was passed to onDelta
+func StreamWithFallback(ctx context.Context, provider Provider, req Request, fallbacks []string, onDelta func(delta string) error) (Response, error) {
+	streamed := false
+	return withFallback(ctx, provider, req, fallbacks, func(req Request) (Response, error) {
+		return provider.Stream(ctx, req, func(delta string) error {
+			streamed = true
+			return onDelta(delta)
+		})
+	}, func() bool { return !streamed })
+}
+
+// Tries the models one after another until one of them answers
+func withFallback(ctx context.Context, provider Provider, req Request, fallbacks []string, attempt func(req Request) (Response, error), canFallback func() bool) (Response, error) {
+	chain := fallbackChain(req.Model, fallbacks)
+	checker, _ := provider.(circuitChecker)
+
+	var lastResponse Response
+	var lastErr error
+	for i, model := range chain {
+		// Models that are paused are skipped without waiting for their error
+		if checker != nil && checker.IsCircuitOpen(model) && i < len(chain)-1 {
+			lastErr = &Error{Kind: ErrKindCircuitOpen, Model: model, Err: errCircuitOpen}
+			continue
+		}
+
+		modelReq := req
+		modelReq.Model = model
+		response, err := attempt(modelReq)
+		if err == nil {
+			if response.Model == "" {
+				response.Model = model
+			}
+			response.ChainModel = model
+			return response, nil
+		}
+		lastResponse, lastErr = response, err
+
+		if !shouldFallback(err) || !canFallback() {
+			return response, err
+		}
+		if i < len(chain)-1 {
+			slog.LogAttrs(ctx, slog.LevelWarn, "AI model failed, using fallback model",
+				slog.String("model", model),
+				slog.String("fallback_model", chain[i+1]),
+				slog.String("error", err.Error()),
+			)
+		}
+	}
+	return lastResponse, lastErr
+}
+
+// Returns the model followed by the fallback models without duplicates and without models that are not in the registry
+func fallbackChain(model string, fallbacks []string) []string {
+	chain := []string{model}
+	for _, fallback := range fallbacks {
+		duplicate := false
+		for _, existing := range chain {
+			if existing == fallback {
+				duplicate = true
+				break
+			}
+		}
+		if !duplicate && IsAvailableModel(fallback) {
+			chain = append(chain, fallback)
+		}
+	}
+	return chain
+}
+
+// Checks if another model could answer where this one failed
+func shouldFallback(err error) bool {
+	var aiErr *Error
+	if !errors.As(err, &aiErr) {
+		return false
+	}
+	switch aiErr.Kind {
+	case ErrKindRateLimited, ErrKindUnavailable, ErrKindCircuitOpen:
+		return true
+	case ErrKindInvalidRequest:
+		// The model doesn't exist (anymore) at the provider
+		return aiErr.StatusCode == http.StatusNotFound
+	}
+	return false
+}
@@ -0,0 +1,16 @@
+package ai
+
+import (
+	"github.com/openai/openai-go"
+	"github.com/openai/openai-go/option"
+)
+
+// Creates a provider for any server that offers the OpenAI chat completions API under the given base URL
+// (for example Ollama with "http://localhost:11434/v1" or the llama.cpp server). Most local servers don't need an API key
+func NewOpenAICompatibleProvider(baseURL, apiKey string) *OpenAIProvider {
+	return &OpenAIProvider{
+		// The API key is always set, even if it is empty. Otherwise the client would send OPENAI_API_KEY to the server.
+		// Retries are done by the ReliableProvider
+		client: openai.NewClient(option.WithBaseURL(baseURL), option.WithAPIKey(apiKey), option.WithMaxRetries(0)),
+	}
+}
@@ -0,0 +1,96 @@
+package ai
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Starts a server that behaves like a local OpenAI compatible server without API key and always answers with "Hello there"
+func newLocalTestServer(t *testing.T) *httptest.Server {
+	t.Helper()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.Header.Get("Authorization"), "sk-") {
+			http.Error(w, "unexpected API key", http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Path != "/v1/chat/completions" {
+			http.NotFound(w, r)
+			return
+		}
+
+		var body struct {
+			Model  string `json:"model"`
+			Stream bool   `json:"stream"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+
+		if !body.Stream {
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprintf(w, `{"id":"1","object":"chat.completion","created":1,"model":%q,
+				"choices":[{"index":0,"finish_reason":"stop","message":{"role":"assistant","content":"Hello there"}}],
+				"usage":{"prompt_tokens":5,"completion_tokens":2,"total_tokens":7}}`, body.Model)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, word := range []string{"Hello", " there"} {
+			fmt.Fprintf(w, "data: {\"id\":\"1\",\"object\":\"chat.completion.chunk\",\"created\":1,\"model\":%q,"+
+				"\"choices\":[{\"index\":0,\"delta\":{\"content\":%q}}]}\n\n", body.Model, word)
+		}
+		fmt.Fprintf(w, "data: {\"id\":\"1\",\"object\":\"chat.completion.chunk\",\"created\":1,\"model\":%q,"+
+			"\"choices\":[{\"index\":0,\"delta\":{},\"finish_reason\":\"stop\"}]}\n\n", body.Model)
+		fmt.Fprintf(w, "data: {\"id\":\"1\",\"object\":\"chat.completion.chunk\",\"created\":1,\"model\":%q,"+
+			"\"choices\":[],\"usage\":{\"prompt_tokens\":5,\"completion_tokens\":2,\"total_tokens\":7}}\n\n", body.Model)
+		fmt.Fprint(w, "data: [DONE]\n\n")
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestLocalProviderComplete(t *testing.T) {
+	// The key for the OpenAI API must never be sent to a local server
+	t.Setenv("OPENAI_API_KEY", "sk-secret")
+	server := newLocalTestServer(t)
+	provider := NewOpenAICompatibleProvider(server.URL+"/v1", "")
+
+	response, err := provider.Complete(context.Background(), Request{
+		Model:    "llama3.2",
+		Messages: []ChatMessage{{Role: "user", Content: "Hi"}},
+	})
+	if err != nil {
+		t.Fatalf("Error completing request: %v", err)
+	}
+	if response.Content != "Hello there" || response.Model != "llama3.2" || response.Usage.TotalTokens != 7 {
+		t.Errorf("Unexpected response: %+v", response)
+	}
+}
+
+func TestLocalProviderStream(t *testing.T) {
+	t.Setenv("OPENAI_API_KEY", "sk-secret")
+	server := newLocalTestServer(t)
+	provider := NewOpenAICompatibleProvider(server.URL+"/v1", "")
+
+	var deltas []string
+	response, err := provider.Stream(context.Background(), Request{
+		Model:    "llama3.2",
+		Messages: []ChatMessage{{Role: "user", Content: "Hi"}},
+	}, func(delta string) error {
+		deltas = append(deltas, delta)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Error streaming request: %v", err)
+	}
+	if strings.Join(deltas, "|") != "Hello| there" {
+		t.Errorf("Unexpected deltas: %q", deltas)
+	}
+	if response.Content != "Hello there" || response.FinishReason != "stop" || response.Usage.TotalTokens != 7 {
+		t.Errorf("Unexpected response: %+v", response)
+	}
+}
@@ -0,0 +1,154 @@
+package ai
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/roly-backend/internal/config"
+)
+
+// Context window that is assumed for unknown models (for example models of a local server)
+const defaultContextWindow = 8192
+
+// A model of the registry with its limits and prices
+type ModelInfo struct {
+	ID                    string   `json:"id"`
+	DisplayName           string   `json:"display_name"`
+	ContextWindow         int      `json:"context_window"`
+	InputPricePerMillion  float64  `json:"input_price_per_million"`  // US dollars per one million prompt tokens
+	OutputPricePerMillion float64  `json:"output_price_per_million"` // US dollars per one million completion tokens
+	Capabilities          []string `json:"capabilities"`
+}
+
+// Calculates what a request with the given token usage costs in US dollars
+func (m ModelInfo) Cost(usage Usage) float64 {
+	return float64(usage.PromptTokens)*m.InputPricePerMillion/1_000_000 +
+		float64(usage.CompletionTokens)*m.OutputPricePerMillion/1_000_000
+}
+
+// Checks if the model has the capability (see the capability constants in the config package)
+func (m ModelInfo) HasCapability(capability string) bool {
+	for _, c := range m.Capabilities {
+		if c == capability {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	registryMutex sync.RWMutex
+	registry      []ModelInfo // In the order of the config, the first model is the default model
+	defaultModel  string
+)
+
+func init() {
+	LoadModels(config.Models)
+}
+
+// Replaces all models of the registry
+func LoadModels(models []config.ModelConfig) {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+
+	registry = make([]ModelInfo, 0, len(models))
+	for _, model := range models {
+		registry = append(registry, ModelInfo{
+			ID:                    model.ID,
+			DisplayName:           model.DisplayName,
+			ContextWindow:         model.ContextWindow,
+			InputPricePerMillion:  model.InputPricePerMillion,
+			OutputPricePerMillion: model.OutputPricePerMillion,
+			Capabilities:          model.Capabilities,
+		})
+	}
+
+	defaultModel = ""
+	if len(registry) > 0 {
+		defaultModel = registry[0].ID
+	}
+}
+
+// Makes the model the default model. Models that are not in the registry yet are added without prices
+func setDefaultModel(id string) {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+
+	if _, ok := findModel(id); !ok {
+		registry = append(registry, ModelInfo{
+			ID:            id,
+			DisplayName:   id,
+			ContextWindow: defaultContextWindow,
+			Capabilities:  []string{config.CapabilityStreaming},
+		})
+	}
+	defaultModel = id
+}
+
+// Returns all models of the registry
+func Models() []ModelInfo {
+	registryMutex.RLock()
+	defer registryMutex.RUnlock()
+	return append([]ModelInfo(nil), registry...)
+}
+
+// Returns the model from the registry. Dated versions that the API returns (for example "gpt-4.1-nano-2025-04-14")
+// are found by their base model
+func GetModel(id string) (ModelInfo, bool) {
+	registryMutex.RLock()
+	defer registryMutex.RUnlock()
+	return findModel(id)
+}
+
+// Searches the model, the caller has to hold the registry lock
+func findModel(id string) (ModelInfo, bool) {
+	var best ModelInfo
+	found := false
+	for _, model := range registry {
+		if model.ID == id {
+			return model, true
+		}
+		// The longest matching base model wins so "gpt-4.1-mini-..." doesn't match "gpt-4.1"
+		if strings.HasPrefix(id, model.ID+"-") && len(model.ID) > len(best.ID) {
+			best = model
+			found = true
+		}
+	}
+	return best, found
+}
+
+// Returns the model that is used when the client doesn't choose one
+func DefaultModel() string {
+	registryMutex.RLock()
+	defer registryMutex.RUnlock()
+	return defaultModel
+}
+
+// Returns the context window of the model
+func ContextWindow(model string) int {
+	if info, ok := GetModel(model); ok && info.ContextWindow > 0 {
+		return info.ContextWindow
+	}
+	return defaultContextWindow
+}
+
+// Checks if the model can be used for chats
+func IsAvailableModel(model string) bool {
+	registryMutex.RLock()
+	defer registryMutex.RUnlock()
+	for _, info := range registry {
+		if info.ID == model {
+			return true
+		}
+	}
+	return false
+}
+
+// Calculates what a request of the model costs in US dollars. Unknown models cost nothing
+func Cost(model string, usage Usage) float64 {
+	info, ok := GetModel(model)
+	if !ok {
+		return 0
+	}
+	return info.Cost(usage)
+}
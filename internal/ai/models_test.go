@@ -0,0 +1,64 @@
+package ai
+
+import (
+	"math"
+	"testing"
+
+	"github.com/roly-backend/internal/config"
+)
+
+// Replaces the registry for the test
+func useModels(t *testing.T, models []config.ModelConfig) {
+	t.Helper()
+	LoadModels(models)
+	t.Cleanup(func() { LoadModels(config.Models) })
+}
+
+func TestFindModelByPrefix(t *testing.T) {
+	useModels(t, []config.ModelConfig{
+		{ID: "gpt-4.1", ContextWindow: 1000},
+		{ID: "gpt-4.1-mini", ContextWindow: 2000},
+	})
+
+	tests := []struct {
+		id       string
+		expected string
+	}{
+		{"gpt-4.1", "gpt-4.1"},
+		{"gpt-4.1-mini", "gpt-4.1-mini"},
+		{"gpt-4.1-2025-04-14", "gpt-4.1"},
+		{"gpt-4.1-mini-2025-04-14", "gpt-4.1-mini"}, // The longest base model wins
+		{"gpt-4.10", ""},                            // Only dated versions match, not other models that start the same
+		{"gpt-4", ""},
+	}
+	for _, test := range tests {
+		model, ok := GetModel(test.id)
+		if ok != (test.expected != "") || model.ID != test.expected {
+			t.Errorf("expected %q for %q, got %q (%t)", test.expected, test.id, model.ID, ok)
+		}
+	}
+
+	if window := ContextWindow("gpt-4.1-mini-2025-04-14"); window != 2000 {
+		t.Errorf("expected the context window of the base model, got %d", window)
+	}
+	if window := ContextWindow("local-llama"); window != defaultContextWindow {
+		t.Errorf("expected the default context window for unknown models, got %d", window)
+	}
+	// Chats can only choose the models of the registry, not their dated versions
+	if IsAvailableModel("gpt-4.1-2025-04-14") || !IsAvailableModel("gpt-4.1") {
+		t.Error("expected only the models of the registry to be available")
+	}
+}
+
+func TestCost(t *testing.T) {
+	useModels(t, []config.ModelConfig{{ID: "gpt-4.1", InputPricePerMillion: 2, OutputPricePerMillion: 8}})
+
+	usage := Usage{PromptTokens: 1500, CompletionTokens: 500, TotalTokens: 2000}
+	// 1500 * 2 / 1M + 500 * 8 / 1M
+	if cost := Cost("gpt-4.1-2025-04-14", usage); math.Abs(cost-0.007) > 1e-12 {
+		t.Errorf("expected 0.007 dollars, got %v", cost)
+	}
+	if cost := Cost("unknown-model", usage); cost != 0 {
+		t.Errorf("expected unknown models to cost nothing, got %v", cost)
+	}
+}
@@ -0,0 +1,222 @@
+package ai
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sort"
+
+	"github.com/openai/openai-go"
+	"github.com/openai/openai-go/option"
+	"github.com/openai/openai-go/shared"
+	"github.com/roly-backend/internal/config"
+)
+
+// Provider for the hosted OpenAI API
+type OpenAIProvider struct {
+	client openai.Client
+}
+
+// Creates a provider that sends all requests to the OpenAI API
+func NewOpenAIProvider(apiKey string) *OpenAIProvider {
+	return &OpenAIProvider{
+		// Retries are done by the ReliableProvider
+		client: openai.NewClient(option.WithAPIKey(apiKey), option.WithMaxRetries(0)),
+	}
+}
+
+// Sends the request to OpenAI and waits for the complete answer
+func (p *OpenAIProvider) Complete(ctx context.Context, req Request) (Response, error) {
+	completion, err := p.client.Chat.Completions.New(ctx, p.params(req))
+	if err != nil {
+		return Response{Model: req.Model}, err
+	}
+	if len(completion.Choices) == 0 {
+		return Response{Model: req.Model}, errors.New("no answer received from the AI")
+	}
+
+	return Response{
+		Content:      completion.Choices[0].Message.Content,
+		ToolCalls:    fromOpenAIToolCalls(completion.Choices[0].Message.ToolCalls),
+		Model:        completion.Model,
+		FinishReason: completion.Choices[0].FinishReason,
+		Usage:        toUsage(completion.Usage),
+	}, nil
+}
+
+// Sends the request to OpenAI and passes every piece of the answer to onDelta as soon as it arrives
+func (p *OpenAIProvider) Stream(ctx context.Context, req Request, onDelta func(delta string) error) (Response, error) {
+	params := p.params(req)
+	params.StreamOptions = openai.ChatCompletionStreamOptionsParam{
+		IncludeUsage: openai.Bool(true), // The last chunk then contains the token usage
+	}
+
+	stream := p.client.Chat.Completions.NewStreaming(ctx, params)
+	defer stream.Close()
+
+	acc := openai.ChatCompletionAccumulator{}
+	for stream.Next() {
+		chunk := stream.Current()
+		acc.AddChunk(chunk)
+
+		if len(chunk.Choices) > 0 && chunk.Choices[0].Delta.Content != "" {
+			if err := onDelta(chunk.Choices[0].Delta.Content); err != nil {
+				return accumulatedResponse(req, acc), err
+			}
+		}
+	}
+
+	response := accumulatedResponse(req, acc)
+	if err := stream.Err(); err != nil {
+		return response, err
+	}
+	if len(acc.Choices) == 0 {
+		return response, errors.New("no answer received from the AI")
+	}
+	return response, nil
+}
+
+// Classifies the text with the moderation endpoint of OpenAI
+func (p *OpenAIProvider) Moderate(ctx context.Context, text string) (ModerationResult, error) {
+	response, err := p.client.Moderations.New(ctx, openai.ModerationNewParams{
+		Input: openai.ModerationNewParamsInputUnion{OfString: openai.String(text)},
+		Model: openai.ModerationModelOmniModerationLatest,
+	})
+	if err != nil {
+		return ModerationResult{}, err
+	}
+
+	result := ModerationResult{Model: response.Model, Usage: Usage{PromptTokens: int64(EstimateTextTokens(text))}}
+	result.Usage.TotalTokens = result.Usage.PromptTokens
+	for _, moderation := range response.Results {
+		if !moderation.Flagged {
+			continue
+		}
+		result.Flagged = true
+
+		// The categories are a struct with one bool per category, the raw JSON is easier to go through
+		var categories map[string]bool
+		if err := json.Unmarshal([]byte(moderation.Categories.RawJSON()), &categories); err == nil {
+			for category, flagged := range categories {
+				if flagged {
+					result.Categories = append(result.Categories, category)
+				}
+			}
+		}
+	}
+	sort.Strings(result.Categories)
+	return result, nil
+}
+
+// Estimates the prompt tokens of the messages
+func (p *OpenAIProvider) CountTokens(model string, messages []ChatMessage) int {
+	return EstimateTokens(messages)
+}
+
+// Converts the request into the parameters of the OpenAI library
+func (p *OpenAIProvider) params(req Request) openai.ChatCompletionNewParams {
+	params := openai.ChatCompletionNewParams{
+		Model:    req.Model,
+		Messages: toOpenAIMessages(req.Messages),
+	}
+	if req.MaxTokens > 0 {
+		params.MaxCompletionTokens = openai.Int(req.MaxTokens)
+	}
+	for _, tool := range req.Tools {
+		params.Tools = append(params.Tools, openai.ChatCompletionToolParam{
+			Function: shared.FunctionDefinitionParam{
+				Name:        tool.Name,
+				Description: openai.String(tool.Description),
+				Parameters:  shared.FunctionParameters(tool.Parameters),
+			},
+		})
+	}
+	if req.DisableTools && len(req.Tools) > 0 {
+		params.ToolChoice = openai.ChatCompletionToolChoiceOptionUnionParam{OfAuto: openai.String("none")}
+	}
+	if req.Format != nil {
+		// Models without structured outputs at least get the JSON mode, the schema is in the prompt then
+		if info, ok := GetModel(req.Model); ok && info.HasCapability(config.CapabilityStructuredOutput) {
+			params.ResponseFormat.OfJSONSchema = &shared.ResponseFormatJSONSchemaParam{
+				JSONSchema: shared.ResponseFormatJSONSchemaJSONSchemaParam{
+					Name:   req.Format.Name,
+					Schema: req.Format.Schema,
+				},
+			}
+		} else {
+			params.ResponseFormat.OfJSONObject = &shared.ResponseFormatJSONObjectParam{}
+		}
+	}
+	return params
+}
+
+// Copies the accumulated stream into a response
+func accumulatedResponse(req Request, acc openai.ChatCompletionAccumulator) Response {
+	response := Response{Model: req.Model, Usage: toUsage(acc.Usage)}
+	if acc.Model != "" {
+		response.Model = acc.Model
+	}
+	if len(acc.Choices) > 0 {
+		response.Content = acc.Choices[0].Message.Content
+		response.ToolCalls = fromOpenAIToolCalls(acc.Choices[0].Message.ToolCalls)
+		response.FinishReason = acc.Choices[0].FinishReason
+	}
+	return response
+}
+
+// Converts the usage of the OpenAI library
+func toUsage(usage openai.CompletionUsage) Usage {
+	return Usage{
+		PromptTokens:     usage.PromptTokens,
+		CompletionTokens: usage.CompletionTokens,
+		TotalTokens:      usage.TotalTokens,
+	}
+}
+
+// Converts the messages into the format of the OpenAI library
+func toOpenAIMessages(messages []ChatMessage) []openai.ChatCompletionMessageParamUnion {
+	converted := make([]openai.ChatCompletionMessageParamUnion, 0, len(messages))
+	for _, message := range messages {
+		switch message.Role {
+		case "system":
+			converted = append(converted, openai.SystemMessage(message.Content))
+		case "assistant":
+			if len(message.ToolCalls) == 0 {
+				converted = append(converted, openai.AssistantMessage(message.Content))
+				continue
+			}
+			assistant := openai.ChatCompletionAssistantMessageParam{}
+			if message.Content != "" {
+				assistant.Content.OfString = openai.String(message.Content)
+			}
+			for _, call := range message.ToolCalls {
+				assistant.ToolCalls = append(assistant.ToolCalls, openai.ChatCompletionMessageToolCallParam{
+					ID: call.ID,
+					Function: openai.ChatCompletionMessageToolCallFunctionParam{
+						Name:      call.Name,
+						Arguments: call.Arguments,
+					},
+				})
+			}
+			converted = append(converted, openai.ChatCompletionMessageParamUnion{OfAssistant: &assistant})
+		case "tool":
+			converted = append(converted, openai.ToolMessage(message.Content, message.ToolCallID))
+		default:
+			converted = append(converted, openai.UserMessage(message.Content))
+		}
+	}
+	return converted
+}
+
+// Converts the tool calls of the OpenAI library
+func fromOpenAIToolCalls(calls []openai.ChatCompletionMessageToolCall) []ToolCall {
+	var converted []ToolCall
+	for _, call := range calls {
+		converted = append(converted, ToolCall{
+			ID:        call.ID,
+			Name:      call.Function.Name,
+			Arguments: call.Function.Arguments,
+		})
+	}
+	return converted
+}
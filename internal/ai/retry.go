@@ -0,0 +1,158 @@
+package ai
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"math/rand/v2"
+	"sync"
+	"time"
+
+	"github.com/roly-backend/internal/config"
+)
+
+// Wraps a provider with retries (exponential backoff with jitter), support for Retry-After and a circuit breaker per model.
+// All errors are returned as *Error
+type ReliableProvider struct {
+	inner            Provider
+	maxRetries       int
+	baseDelay        time.Duration
+	maxDelay         time.Duration
+	maxRetryAfter    time.Duration // If the provider asks us to wait longer than this, we give up at once
+	failureThreshold int
+	openDuration     time.Duration
+
+	breakersMutex sync.Mutex
+	breakers      map[string]*circuitBreaker
+}
+
+// Creates a reliable provider with the settings from the config
+func NewReliableProvider(inner Provider) *ReliableProvider {
+	return &ReliableProvider{
+		inner:            inner,
+		maxRetries:       config.AIMaxRetries,
+		baseDelay:        config.AIRetryBaseDelay,
+		maxDelay:         config.AIRetryMaxDelay,
+		maxRetryAfter:    config.AIMaxRetryAfter,
+		failureThreshold: config.AICircuitFailureThreshold,
+		openDuration:     config.AICircuitOpenDuration,
+		breakers:         make(map[string]*circuitBreaker),
+	}
+}
+
+// Sends the request and retries it if the provider has temporary problems
+func (p *ReliableProvider) Complete(ctx context.Context, req Request) (Response, error) {
+	return p.do(ctx, req, func() (Response, error) {
+		return p.inner.Complete(ctx, req)
+	}, func() bool { return true })
+}
+
+// Streams the request and retries it if the provider has temporary problems.
+// A stream is only retried as long as no text was passed to onDelta, otherwise the client would get the text twice
+func (p *ReliableProvider) Stream(ctx context.Context, req Request, onDelta func(delta string) error) (Response, error) {
+	streamed := false
+	return p.do(ctx, req, func() (Response, error) {
+		return p.inner.Stream(ctx, req, func(delta string) error {
+			streamed = true
+			return onDelta(delta)
+		})
+	}, func() bool { return !streamed })
+}
+
+// Counts the tokens with the wrapped provider
+func (p *ReliableProvider) CountTokens(model string, messages []ChatMessage) int {
+	return p.inner.CountTokens(model, messages)
+}
+
+// Classifies the text with the wrapped provider if it has a classifier
+func (p *ReliableProvider) Moderate(ctx context.Context, text string) (ModerationResult, error) {
+	moderator, ok := p.inner.(Moderator)
+	if !ok {
+		return ModerationResult{}, errNoModerator
+	}
+	return moderator.Moderate(ctx, text)
+}
+
+var errNoModerator = errors.New("the provider has no moderation classifier")
+
+// Checks if the circuit breaker of the model rejects requests at the moment
+func (p *ReliableProvider) IsCircuitOpen(model string) bool {
+	return p.breaker(model).isOpen()
+}
+
+var errCircuitOpen = errors.New("the model failed too often, requests are paused")
+
+// Runs the attempt until it succeeds, fails with an error that can't be retried or the retries are used up.
+// canRetry is asked before every retry
+func (p *ReliableProvider) do(ctx context.Context, req Request, attempt func() (Response, error), canRetry func() bool) (Response, error) {
+	breaker := p.breaker(req.Model)
+
+	for try := 0; ; try++ {
+		if !breaker.allow() {
+			return Response{Model: req.Model}, &Error{Kind: ErrKindCircuitOpen, Model: req.Model, Err: errCircuitOpen}
+		}
+
+		response, err := attempt()
+		if err == nil {
+			breaker.success()
+			return response, nil
+		}
+
+		aiErr := classifyError(req.Model, err)
+		if !aiErr.Retryable() {
+			// Errors caused by the request or the caller don't say anything about the health of the model
+			breaker.release()
+			return response, aiErr
+		}
+		breaker.failure()
+
+		if try >= p.maxRetries || !canRetry() {
+			return response, aiErr
+		}
+
+		delay := p.backoff(try)
+		if aiErr.RetryAfter > 0 {
+			if aiErr.RetryAfter > p.maxRetryAfter {
+				return response, aiErr
+			}
+			delay = aiErr.RetryAfter
+		}
+
+		slog.LogAttrs(ctx, slog.LevelWarn, "AI request failed, retrying",
+			slog.String("model", req.Model),
+			slog.String("kind", string(aiErr.Kind)),
+			slog.Int("status_code", aiErr.StatusCode),
+			slog.Int("try", try+1),
+			slog.Duration("delay", delay),
+			slog.String("error", err.Error()),
+		)
+
+		select {
+		case <-ctx.Done():
+			return response, classifyError(req.Model, ctx.Err())
+		case <-time.After(delay):
+		}
+	}
+}
+
+// Returns the delay before the next try: a random duration up to baseDelay * 2^try ("full jitter"), but at most maxDelay
+func (p *ReliableProvider) backoff(try int) time.Duration {
+	ceiling := p.baseDelay << try
+	if ceiling <= 0 || ceiling > p.maxDelay {
+		ceiling = p.maxDelay
+	}
+	return time.Duration(rand.Int64N(int64(ceiling) + 1))
+}
+
+// Returns the circuit breaker of the model
+func (p *ReliableProvider) breaker(model string) *circuitBreaker {
+	p.breakersMutex.Lock()
+	defer p.breakersMutex.Unlock()
+
+	breaker, ok := p.breakers[model]
+	if !ok {
+		breaker = newCircuitBreaker(p.failureThreshold, p.openDuration)
+		p.breakers[model] = breaker
+	}
+	return breaker
+}
@@ -0,0 +1,136 @@
+package ai
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// Provider that fails with the given errors one after another and then answers
+type flakyProvider struct {
+	FakeProvider
+	errs  []error
+	calls int
+}
+
+func (p *flakyProvider) Complete(ctx context.Context, req Request) (Response, error) {
+	p.calls++
+	if p.calls <= len(p.errs) {
+		return Response{Model: req.Model}, p.errs[p.calls-1]
+	}
+	return p.FakeProvider.Complete(ctx, req)
+}
+
+func (p *flakyProvider) Stream(ctx context.Context, req Request, onDelta func(delta string) error) (Response, error) {
+	p.calls++
+	if p.calls <= len(p.errs) {
+		onDelta("partial ")
+		return Response{Model: req.Model}, p.errs[p.calls-1]
+	}
+	return p.FakeProvider.Stream(ctx, req, onDelta)
+}
+
+// Creates a reliable provider with short delays for the tests
+func newTestReliableProvider(inner Provider) *ReliableProvider {
+	p := NewReliableProvider(inner)
+	p.maxRetries = 3
+	p.baseDelay = time.Millisecond
+	p.maxDelay = 5 * time.Millisecond
+	p.maxRetryAfter = 50 * time.Millisecond
+	p.failureThreshold = 2
+	p.openDuration = time.Hour
+	return p
+}
+
+var testRequest = Request{Model: "test-model", Messages: []ChatMessage{{Role: "user", Content: "Hi"}}}
+
+func TestReliableProviderRetriesTemporaryErrors(t *testing.T) {
+	inner := &flakyProvider{
+		FakeProvider: *NewFakeProvider("Hello"),
+		errs:         []error{&Error{Kind: ErrKindRateLimited, RetryAfter: time.Millisecond}},
+	}
+	provider := newTestReliableProvider(inner)
+
+	response, err := provider.Complete(context.Background(), testRequest)
+	if err != nil {
+		t.Fatalf("Expected the retry to succeed, got %v", err)
+	}
+	if response.Content != "Hello" || inner.calls != 2 {
+		t.Errorf("Unexpected response %+v after %d calls", response, inner.calls)
+	}
+}
+
+func TestReliableProviderDoesNotRetryInvalidRequests(t *testing.T) {
+	inner := &flakyProvider{errs: []error{&Error{Kind: ErrKindInvalidRequest}}}
+	provider := newTestReliableProvider(inner)
+
+	_, err := provider.Complete(context.Background(), testRequest)
+	var aiErr *Error
+	if !errors.As(err, &aiErr) || aiErr.Kind != ErrKindInvalidRequest || inner.calls != 1 {
+		t.Errorf("Expected one call with an invalid request error, got %v after %d calls", err, inner.calls)
+	}
+}
+
+func TestReliableProviderDoesNotRetryStartedStreams(t *testing.T) {
+	inner := &flakyProvider{errs: []error{&Error{Kind: ErrKindUnavailable}}}
+	provider := newTestReliableProvider(inner)
+
+	_, err := provider.Stream(context.Background(), testRequest, func(delta string) error { return nil })
+	if err == nil || inner.calls != 1 {
+		t.Errorf("Expected the stream to fail without retry, got %v after %d calls", err, inner.calls)
+	}
+}
+
+func TestReliableProviderOpensCircuit(t *testing.T) {
+	unavailable := &Error{Kind: ErrKindUnavailable}
+	inner := &flakyProvider{errs: []error{unavailable, unavailable, unavailable, unavailable}}
+	provider := newTestReliableProvider(inner)
+
+	_, err := provider.Complete(context.Background(), testRequest)
+	var aiErr *Error
+	if !errors.As(err, &aiErr) || aiErr.Kind != ErrKindCircuitOpen {
+		t.Fatalf("Expected the circuit to open, got %v", err)
+	}
+	if inner.calls != 2 || !provider.IsCircuitOpen("test-model") {
+		t.Errorf("Expected 2 calls before the circuit opened, got %d", inner.calls)
+	}
+
+	// Other models are not affected
+	if provider.IsCircuitOpen("other-model") {
+		t.Errorf("Circuit of another model is open")
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	tests := []struct {
+		header http.Header
+		want   time.Duration
+	}{
+		{http.Header{"Retry-After": {"2"}}, 2 * time.Second},
+		{http.Header{"Retry-After-Ms": {"150"}}, 150 * time.Millisecond},
+		{http.Header{}, 0},
+		{http.Header{"Retry-After": {"soon"}}, 0},
+	}
+	for _, test := range tests {
+		if got := parseRetryAfter(test.header); got != test.want {
+			t.Errorf("parseRetryAfter(%v) = %v, want %v", test.header, got, test.want)
+		}
+	}
+}
+
+func TestCompleteWithFallbackUsesNextModel(t *testing.T) {
+	inner := &flakyProvider{
+		FakeProvider: *NewFakeProvider("Hello"),
+		errs:         []error{&Error{Kind: ErrKindUnavailable}},
+	}
+
+	response, err := CompleteWithFallback(context.Background(), inner, Request{Model: "gpt-4.1-mini"}, []string{"gpt-4.1-nano"})
+	if err != nil {
+		t.Fatalf("Expected the fallback model to answer, got %v", err)
+	}
+	if response.Model != "gpt-4.1-nano" || inner.calls != 2 {
+		t.Errorf("Expected gpt-4.1-nano to answer after 2 calls, got %s after %d calls", response.Model, inner.calls)
+	}
+}
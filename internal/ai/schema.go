@@ -0,0 +1,238 @@
+package ai
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// Format the answer of the model has to follow
+type ResponseFormat struct {
+	Name   string         // Name of the schema (letters, digits, underscores and dashes)
+	Schema map[string]any // JSON schema the answer has to match
+}
+
+// Parses a JSON schema and checks that it uses only keywords the validator understands
+func ParseSchema(schema string) (map[string]any, error) {
+	var parsed map[string]any
+	if err := json.Unmarshal([]byte(schema), &parsed); err != nil {
+		return nil, fmt.Errorf("schema is not a JSON object: %w", err)
+	}
+	if err := checkSchema(parsed, "$"); err != nil {
+		return nil, err
+	}
+	return parsed, nil
+}
+
+// Types of JSON schema. Besides type the validator understands properties, required, additionalProperties, items, enum,
+// minItems, maxItems, minLength, maxLength, minimum and maximum. Other keywords (like descriptions) are allowed but ignored
+var schemaTypes = map[string]bool{"object": true, "array": true, "string": true, "number": true, "integer": true, "boolean": true, "null": true}
+
+// Checks the schema recursively
+func checkSchema(schema map[string]any, path string) error {
+	for _, typeName := range schemaTypeNames(schema) {
+		if !schemaTypes[typeName] {
+			return fmt.Errorf("%s: unknown type %q", path, typeName)
+		}
+	}
+	if properties, ok := schema["properties"]; ok {
+		propertyMap, ok := properties.(map[string]any)
+		if !ok {
+			return fmt.Errorf("%s: properties has to be an object", path)
+		}
+		for name, property := range propertyMap {
+			propertySchema, ok := property.(map[string]any)
+			if !ok {
+				return fmt.Errorf("%s.%s: schema has to be an object", path, name)
+			}
+			if err := checkSchema(propertySchema, path+"."+name); err != nil {
+				return err
+			}
+		}
+	}
+	if items, ok := schema["items"]; ok {
+		itemSchema, ok := items.(map[string]any)
+		if !ok {
+			return fmt.Errorf("%s: items has to be an object", path)
+		}
+		if err := checkSchema(itemSchema, path+"[]"); err != nil {
+			return err
+		}
+	}
+	if required, ok := schema["required"]; ok {
+		if _, ok := required.([]any); !ok {
+			return fmt.Errorf("%s: required has to be an array", path)
+		}
+	}
+	return nil
+}
+
+// Checks that the JSON data matches the schema. The error describes the first mismatch so the model can correct it
+func ValidateJSON(schema map[string]any, data []byte) error {
+	var value any
+	if err := json.Unmarshal(data, &value); err != nil {
+		return fmt.Errorf("answer is not valid JSON: %w", err)
+	}
+	return validateValue(schema, value, "$")
+}
+
+// Validates a value against its schema
+func validateValue(schema map[string]any, value any, path string) error {
+	if types := schemaTypeNames(schema); len(types) > 0 {
+		matches := false
+		for _, typeName := range types {
+			if hasType(value, typeName) {
+				matches = true
+				break
+			}
+		}
+		if !matches {
+			return fmt.Errorf("%s: expected %s", path, strings.Join(types, " or "))
+		}
+	}
+
+	if enum, ok := schema["enum"].([]any); ok {
+		found := false
+		for _, allowed := range enum {
+			if reflect.DeepEqual(allowed, value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s: value is not one of the allowed values", path)
+		}
+	}
+
+	switch typed := value.(type) {
+	case map[string]any:
+		return validateObject(schema, typed, path)
+	case []any:
+		if min, ok := schemaNumber(schema, "minItems"); ok && float64(len(typed)) < min {
+			return fmt.Errorf("%s: expected at least %v items", path, min)
+		}
+		if max, ok := schemaNumber(schema, "maxItems"); ok && float64(len(typed)) > max {
+			return fmt.Errorf("%s: expected at most %v items", path, max)
+		}
+		if items, ok := schema["items"].(map[string]any); ok {
+			for i, item := range typed {
+				if err := validateValue(items, item, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+					return err
+				}
+			}
+		}
+	case string:
+		length := float64(utf8.RuneCountInString(typed))
+		if min, ok := schemaNumber(schema, "minLength"); ok && length < min {
+			return fmt.Errorf("%s: expected at least %v characters", path, min)
+		}
+		if max, ok := schemaNumber(schema, "maxLength"); ok && length > max {
+			return fmt.Errorf("%s: expected at most %v characters", path, max)
+		}
+	case float64:
+		if min, ok := schemaNumber(schema, "minimum"); ok && typed < min {
+			return fmt.Errorf("%s: expected at least %v", path, min)
+		}
+		if max, ok := schemaNumber(schema, "maximum"); ok && typed > max {
+			return fmt.Errorf("%s: expected at most %v", path, max)
+		}
+	}
+	return nil
+}
+
+// Validates the properties of an object
+func validateObject(schema map[string]any, object map[string]any, path string) error {
+	if required, ok := schema["required"].([]any); ok {
+		for _, name := range required {
+			if nameString, ok := name.(string); ok {
+				if _, exists := object[nameString]; !exists {
+					return fmt.Errorf("%s.%s: property is required", path, nameString)
+				}
+			}
+		}
+	}
+
+	properties, _ := schema["properties"].(map[string]any)
+	// Sorted so the error message is always the same for the same answer
+	names := make([]string, 0, len(object))
+	for name := range object {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		propertySchema, ok := properties[name].(map[string]any)
+		if ok {
+			if err := validateValue(propertySchema, object[name], path+"."+name); err != nil {
+				return err
+			}
+			continue
+		}
+
+		switch additional := schema["additionalProperties"].(type) {
+		case bool:
+			if !additional {
+				return fmt.Errorf("%s.%s: property is not allowed", path, name)
+			}
+		case map[string]any:
+			if err := validateValue(additional, object[name], path+"."+name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Returns the types of the schema ("type" can be a string or a list of strings)
+func schemaTypeNames(schema map[string]any) []string {
+	switch typed := schema["type"].(type) {
+	case string:
+		return []string{typed}
+	case []any:
+		var names []string
+		for _, name := range typed {
+			if nameString, ok := name.(string); ok {
+				names = append(names, nameString)
+			}
+		}
+		return names
+	}
+	return nil
+}
+
+// Checks if the decoded JSON value has the type
+func hasType(value any, typeName string) bool {
+	switch typeName {
+	case "object":
+		_, ok := value.(map[string]any)
+		return ok
+	case "array":
+		_, ok := value.([]any)
+		return ok
+	case "string":
+		_, ok := value.(string)
+		return ok
+	case "number":
+		_, ok := value.(float64)
+		return ok
+	case "integer":
+		number, ok := value.(float64)
+		return ok && number == math.Trunc(number)
+	case "boolean":
+		_, ok := value.(bool)
+		return ok
+	case "null":
+		return value == nil
+	}
+	return false
+}
+
+// Returns a numeric keyword of the schema
+func schemaNumber(schema map[string]any, keyword string) (float64, bool) {
+	number, ok := schema[keyword].(float64)
+	return number, ok
+}
@@ -0,0 +1,122 @@
+package ai
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/roly-backend/internal/config"
+)
+
+const quizSchema = `{
+	"type": "object",
+	"properties": {
+		"question": {"type": "string", "minLength": 1},
+		"answers": {"type": "array", "items": {"type": "string"}, "minItems": 2},
+		"correct": {"type": "integer", "minimum": 0},
+		"difficulty": {"enum": ["easy", "hard"]}
+	},
+	"required": ["question", "answers", "correct"],
+	"additionalProperties": false
+}`
+
+func TestValidateJSON(t *testing.T) {
+	schema, err := ParseSchema(quizSchema)
+	if err != nil {
+		t.Fatalf("Error parsing schema: %v", err)
+	}
+
+	tests := []struct {
+		data  string
+		valid bool
+	}{
+		{`{"question": "2+2?", "answers": ["3", "4"], "correct": 1}`, true},
+		{`{"question": "2+2?", "answers": ["3", "4"], "correct": 1, "difficulty": "easy"}`, true},
+		{`{"question": "2+2?", "answers": ["3", "4"]}`, false},                                       // missing property
+		{`{"question": "2+2?", "answers": ["4"], "correct": 0}`, false},                              // too few items
+		{`{"question": "2+2?", "answers": ["3", 4], "correct": 1}`, false},                           // wrong item type
+		{`{"question": "2+2?", "answers": ["3", "4"], "correct": 1.5}`, false},                       // not an integer
+		{`{"question": "2+2?", "answers": ["3", "4"], "correct": 1, "difficulty": "medium"}`, false}, // not in enum
+		{`{"question": "2+2?", "answers": ["3", "4"], "correct": 1, "extra": true}`, false},          // additional property
+		{`not json`, false},
+	}
+	for _, test := range tests {
+		err := ValidateJSON(schema, []byte(test.data))
+		if (err == nil) != test.valid {
+			t.Errorf("ValidateJSON(%s) = %v, expected valid = %v", test.data, err, test.valid)
+		}
+	}
+}
+
+func TestParseSchemaRejectsUnknownTypes(t *testing.T) {
+	if _, err := ParseSchema(`{"type": "text"}`); err == nil {
+		t.Errorf("Expected an error for an unknown type")
+	}
+	if _, err := ParseSchema(`[1, 2]`); err == nil {
+		t.Errorf("Expected an error for a schema that is not an object")
+	}
+}
+
+func TestCompleteStructuredRetriesInvalidAnswers(t *testing.T) {
+	schema, _ := ParseSchema(quizSchema)
+	provider := NewFakeProvider("Sure, here is your quiz!", "```json\n{\"question\": \"2+2?\", \"answers\": [\"3\", \"4\"], \"correct\": 1}\n```")
+
+	_, data, err := CompleteStructured(context.Background(), provider, Request{Model: "gpt-4.1-nano"}, ResponseFormat{Name: "quiz", Schema: schema}, nil)
+	if err != nil {
+		t.Fatalf("Expected the second answer to be valid, got %v", err)
+	}
+	if string(data) != `{"question": "2+2?", "answers": ["3", "4"], "correct": 1}` {
+		t.Errorf("Unexpected data: %s", data)
+	}
+
+	requests := provider.Requests()
+	if len(requests) != 2 {
+		t.Fatalf("Expected 2 requests, got %d", len(requests))
+	}
+	// The second request contains the invalid answer and the validation error
+	last := requests[1].Messages[len(requests[1].Messages)-1]
+	if last.Role != "user" {
+		t.Errorf("Expected a correction message, got %+v", last)
+	}
+}
+
+func TestCompleteStructuredGivesUp(t *testing.T) {
+	schema, _ := ParseSchema(quizSchema)
+	provider := NewFakeProvider("no json")
+
+	response, _, err := CompleteStructured(context.Background(), provider, Request{Model: "gpt-4.1-nano"}, ResponseFormat{Name: "quiz", Schema: schema}, nil)
+	if !errors.Is(err, ErrInvalidStructuredOutput) {
+		t.Errorf("Expected ErrInvalidStructuredOutput, got %v", err)
+	}
+
+	// The failed tries are still charged
+	var expected int64
+	for _, request := range provider.Requests() {
+		expected += int64(EstimateTokens(request.Messages) + EstimateTextTokens("no json"))
+	}
+	if response.Model != "gpt-4.1-nano" || response.Usage.TotalTokens != expected || expected == 0 {
+		t.Errorf("Expected the usage of all tries (%d tokens), got %+v", expected, response)
+	}
+}
+
+func TestCompleteStructuredRetriesWithTheModelOfTheChain(t *testing.T) {
+	useModels(t, []config.ModelConfig{{ID: "test-model"}, {ID: "test-fallback"}})
+	schema, _ := ParseSchema(quizSchema)
+	// The first model is unavailable, the fallback answers with a dated version of its ID and invalid JSON
+	inner := &flakyProvider{
+		FakeProvider: *NewFakeProvider("no json", `{"question": "2+2?", "answers": ["3", "4"], "correct": 1}`),
+		errs:         []error{&Error{Kind: ErrKindUnavailable}},
+	}
+
+	response, _, err := CompleteStructured(context.Background(), datedProvider{inner}, testRequest, ResponseFormat{Name: "quiz", Schema: schema}, []string{"test-fallback"})
+	if err != nil {
+		t.Fatalf("Expected the second answer to be valid, got %v", err)
+	}
+	requests := inner.Requests()
+	if len(requests) != 2 || requests[1].Model != "test-fallback" {
+		t.Errorf("Expected the retry to use test-fallback, got %+v", requests)
+	}
+	if response.ChainModel != "test-fallback" {
+		t.Errorf("Expected test-fallback to answer, got %s", response.ChainModel)
+	}
+}
@@ -0,0 +1,69 @@
+package ai
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/roly-backend/internal/config"
+)
+
+var ErrInvalidStructuredOutput = errors.New("the AI didn't answer with JSON that matches the schema")
+
+// Lets the model answer with JSON that matches the schema of the format. Invalid answers are sent back to the model
+// together with the validation error, up to config.StructuredOutputRetries times.
+// The usage of the response contains the tokens of all tries, also if no try matched the schema
+func CompleteStructured(ctx context.Context, provider Provider, req Request, format ResponseFormat, fallbacks []string) (Response, json.RawMessage, error) {
+	schema, err := json.Marshal(format.Schema)
+	if err != nil {
+		return Response{}, nil, err
+	}
+
+	req.Format = &format
+	req.Tools = nil
+	// The schema is also part of the prompt so models without structured outputs know it too
+	req.Messages = append(append([]ChatMessage(nil), req.Messages...), ChatMessage{
+		Role:    "system",
+		Content: "Answer only with a JSON value that matches this JSON schema, without any other text:\n" + string(schema),
+	})
+
+	var total Usage
+	var validationErr error
+	for try := 0; try <= config.StructuredOutputRetries; try++ {
+		response, err := CompleteWithFallback(ctx, provider, req, fallbacks)
+		total = addUsage(total, response.Usage)
+		response.Usage = total
+		if err != nil {
+			return response, nil, err
+		}
+
+		content := stripCodeFence(response.Content)
+		validationErr = ValidateJSON(format.Schema, []byte(content))
+		if validationErr == nil {
+			return response, json.RawMessage(content), nil
+		}
+
+		// The model of the chain that answered gets the chance to correct its answer
+		req.Model = response.ChainModel
+		fallbacks = nil
+		req.Messages = append(req.Messages,
+			ChatMessage{Role: "assistant", Content: response.Content},
+			ChatMessage{Role: "user", Content: fmt.Sprintf("Your answer doesn't match the schema (%v). Answer again with valid JSON only.", validationErr)},
+		)
+	}
+	return Response{Model: req.Model, Usage: total}, nil, fmt.Errorf("%w: %v", ErrInvalidStructuredOutput, validationErr)
+}
+
+// Removes a markdown code fence around the JSON that some models add even in JSON mode
+func stripCodeFence(content string) string {
+	content = strings.TrimSpace(content)
+	if !strings.HasPrefix(content, "```") {
+		return content
+	}
+	content = strings.TrimPrefix(content, "```json")
+	content = strings.TrimPrefix(content, "```")
+	content = strings.TrimSuffix(content, "```")
+	return strings.TrimSpace(content)
+}
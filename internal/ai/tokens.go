@@ -0,0 +1,27 @@
+package ai
+
+import "unicode/utf8"
+
+// Tokens that every message needs in addition to its content (role and separators)
+const tokensPerMessage = 4
+
+// Tokens that are added to every prompt because the answer of the assistant is primed with them
+const tokensPerReply = 3
+
+// Estimates how many tokens the messages need. There is no tokenizer for Go that knows every model,
+// so this uses the rule of thumb of OpenAI that one token is about four characters
+func EstimateTokens(messages []ChatMessage) int {
+	tokens := tokensPerReply
+	for _, message := range messages {
+		tokens += tokensPerMessage + EstimateTextTokens(message.Content)
+		for _, call := range message.ToolCalls {
+			tokens += EstimateTextTokens(call.Name) + EstimateTextTokens(call.Arguments)
+		}
+	}
+	return tokens
+}
+
+// Estimates how many tokens a text needs
+func EstimateTextTokens(text string) int {
+	return (utf8.RuneCountInString(text) + 3) / 4
+}
@@ -0,0 +1,112 @@
+package ai
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/roly-backend/internal/config"
+)
+
+// Callbacks of the tool loop. Every callback is optional
+type ToolLoopHooks struct {
+	OnDelta      func(delta string) error                              // A piece of text of the model
+	OnToolCall   func(content string, call ToolCall) error             // The model wants to call a tool. content is the text the model wrote before the call
+	OnToolResult func(call ToolCall, result string, failed bool) error // The tool was executed
+}
+
+// Streams the request and executes the tools the model calls until the model answers without a tool call.
+// After config.MaxToolRounds rounds the model has to answer without tools.
+// The usage of the response contains the tokens of all rounds
+func RunToolLoop(ctx context.Context, provider Provider, req Request, fallbacks []string, hooks ToolLoopHooks) (Response, error) {
+	onDelta := func(delta string) error {
+		if hooks.OnDelta != nil {
+			return hooks.OnDelta(delta)
+		}
+		return nil
+	}
+
+	var total Usage
+	messages := append([]ChatMessage(nil), req.Messages...)
+	for round := 0; ; round++ {
+		roundReq := req
+		roundReq.Messages = messages
+		roundReq.DisableTools = req.DisableTools || round >= config.MaxToolRounds
+
+		response, err := StreamWithFallback(ctx, provider, roundReq, fallbacks, onDelta)
+		total = addUsage(total, response.Usage)
+		response.Usage = total
+		if err != nil || len(response.ToolCalls) == 0 || len(req.Tools) == 0 || roundReq.DisableTools {
+			return response, err
+		}
+
+		// The same model answers the following rounds. The echoed Model can be a dated version that isn't in the registry
+		req.Model = response.ChainModel
+		fallbacks = nil
+
+		messages = append(messages, ChatMessage{Role: "assistant", Content: response.Content, ToolCalls: response.ToolCalls})
+		for i, call := range response.ToolCalls {
+			if hooks.OnToolCall != nil {
+				content := ""
+				if i == 0 {
+					content = response.Content
+				}
+				if err := hooks.OnToolCall(content, call); err != nil {
+					return response, err
+				}
+			}
+
+			result, failed := executeTool(ctx, req.Tools, call)
+			if hooks.OnToolResult != nil {
+				if err := hooks.OnToolResult(call, result, failed); err != nil {
+					return response, err
+				}
+			}
+			messages = append(messages, ChatMessage{Role: "tool", Content: result, ToolCallID: call.ID})
+		}
+	}
+}
+
+// Executes the tool call. Errors are returned as text so the model can react to them
+func executeTool(ctx context.Context, allowed []ToolDefinition, call ToolCall) (string, bool) {
+	// The model may only call the tools of the request, even if more tools are registered
+	permitted := false
+	for _, definition := range allowed {
+		if definition.Name == call.Name {
+			permitted = true
+			break
+		}
+	}
+	tool, ok := GetTool(call.Name)
+	if !permitted || !ok {
+		return fmt.Sprintf("Error: the tool %q does not exist", call.Name), true
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, config.ToolTimeout)
+	defer cancel()
+
+	started := time.Now()
+	result, err := tool.Call(ctx, json.RawMessage(call.Arguments))
+	if err != nil {
+		return fmt.Sprintf("Error: %v", err), true
+	}
+	if config.DebugMode {
+		slog.LogAttrs(ctx, slog.LevelDebug, "Tool was called by the AI",
+			slog.String("tool", call.Name),
+			slog.String("arguments", call.Arguments),
+			slog.Duration("duration", time.Since(started)),
+		)
+	}
+	return result, false
+}
+
+// Adds up the usage of two requests
+func addUsage(a, b Usage) Usage {
+	return Usage{
+		PromptTokens:     a.PromptTokens + b.PromptTokens,
+		CompletionTokens: a.CompletionTokens + b.CompletionTokens,
+		TotalTokens:      a.TotalTokens + b.TotalTokens,
+	}
+}
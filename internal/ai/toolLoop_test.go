@@ -0,0 +1,209 @@
+package ai
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/roly-backend/internal/config"
+)
+
+// Tool that returns its arguments and counts its calls
+type echoTool struct {
+	calls *int
+}
+
+func (echoTool) Name() string               { return "test_echo" }
+func (echoTool) Description() string        { return "Returns the arguments." }
+func (echoTool) Parameters() map[string]any { return map[string]any{"type": "object"} }
+
+func (t echoTool) Call(ctx context.Context, arguments json.RawMessage) (string, error) {
+	*t.calls++
+	return "echo " + string(arguments), nil
+}
+
+// Registers the echo tool and returns the counter of its calls
+func useEchoTool(t *testing.T) *int {
+	t.Helper()
+	calls := new(int)
+	RegisterTool(echoTool{calls: calls})
+	t.Cleanup(func() {
+		toolsMutex.Lock()
+		delete(tools, "test_echo")
+		toolsMutex.Unlock()
+	})
+	return calls
+}
+
+// Hooks that write every callback into the events
+func recordingHooks(events *[]string) ToolLoopHooks {
+	return ToolLoopHooks{
+		OnDelta: func(delta string) error {
+			*events = append(*events, "delta "+delta)
+			return nil
+		},
+		OnToolCall: func(content string, call ToolCall) error {
+			*events = append(*events, fmt.Sprintf("call %s %q", call.ID, content))
+			return nil
+		},
+		OnToolResult: func(call ToolCall, result string, failed bool) error {
+			*events = append(*events, fmt.Sprintf("result %s %t", call.ID, failed))
+			return nil
+		},
+	}
+}
+
+var echoCall = ToolCall{ID: "call-1", Name: "test_echo", Arguments: `{"text":"hi"}`}
+
+// Provider that answers with a dated version of the requested model like the OpenAI API does
+type datedProvider struct {
+	Provider
+}
+
+func (p datedProvider) Complete(ctx context.Context, req Request) (Response, error) {
+	response, err := p.Provider.Complete(ctx, req)
+	response.Model = req.Model + "-2025-04-14"
+	return response, err
+}
+
+func (p datedProvider) Stream(ctx context.Context, req Request, onDelta func(delta string) error) (Response, error) {
+	response, err := p.Provider.Stream(ctx, req, onDelta)
+	response.Model = req.Model + "-2025-04-14"
+	return response, err
+}
+
+func TestToolLoopCallsAllowedTool(t *testing.T) {
+	calls := useEchoTool(t)
+	provider := NewFakeToolProvider(
+		FakeReply{Content: "Let me check.", ToolCalls: []ToolCall{echoCall}},
+		FakeReply{Content: "It says hi."},
+	)
+	req := testRequest
+	req.Tools = ToolDefinitions([]string{"test_echo"})
+
+	var events []string
+	response, err := RunToolLoop(context.Background(), provider, req, nil, recordingHooks(&events))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.Content != "It says hi." || *calls != 1 {
+		t.Errorf("expected the answer after one tool call, got %q after %d calls", response.Content, *calls)
+	}
+
+	expected := []string{`delta Let `, `delta me `, `delta check.`, `call call-1 "Let me check."`, `result call-1 false`, `delta It `, `delta says `, `delta hi.`}
+	if !slices.Equal(events, expected) {
+		t.Errorf("expected the hooks in the order %q, got %q", expected, events)
+	}
+
+	// The second round sees the call and its result
+	requests := provider.Requests()
+	if len(requests) != 2 {
+		t.Fatalf("expected two rounds, got %d", len(requests))
+	}
+	messages := requests[1].Messages
+	call, result := messages[len(messages)-2], messages[len(messages)-1]
+	if call.Role != "assistant" || len(call.ToolCalls) != 1 || call.ToolCalls[0].ID != "call-1" {
+		t.Errorf("expected the assistant message with the call, got %+v", call)
+	}
+	if result.Role != "tool" || result.ToolCallID != "call-1" || result.Content != `echo {"text":"hi"}` {
+		t.Errorf("expected the result of the call, got %+v", result)
+	}
+
+	if prompt := int64(EstimateTokens(requests[0].Messages) + EstimateTokens(requests[1].Messages)); response.Usage.PromptTokens != prompt {
+		t.Errorf("expected the usage of both rounds, got %+v", response.Usage)
+	}
+}
+
+func TestToolLoopDeniesToolsOfOtherRoles(t *testing.T) {
+	calls := useEchoTool(t)
+	provider := NewFakeToolProvider(
+		FakeReply{ToolCalls: []ToolCall{echoCall}},
+		FakeReply{Content: "I can't."},
+	)
+	// The tool is registered, but the request only allows another one
+	req := testRequest
+	req.Tools = ToolDefinitions([]string{"current_time"})
+
+	var events []string
+	response, err := RunToolLoop(context.Background(), provider, req, nil, recordingHooks(&events))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *calls != 0 {
+		t.Errorf("expected the tool not to be called, got %d calls", *calls)
+	}
+	if !slices.Contains(events, "result call-1 true") || response.Content != "I can't." {
+		t.Errorf("expected a failed call, got %q", events)
+	}
+
+	messages := provider.Requests()[1].Messages
+	if result := messages[len(messages)-1]; !strings.Contains(result.Content, "does not exist") {
+		t.Errorf("expected the model to be told that the tool doesn't exist, got %q", result.Content)
+	}
+}
+
+func TestToolLoopStopsAfterMaxRounds(t *testing.T) {
+	previous := config.MaxToolRounds
+	config.MaxToolRounds = 2
+	t.Cleanup(func() { config.MaxToolRounds = previous })
+
+	calls := useEchoTool(t)
+	// The model wants to call the tool forever
+	provider := NewFakeToolProvider(FakeReply{Content: "Again.", ToolCalls: []ToolCall{echoCall}})
+	req := testRequest
+	req.Tools = ToolDefinitions([]string{"test_echo"})
+
+	response, err := RunToolLoop(context.Background(), provider, req, nil, ToolLoopHooks{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	requests := provider.Requests()
+	if len(requests) != 3 || *calls != 2 {
+		t.Fatalf("expected two rounds with tools and a last one without, got %d requests and %d calls", len(requests), *calls)
+	}
+	if requests[1].DisableTools || !requests[2].DisableTools {
+		t.Errorf("expected only the last round to disable the tools")
+	}
+	if len(response.ToolCalls) != 0 || response.Content != "Again." {
+		t.Errorf("expected an answer without tool calls, got %+v", response)
+	}
+}
+
+func TestToolLoopStopsOnHookError(t *testing.T) {
+	calls := useEchoTool(t)
+	provider := NewFakeToolProvider(FakeReply{ToolCalls: []ToolCall{echoCall}}, FakeReply{Content: "Done."})
+	req := testRequest
+	req.Tools = ToolDefinitions([]string{"test_echo"})
+
+	stop := errors.New("stop")
+	_, err := RunToolLoop(context.Background(), provider, req, nil, ToolLoopHooks{
+		OnToolCall: func(content string, call ToolCall) error { return stop },
+	})
+	if !errors.Is(err, stop) || *calls != 0 || len(provider.Requests()) != 1 {
+		t.Errorf("expected the loop to stop before the tool is called, got %v after %d calls", err, *calls)
+	}
+}
+
+func TestToolLoopKeepsTheModelOfTheChain(t *testing.T) {
+	useEchoTool(t)
+	provider := NewFakeToolProvider(FakeReply{ToolCalls: []ToolCall{echoCall}}, FakeReply{Content: "Done."})
+	req := testRequest
+	req.Tools = ToolDefinitions([]string{"test_echo"})
+
+	response, err := RunToolLoop(context.Background(), datedProvider{provider}, req, nil, ToolLoopHooks{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The second round asks for the model of the request, not for the dated version it answered with
+	requests := provider.Requests()
+	if len(requests) != 2 || requests[1].Model != testRequest.Model {
+		t.Errorf("expected the second round to use %s, got %+v", testRequest.Model, requests)
+	}
+	if response.Model != testRequest.Model+"-2025-04-14" || response.ChainModel != testRequest.Model {
+		t.Errorf("expected the dated model and the model of the chain, got %s and %s", response.Model, response.ChainModel)
+	}
+}
@@ -0,0 +1,70 @@
+package ai
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+)
+
+// A server side function that the model can call. Roles opt into tools by their name
+type Tool interface {
+	Name() string
+	Description() string
+	Parameters() map[string]any // JSON schema of the arguments
+	Call(ctx context.Context, arguments json.RawMessage) (string, error)
+}
+
+// Description of a tool that is sent to the model
+type ToolDefinition struct {
+	Name        string
+	Description string
+	Parameters  map[string]any
+}
+
+var (
+	toolsMutex sync.RWMutex
+	tools      = map[string]Tool{}
+)
+
+// Makes the tool available for roles. Registering a tool with the same name twice overwrites the old one
+func RegisterTool(tool Tool) {
+	toolsMutex.Lock()
+	defer toolsMutex.Unlock()
+	tools[tool.Name()] = tool
+}
+
+// Returns the tool with the name
+func GetTool(name string) (Tool, bool) {
+	toolsMutex.RLock()
+	defer toolsMutex.RUnlock()
+	tool, ok := tools[name]
+	return tool, ok
+}
+
+// Returns the names of all registered tools
+func ToolNames() []string {
+	toolsMutex.RLock()
+	defer toolsMutex.RUnlock()
+	names := make([]string, 0, len(tools))
+	for name := range tools {
+		names = append(names, name)
+	}
+	return names
+}
+
+// Returns the definitions of the tools with the names. Unknown names are skipped
+func ToolDefinitions(names []string) []ToolDefinition {
+	var definitions []ToolDefinition
+	for _, name := range names {
+		tool, ok := GetTool(name)
+		if !ok {
+			continue
+		}
+		definitions = append(definitions, ToolDefinition{
+			Name:        tool.Name(),
+			Description: tool.Description(),
+			Parameters:  tool.Parameters(),
+		})
+	}
+	return definitions
+}
@@ -1,3 +1,162 @@
 package chats
 
-// TODO: create chat, listChats
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/roly-backend/internal/config"
+	"github.com/roly-backend/internal/moderation"
+	"github.com/roly-backend/internal/roles"
+	"github.com/roly-backend/internal/users"
+)
+
+// Returns the chats of the user, paginated with ?limit=&offset=
+func ListChatsHandler(c *gin.Context) {
+	userID, err := users.GetUserID(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	limit, err1 := queryInt(c, "limit")
+	offset, err2 := queryInt(c, "offset")
+	if err1 != nil || err2 != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "limit and offset have to be numbers"})
+		return
+	}
+
+	page, err := ListChats(c.Request.Context(), userID, limit, offset)
+	if err != nil {
+		internalError(c, "Error listing chats", userID, err)
+		return
+	}
+	c.JSON(http.StatusOK, page)
+}
+
+// Creates a new chat and returns it
+func CreateChatHandler(c *gin.Context) {
+	userID, err := users.GetUserID(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	// The body is optional, a chat without title gets one later
+	var input NewChat
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&input); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	chat, err := CreateChat(c.Request.Context(), userID, input)
+	if err != nil {
+		chatError(c, "Error creating chat", userID, err)
+		return
+	}
+	c.JSON(http.StatusCreated, chat)
+}
+
+// Changes the title, the roles or the turn policy of a chat
+func UpdateChatHandler(c *gin.Context) {
+	userID, err := users.GetUserID(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	chatID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid chat id"})
+		return
+	}
+
+	var input ChatUpdate
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	chat, err := UpdateChat(c.Request.Context(), userID, chatID, input)
+	if err != nil {
+		chatError(c, "Error updating chat", userID, err)
+		return
+	}
+	c.JSON(http.StatusOK, chat)
+}
+
+// Deletes a chat with all its messages
+func DeleteChatHandler(c *gin.Context) {
+	userID, err := users.GetUserID(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	chatID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid chat id"})
+		return
+	}
+
+	if err := DeleteChat(c.Request.Context(), userID, chatID); err != nil {
+		chatError(c, "Error deleting chat", userID, err)
+		return
+	}
+
+	slog.LogAttrs(context.Background(), slog.LevelInfo, "Chat deleted",
+		slog.String("user_id", userID.String()),
+		slog.String("chat_id", chatID.String()),
+	)
+	c.Status(http.StatusNoContent)
+}
+
+// Sends the matching status for the errors of the service. Chats of other users are reported as not found so their ids aren't leaked
+func chatError(c *gin.Context, msg string, userID uuid.UUID, err error) {
+	var validationErr *roles.ValidationError
+	var blockedErr *moderation.BlockedError
+	switch {
+	case errors.Is(err, ErrChatNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Chat not found"})
+	case errors.Is(err, ErrRoleNotFound):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Role not found"})
+	case errors.Is(err, ErrTooManyRoles):
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("A chat can have at most %d roles", config.MaxChatRoles)})
+	case errors.Is(err, ErrDuplicateRole):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "A role can only be part of a chat once"})
+	case errors.Is(err, ErrInvalidTurnPolicy):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "turn_policy has to be round_robin, all or mention"})
+	case errors.As(err, &validationErr):
+		c.JSON(http.StatusBadRequest, gin.H{"error": validationErr.Error()})
+	case errors.As(err, &blockedErr):
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Content was blocked by the moderation", "stage": blockedErr.Stage})
+	case errors.Is(err, ErrTitleTooLong):
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Title must not be longer than %d characters", config.MaxChatTitleLength)})
+	default:
+		internalError(c, msg, userID, err)
+	}
+}
+
+// Logs the error and sends a generic error to the client
+func internalError(c *gin.Context, msg string, userID uuid.UUID, err error) {
+	slog.LogAttrs(context.Background(), slog.LevelError, msg,
+		slog.String("user_id", userID.String()),
+		slog.String("error", err.Error()),
+	)
+	// Sends error to client
+	c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+}
+
+// Reads an optional number from the query string (0 if it is missing)
+func queryInt(c *gin.Context, key string) (int, error) {
+	value := c.Query(key)
+	if value == "" {
+		return 0, nil
+	}
+	return strconv.Atoi(value)
+}
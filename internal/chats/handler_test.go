@@ -0,0 +1,62 @@
+package chats
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/roly-backend/internal/users"
+)
+
+func TestListChatsHandlerRejectsInvalidRequests(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	tests := []struct {
+		query      string
+		authorized bool
+		status     int
+	}{
+		{"", false, http.StatusUnauthorized},
+		{"?limit=ten", true, http.StatusBadRequest},
+		{"?limit=10&offset=-", true, http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		recorder := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(recorder)
+		c.Request = httptest.NewRequest(http.MethodGet, "/api/chats"+test.query, nil)
+		if test.authorized {
+			c.Set(string(users.UserContextKey), &users.Claims{UserID: uuid.NewString()})
+		}
+		ListChatsHandler(c)
+		if recorder.Code != test.status {
+			t.Errorf("expected %d for %q, got %d: %s", test.status, test.query, recorder.Code, recorder.Body.String())
+		}
+	}
+}
+
+func TestDeleteChatHandlerRejectsInvalidIDs(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	recorder := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(recorder)
+	c.Request = httptest.NewRequest(http.MethodDelete, "/api/chats/not-a-uuid", nil)
+	c.Params = gin.Params{{Key: "id", Value: "not-a-uuid"}}
+	c.Set(string(users.UserContextKey), &users.Claims{UserID: uuid.NewString()})
+
+	DeleteChatHandler(c)
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for an invalid chat id, got %d", recorder.Code)
+	}
+}
+
+// Chats of other users are reported like chats that don't exist
+func TestChatErrorHidesOtherUsersChats(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	recorder := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(recorder)
+
+	chatError(c, "Error updating chat", uuid.New(), ErrChatNotFound)
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("expected 404, got %d", recorder.Code)
+	}
+}
@@ -1,3 +1,498 @@
 package chats
 
-// TODO: alle weitere logik wieder
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/roly-backend/internal/config"
+	"github.com/roly-backend/internal/database"
+	"github.com/roly-backend/internal/moderation"
+	"github.com/roly-backend/internal/roles"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrChatNotFound = errors.New("chat not found")
+	ErrTitleTooLong = errors.New("title is too long")
+	ErrRoleNotFound = errors.New("role not found")
+
+	ErrTooManyRoles      = errors.New("chat has too many roles")
+	ErrDuplicateRole     = errors.New("role is part of the chat more than once")
+	ErrInvalidTurnPolicy = errors.New("invalid turn policy")
+)
+
+// A chat how the client gets it
+type ChatInfo struct {
+	ID         uuid.UUID         `json:"id"`
+	Title      string            `json:"title"`
+	RoleID     *uuid.UUID        `json:"role_id"`
+	RoleIDs    []uuid.UUID       `json:"role_ids"` // All roles of the chat in the order they answer
+	TurnPolicy string            `json:"turn_policy"`
+	Variables  map[string]string `json:"variables"` // Values of the parameters of the roles
+	CreatedAt  time.Time         `json:"created_at"`
+}
+
+// One page of the chats of a user
+type ChatPage struct {
+	Chats  []ChatInfo `json:"chats"`
+	Total  int64      `json:"total"` // Number of all chats of the user
+	Limit  int        `json:"limit"`
+	Offset int        `json:"offset"`
+}
+
+// Called after a chat changed, for example to push the change to the open connections of the user. Set by the server on startup
+var OnChatUpdated func(userID uuid.UUID, chat ChatInfo)
+
+// Passes the changed chat on to OnChatUpdated
+func notifyChatUpdated(ctx context.Context, chat database.Chat) {
+	if OnChatUpdated == nil {
+		return
+	}
+	roleIDs, err := RoleIDs(ctx, chat)
+	if err != nil {
+		slog.LogAttrs(ctx, slog.LevelError, "Error loading the roles of a changed chat",
+			slog.String("chat_id", chat.ID.String()),
+			slog.String("error", err.Error()),
+		)
+		return
+	}
+	OnChatUpdated(chat.UserID, toChatInfo(chat, roleIDs))
+}
+
+func toChatInfo(chat database.Chat, roleIDs []uuid.UUID) ChatInfo {
+	return ChatInfo{ID: chat.ID, Title: chat.Title, RoleID: chat.RoleID, RoleIDs: roleIDs, TurnPolicy: chat.TurnPolicy, Variables: chat.Variables, CreatedAt: chat.CreatedAt}
+}
+
+// Input for a new chat
+type NewChat struct {
+	Title      string            `json:"title"`
+	RoleID     *uuid.UUID        `json:"role_id"`     // A chat with a single role, ignored if role_ids is set
+	RoleIDs    []uuid.UUID       `json:"role_ids"`    // Roles of a group chat in the order they answer
+	TurnPolicy string            `json:"turn_policy"` // Which roles of a group chat answer (round_robin if empty)
+	Variables  map[string]string `json:"variables"`   // Values of the parameters of the roles and of user_name and language, used in the system prompts
+
+	ModeratorID *uuid.UUID `json:"-"` // Moderator of a debate, its parameters can be set as variables too although it doesn't answer in the chat
+}
+
+// Creates a new chat for the user. Every role has to be a default role or an own role of the user
+func CreateChat(ctx context.Context, userID uuid.UUID, input NewChat) (ChatInfo, error) {
+	title, err := cleanTitle(input.Title)
+	if err != nil {
+		return ChatInfo{}, err
+	}
+	roleIDs := input.RoleIDs
+	if len(roleIDs) == 0 && input.RoleID != nil {
+		roleIDs = []uuid.UUID{*input.RoleID}
+	}
+	parameters, err := checkRoles(ctx, userID, roleIDs)
+	if err != nil {
+		return ChatInfo{}, err
+	}
+	if input.ModeratorID != nil {
+		moderator, err := parametersOf(ctx, []uuid.UUID{*input.ModeratorID})
+		if err != nil {
+			return ChatInfo{}, err
+		}
+		parameters = append(parameters, moderator...)
+	}
+	chatID := uuid.New()
+	if err := checkVariables(ctx, userID, chatID, input.Variables, parameters); err != nil {
+		return ChatInfo{}, err
+	}
+	if input.TurnPolicy == "" {
+		input.TurnPolicy = database.TurnPolicyRoundRobin
+	}
+	if !validTurnPolicy(input.TurnPolicy) {
+		return ChatInfo{}, ErrInvalidTurnPolicy
+	}
+
+	chat := database.Chat{
+		ID:          chatID,
+		UserID:      userID,
+		Title:       title,
+		TitleManual: title != "",
+		RoleID:      firstRole(roleIDs),
+		TurnPolicy:  input.TurnPolicy,
+		Variables:   input.Variables,
+		CreatedAt:   time.Now(),
+	}
+	err = database.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&chat).Error; err != nil {
+			return err
+		}
+		return saveRoles(tx, chat.ID, roleIDs)
+	})
+	if err != nil {
+		return ChatInfo{}, err
+	}
+	return toChatInfo(chat, roleIDs), nil
+}
+
+// Returns the roles of the chat in the order they answer. Chats from before group chats existed only have Chat.RoleID
+func RoleIDs(ctx context.Context, chat database.Chat) ([]uuid.UUID, error) {
+	var rows []database.ChatRole
+	if err := database.DB.WithContext(ctx).Where("chat_id = ?", chat.ID).Order("position ASC").Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	return roleIDsOf(chat, rows), nil
+}
+
+// Returns the role ids of the rows, which have to be ordered by position
+func roleIDsOf(chat database.Chat, rows []database.ChatRole) []uuid.UUID {
+	roleIDs := make([]uuid.UUID, 0, len(rows))
+	for _, row := range rows {
+		roleIDs = append(roleIDs, row.RoleID)
+	}
+	if len(roleIDs) == 0 && chat.RoleID != nil {
+		roleIDs = append(roleIDs, *chat.RoleID)
+	}
+	return roleIDs
+}
+
+// Replaces the roles of the chat
+func saveRoles(tx *gorm.DB, chatID uuid.UUID, roleIDs []uuid.UUID) error {
+	if err := tx.Where("chat_id = ?", chatID).Delete(&database.ChatRole{}).Error; err != nil {
+		return err
+	}
+	if len(roleIDs) == 0 {
+		return nil
+	}
+	rows := make([]database.ChatRole, 0, len(roleIDs))
+	for i, roleID := range roleIDs {
+		rows = append(rows, database.ChatRole{ChatID: chatID, RoleID: roleID, Position: i})
+	}
+	return tx.Create(&rows).Error
+}
+
+// Returns the chats of the user, the newest first. The limit is capped at config.MaxChatsPageSize
+func ListChats(ctx context.Context, userID uuid.UUID, limit, offset int) (ChatPage, error) {
+	limit, offset = pageBounds(limit, offset)
+	page := ChatPage{Chats: []ChatInfo{}, Limit: limit, Offset: offset}
+	query := database.DB.WithContext(ctx).Model(&database.Chat{}).Where("user_id = ?", userID)
+	if err := query.Count(&page.Total).Error; err != nil {
+		return page, err
+	}
+
+	// The id makes the order stable for chats that were created at the same time
+	var chats []database.Chat
+	if err := query.Order("created_at DESC, id DESC").Limit(limit).Offset(offset).Find(&chats).Error; err != nil {
+		return page, err
+	}
+	if len(chats) == 0 {
+		return page, nil
+	}
+
+	// The roles of all chats of the page are loaded at once
+	chatIDs := make([]uuid.UUID, 0, len(chats))
+	for _, chat := range chats {
+		chatIDs = append(chatIDs, chat.ID)
+	}
+	var rows []database.ChatRole
+	if err := database.DB.WithContext(ctx).Where("chat_id IN ?", chatIDs).Order("position ASC").Find(&rows).Error; err != nil {
+		return page, err
+	}
+	rowsByChat := map[uuid.UUID][]database.ChatRole{}
+	for _, row := range rows {
+		rowsByChat[row.ChatID] = append(rowsByChat[row.ChatID], row)
+	}
+
+	for _, chat := range chats {
+		page.Chats = append(page.Chats, toChatInfo(chat, roleIDsOf(chat, rowsByChat[chat.ID])))
+	}
+	return page, nil
+}
+
+// Returns the limit and the offset of a page of chats. Without a limit the page has the default size
+func pageBounds(limit, offset int) (int, int) {
+	if limit <= 0 {
+		limit = config.DefaultChatsPageSize
+	}
+	if limit > config.MaxChatsPageSize {
+		limit = config.MaxChatsPageSize
+	}
+	if offset < 0 {
+		offset = 0
+	}
+	return limit, offset
+}
+
+// Fields of a chat the client can change. Fields that are nil stay unchanged
+type ChatUpdate struct {
+	Title      *string      `json:"title"`
+	RoleID     *uuid.UUID   `json:"role_id"`  // Makes the chat a chat with this single role. Messages that were already written keep the snapshot of the old role
+	RoleIDs    *[]uuid.UUID `json:"role_ids"` // Replaces all roles of the chat, takes priority over role_id
+	TurnPolicy *string      `json:"turn_policy"`
+
+	Variables *map[string]string `json:"variables"` // Replaces all variables of the chat. New snapshots are rendered with them, written messages keep theirs
+}
+
+// Changes the title, the roles, the turn policy or the variables of a chat of the user.
+// The variables are checked again when the roles change, since every variable has to be a parameter of one of the roles
+func UpdateChat(ctx context.Context, userID, chatID uuid.UUID, update ChatUpdate) (ChatInfo, error) {
+	chat, err := getChat(ctx, userID, chatID)
+	if err != nil {
+		return ChatInfo{}, err
+	}
+
+	changes := map[string]any{}
+	if update.Title != nil {
+		title, err := cleanTitle(*update.Title)
+		if err != nil {
+			return ChatInfo{}, err
+		}
+		chat.Title = title
+		changes["title"] = title
+		changes["title_manual"] = true
+	}
+	roleIDs := update.RoleIDs
+	if roleIDs == nil && update.RoleID != nil {
+		roleIDs = &[]uuid.UUID{*update.RoleID}
+	}
+	var parameters []database.RoleParameter
+	if roleIDs != nil {
+		if parameters, err = checkRoles(ctx, userID, *roleIDs); err != nil {
+			return ChatInfo{}, err
+		}
+		chat.RoleID = firstRole(*roleIDs)
+		changes["role_id"] = chat.RoleID
+	}
+	if roleIDs != nil || update.Variables != nil {
+		if err := updateVariables(ctx, &chat, roleIDs != nil, parameters, update.Variables); err != nil {
+			return ChatInfo{}, err
+		}
+	}
+	if update.TurnPolicy != nil {
+		if !validTurnPolicy(*update.TurnPolicy) {
+			return ChatInfo{}, ErrInvalidTurnPolicy
+		}
+		chat.TurnPolicy = *update.TurnPolicy
+		changes["turn_policy"] = chat.TurnPolicy
+	}
+	if len(changes) == 0 && update.Variables == nil {
+		return chatInfo(ctx, chat)
+	}
+
+	err = database.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if len(changes) > 0 {
+			if err := tx.Model(&chat).Updates(changes).Error; err != nil {
+				return err
+			}
+		}
+		// The variables are saved from the struct so they are serialized as JSON
+		if update.Variables != nil {
+			if err := tx.Model(&chat).Select("variables").Updates(&chat).Error; err != nil {
+				return err
+			}
+		}
+		if roleIDs == nil {
+			return nil
+		}
+		return saveRoles(tx, chat.ID, *roleIDs)
+	})
+	if err != nil {
+		return ChatInfo{}, err
+	}
+	notifyChatUpdated(ctx, chat)
+	return chatInfo(ctx, chat)
+}
+
+// Checks the new variables of the chat or, if only the roles changed, the current variables against the parameters of the roles.
+// newRoles tells if parameters belong to the new roles of the chat, otherwise the parameters of the current roles are loaded
+func updateVariables(ctx context.Context, chat *database.Chat, newRoles bool, parameters []database.RoleParameter, variables *map[string]string) error {
+	if !newRoles {
+		roleIDs, err := RoleIDs(ctx, *chat)
+		if err != nil {
+			return err
+		}
+		if parameters, err = parametersOf(ctx, roleIDs); err != nil {
+			return err
+		}
+	}
+	// The moderator of a debate uses the variables too
+	var debate database.Debate
+	err := database.DB.WithContext(ctx).Select("moderator_id").Where("chat_id = ?", chat.ID).Limit(1).Find(&debate).Error
+	if err != nil {
+		return err
+	}
+	if debate.ModeratorID != nil {
+		moderator, err := parametersOf(ctx, []uuid.UUID{*debate.ModeratorID})
+		if err != nil {
+			return err
+		}
+		parameters = append(parameters, moderator...)
+	}
+
+	if variables == nil {
+		return roles.ValidateVariables(chat.Variables, parameters)
+	}
+	if err := checkVariables(ctx, chat.UserID, chat.ID, *variables, parameters); err != nil {
+		return err
+	}
+	chat.Variables = *variables
+	return nil
+}
+
+// Checks the variables against the parameters of the roles. The values become part of the system prompts,
+// so they are moderated like messages of the user and values that look like instructions for the AI are rejected
+func checkVariables(ctx context.Context, userID, chatID uuid.UUID, variables map[string]string, parameters []database.RoleParameter) error {
+	if err := roles.ValidateVariables(variables, parameters); err != nil {
+		return err
+	}
+	for _, name := range slices.Sorted(maps.Keys(variables)) {
+		value := variables[name]
+		if _, err := moderation.Check(ctx, moderation.StageInput, moderation.Subject{UserID: userID, ChatID: chatID, Text: value}); err != nil {
+			return err
+		}
+		if moderation.GuardTurn(ctx, moderation.SourceChatVariable, userID, chatID, value).Suspicious() {
+			return &roles.ValidationError{Field: "variables", Message: fmt.Sprintf("%q looks like instructions for the AI", name)}
+		}
+	}
+	return nil
+}
+
+// Returns the parameters of the roles that still exist
+func parametersOf(ctx context.Context, roleIDs []uuid.UUID) ([]database.RoleParameter, error) {
+	if len(roleIDs) == 0 {
+		return nil, nil
+	}
+	var found []database.Role
+	if err := database.DB.WithContext(ctx).Select("parameters").Where("id IN ?", roleIDs).Find(&found).Error; err != nil {
+		return nil, err
+	}
+	var parameters []database.RoleParameter
+	for _, role := range found {
+		parameters = append(parameters, role.Parameters...)
+	}
+	return parameters, nil
+}
+
+// Returns the chat together with its roles
+func chatInfo(ctx context.Context, chat database.Chat) (ChatInfo, error) {
+	roleIDs, err := RoleIDs(ctx, chat)
+	if err != nil {
+		return ChatInfo{}, err
+	}
+	return toChatInfo(chat, roleIDs), nil
+}
+
+// Saves a generated title, unless the chat got a title in the meantime or the user set one.
+// Returns false if the title wasn't saved
+func SetGeneratedTitle(ctx context.Context, chatID uuid.UUID, title string) (bool, error) {
+	title, err := cleanTitle(title)
+	if err != nil {
+		title = string([]rune(title)[:config.MaxChatTitleLength])
+	}
+	if title == "" {
+		return false, nil
+	}
+
+	// The condition is part of the update, so a title the user sets at the same time always wins
+	result := database.DB.WithContext(ctx).Model(&database.Chat{}).
+		Where("id = ? AND title_manual = ? AND title = ?", chatID, false, "").
+		Update("title", title)
+	if result.Error != nil || result.RowsAffected == 0 {
+		return false, result.Error
+	}
+
+	var chat database.Chat
+	if err := database.DB.WithContext(ctx).First(&chat, "id = ?", chatID).Error; err != nil {
+		return true, err
+	}
+	notifyChatUpdated(ctx, chat)
+	return true, nil
+}
+
+// Deletes a chat of the user together with its messages, summaries and debate.
+// Role snapshots stay since other chats can use them too, and the usage records stay so deleting a chat doesn't reset the quotas
+func DeleteChat(ctx context.Context, userID, chatID uuid.UUID) error {
+	chat, err := getChat(ctx, userID, chatID)
+	if err != nil {
+		return err
+	}
+
+	return database.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("chat_id = ?", chat.ID).Delete(&database.Message{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("chat_id = ?", chat.ID).Delete(&database.ChatSummary{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("chat_id = ?", chat.ID).Delete(&database.ChatRole{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("chat_id = ?", chat.ID).Delete(&database.Debate{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&chat).Error
+	})
+}
+
+// Returns the chat if it belongs to the user
+func getChat(ctx context.Context, userID, chatID uuid.UUID) (database.Chat, error) {
+	var chat database.Chat
+	if err := database.DB.WithContext(ctx).Where("id = ? AND user_id = ?", chatID, userID).First(&chat).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return chat, ErrChatNotFound
+		}
+		return chat, err
+	}
+	return chat, nil
+}
+
+// Checks that the user can use every role (a default role or an own role) and that no role is part of the chat twice.
+// A chat without a role is allowed. Returns the parameters of all roles
+func checkRoles(ctx context.Context, userID uuid.UUID, roleIDs []uuid.UUID) ([]database.RoleParameter, error) {
+	if len(roleIDs) > config.MaxChatRoles {
+		return nil, ErrTooManyRoles
+	}
+	var parameters []database.RoleParameter
+	seen := map[uuid.UUID]bool{}
+	for _, roleID := range roleIDs {
+		if seen[roleID] {
+			return nil, ErrDuplicateRole
+		}
+		seen[roleID] = true
+
+		role, err := roles.GetRole(ctx, userID, roleID)
+		if err != nil {
+			if errors.Is(err, roles.ErrRoleNotFound) {
+				return nil, ErrRoleNotFound
+			}
+			return nil, err
+		}
+		parameters = append(parameters, role.Parameters...)
+	}
+	return parameters, nil
+}
+
+// The first role answers in chats with a single role (null if there is no role)
+func firstRole(roleIDs []uuid.UUID) *uuid.UUID {
+	if len(roleIDs) == 0 {
+		return nil
+	}
+	return &roleIDs[0]
+}
+
+func validTurnPolicy(policy string) bool {
+	switch policy {
+	case database.TurnPolicyRoundRobin, database.TurnPolicyAll, database.TurnPolicyMention:
+		return true
+	}
+	return false
+}
+
+// Trims the title and checks its length
+func cleanTitle(title string) (string, error) {
+	title = strings.TrimSpace(title)
+	if len([]rune(title)) > config.MaxChatTitleLength {
+		return title, ErrTitleTooLong
+	}
+	return title, nil
+}
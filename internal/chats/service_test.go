@@ -0,0 +1,90 @@
+package chats
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/roly-backend/internal/config"
+	"github.com/roly-backend/internal/database"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// Replaces the database with one that only builds the queries and returns the SQL of every query.
+// Nothing is found, so only the queries up to the first lookup can be checked
+func recordQueries(t *testing.T) *[]string {
+	t.Helper()
+	db, err := gorm.Open(postgres.New(postgres.Config{DSN: "host=localhost"}), &gorm.Config{DryRun: true, DisableAutomaticPing: true, Logger: logger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var queries []string
+	err = db.Callback().Query().After("gorm:query").Register("test:record", func(tx *gorm.DB) {
+		queries = append(queries, tx.Dialector.Explain(tx.Statement.SQL.String(), tx.Statement.Vars...))
+		// Executed queries reset the statement, so the next query of the same chain builds its own SQL
+		tx.Statement.SQL.Reset()
+		tx.Statement.Vars = nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := database.DB
+	database.DB = db
+	t.Cleanup(func() { database.DB = previous })
+	return &queries
+}
+
+func TestPageBounds(t *testing.T) {
+	tests := []struct {
+		limit, offset                 int
+		expectedLimit, expectedOffset int
+	}{
+		{0, 0, config.DefaultChatsPageSize, 0},
+		{-5, -1, config.DefaultChatsPageSize, 0},
+		{10, 30, 10, 30},
+		{config.MaxChatsPageSize + 1, 0, config.MaxChatsPageSize, 0},
+	}
+	for _, test := range tests {
+		limit, offset := pageBounds(test.limit, test.offset)
+		if limit != test.expectedLimit || offset != test.expectedOffset {
+			t.Errorf("expected %d/%d for %d/%d, got %d/%d", test.expectedLimit, test.expectedOffset, test.limit, test.offset, limit, offset)
+		}
+	}
+}
+
+func TestListChatsOnlyListsOwnChats(t *testing.T) {
+	queries := recordQueries(t)
+	userID := uuid.New()
+
+	page, err := ListChats(context.Background(), userID, 1000, 40)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if page.Limit != config.MaxChatsPageSize || page.Offset != 40 || page.Chats == nil {
+		t.Errorf("unexpected page %+v", page)
+	}
+	if len(*queries) != 2 {
+		t.Fatalf("expected the count and the page query, got %q", *queries)
+	}
+	for _, query := range *queries {
+		if !strings.Contains(query, "user_id = '"+userID.String()+"'") {
+			t.Errorf("expected the query to be limited to the chats of the user: %s", query)
+		}
+	}
+	if page := (*queries)[1]; !strings.Contains(page, "ORDER BY created_at DESC, id DESC LIMIT 100 OFFSET 40") {
+		t.Errorf("expected the newest chats of the page first: %s", page)
+	}
+}
+
+func TestGetChatChecksTheOwner(t *testing.T) {
+	queries := recordQueries(t)
+	userID, chatID := uuid.New(), uuid.New()
+
+	getChat(context.Background(), userID, chatID)
+	if len(*queries) != 1 || !strings.Contains((*queries)[0], "id = '"+chatID.String()+"' AND user_id = '"+userID.String()+"'") {
+		t.Errorf("expected the chat to be looked up together with its owner, got %q", *queries)
+	}
+}
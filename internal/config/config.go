@@ -3,6 +3,7 @@ package config
 import (
 	"fmt"
 	"log/slog"
+	"time"
 )
 
 // Debug and Log Settings
@@ -15,3 +16,58 @@ var AllowedOrigins = map[string]bool{
 
 var Port int = 8080
 var MinPasswordLength int = 6
+
+// AI context settings
+var MaxContextTokens int = 16000       // Upper limit for the prompt tokens of one AI request even if the model could take more (keeps the costs low). 0 means no limit
+var ReservedOutputTokens int = 4096    // Tokens of the context window that are kept free for the answer of the AI
+var MinShortenedMessageTokens int = 50 // An old message is only shortened (instead of dropped) if at least this many tokens of it fit
+
+// Chat summary settings
+var SummaryModel string = "gpt-4.1-nano" // Cheap model that condenses the older messages of long chats
+var SummarizeAfterMessages int = 20      // A new summary is created as soon as this many messages are not covered by the summary yet
+var SummaryKeepRecentMessages int = 10   // The newest messages are never summarized so the AI still sees them word for word
+
+// Default usage limits per user (can be changed per user in the user_quotas table). 0 means no limit
+var DefaultDailyTokenLimit int64 = 200000
+var DefaultMonthlyTokenLimit int64 = 3000000
+var DefaultDailyCostLimit float64 = 0.50  // US dollars
+var DefaultMonthlyCostLimit float64 = 5.0 // US dollars
+
+// Models that are tried in this order when the chosen model fails or is paused (roles can have their own list)
+var FallbackModels = []string{"gpt-4.1-mini", "gpt-4.1-nano"}
+
+// Tool settings
+var MaxToolRounds int = 5                        // How often the AI may call tools before it has to answer
+var ToolTimeout time.Duration = 10 * time.Second // How long a single tool call may take
+
+// How often the AI gets the chance to correct an answer that doesn't match the output schema of the role
+var StructuredOutputRetries int = 2
+
+// Retry and circuit breaker settings for AI requests
+var AIMaxRetries int = 3                                    // How often a failed AI request is sent again
+var AIRetryBaseDelay time.Duration = 500 * time.Millisecond // Delay before the first retry, doubled with every retry
+var AIRetryMaxDelay time.Duration = 10 * time.Second        // Upper limit for the delay between retries
+var AIMaxRetryAfter time.Duration = 30 * time.Second        // If the provider wants us to wait longer than this, the request fails at once
+var AICircuitFailureThreshold int = 5                       // Failures in a row after which a model is paused
+var AICircuitOpenDuration time.Duration = 30 * time.Second  // How long a failing model is paused
+
+// Chat settings
+var MaxChatTitleLength int = 200
+var TitleModel string = "gpt-4.1-nano" // Cheap model that writes the titles of new chats
+var MaxChatRoles int = 5               // How many roles can take part in one group chat
+var DefaultChatsPageSize int = 20      // How many chats are listed if the client doesn't ask for a specific number
+var MaxChatsPageSize int = 100
+var MaxMessageLength int = 32000    // Characters of a single message of the user
+var DefaultHistoryPageSize int = 50 // How many messages of a chat are loaded if the client doesn't ask for a specific number
+var MaxHistoryPageSize int = 200
+
+// Debate settings
+var DefaultDebateTurns int = 6 // Answers both roles of a debate write together if the client doesn't ask for a specific number
+var MaxDebateTurns int = 20
+
+// Role settings
+var MaxRoleNameLength int = 100
+var MaxSystemPromptLength int = 20000  // Characters
+var MaxRoleParameters int = 20         // Custom variables of a role
+var MaxVariableLength int = 500        // Characters of the value of a prompt variable
+var DefaultLanguage string = "English" // Value of {{language}} if the chat doesn't set it
@@ -14,6 +14,11 @@ type ENV struct {
 	DBURL        string
 	OpenAIAPIKey string
 	JWTSecret    string
+	AIProvider   string // "openai" (default), "local" for an OpenAI compatible server or "fake" for offline tests
+	AIBaseURL    string // Base URL of the OpenAI compatible server (only for the "local" provider)
+	AIAPIKey     string // API key of the OpenAI compatible server, most local servers don't need one
+	AIModel      string // Overrides the default model (needed for local servers since they have their own models)
+	ModelsFile   string // Optional JSON file that replaces the list of models in config.Models
 }
 
 var Env ENV
@@ -58,5 +63,27 @@ func LoadEnv() {
 		DBURL:        os.Getenv("DATABASE_URL"),
 		OpenAIAPIKey: os.Getenv("OPENAI_API_KEY"),
 		JWTSecret:    os.Getenv("JWT_SECRET"),
+		AIProvider:   os.Getenv("AI_PROVIDER"),
+		AIBaseURL:    os.Getenv("AI_BASE_URL"),
+		AIAPIKey:     os.Getenv("AI_API_KEY"),
+		AIModel:      os.Getenv("AI_MODEL"),
+		ModelsFile:   os.Getenv("MODELS_FILE"),
+	}
+
+	// Without a base URL the client would send the requests to the OpenAI API
+	if Env.AIProvider == "local" && Env.AIBaseURL == "" {
+		slog.LogAttrs(context.Background(), slog.LevelError, "AI_BASE_URL is required for the local AI provider")
+		os.Exit(1)
+	}
+
+	// Loads the model registry from the file if one is configured
+	if Env.ModelsFile != "" {
+		if err := loadModelsFile(Env.ModelsFile); err != nil {
+			slog.LogAttrs(context.Background(), slog.LevelError, "Error while loading the models file",
+				slog.String("file", Env.ModelsFile),
+				slog.String("error", err.Error()),
+			)
+			os.Exit(1)
+		}
 	}
 }
@@ -0,0 +1,68 @@
+package config
+
+import (
+	"encoding/json"
+	"os"
+)
+
+// Capabilities a model can have
+const (
+	CapabilityStreaming        = "streaming"
+	CapabilityTools            = "tools"
+	CapabilityStructuredOutput = "structured_output"
+	CapabilityReasoning        = "reasoning"
+)
+
+// Everything the backend needs to know about a model. Prices are in US dollars per one million tokens
+type ModelConfig struct {
+	ID                    string   `json:"id"`
+	DisplayName           string   `json:"display_name"`
+	ContextWindow         int      `json:"context_window"` // Maximum tokens of prompt and answer together
+	InputPricePerMillion  float64  `json:"input_price_per_million"`
+	OutputPricePerMillion float64  `json:"output_price_per_million"`
+	Capabilities          []string `json:"capabilities"`
+}
+
+// The models that can be used for chats. The first model is the default model.
+// Can be replaced with the JSON file in MODELS_FILE (a list in the same format)
+var Models = []ModelConfig{
+	{
+		ID:                    "gpt-4.1-nano",
+		DisplayName:           "GPT-4.1 nano",
+		ContextWindow:         1047576,
+		InputPricePerMillion:  0.10,
+		OutputPricePerMillion: 0.40,
+		Capabilities:          []string{CapabilityStreaming, CapabilityTools, CapabilityStructuredOutput},
+	},
+	{
+		ID:                    "gpt-4.1-mini",
+		DisplayName:           "GPT-4.1 mini",
+		ContextWindow:         1047576,
+		InputPricePerMillion:  0.40,
+		OutputPricePerMillion: 1.60,
+		Capabilities:          []string{CapabilityStreaming, CapabilityTools, CapabilityStructuredOutput},
+	},
+	{
+		ID:                    "o3-mini",
+		DisplayName:           "o3-mini",
+		ContextWindow:         200000,
+		InputPricePerMillion:  1.10,
+		OutputPricePerMillion: 4.40,
+		Capabilities:          []string{CapabilityStreaming, CapabilityTools, CapabilityStructuredOutput, CapabilityReasoning},
+	},
+}
+
+// Replaces the models with the ones from the JSON file
+func loadModelsFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var models []ModelConfig
+	if err := json.Unmarshal(data, &models); err != nil {
+		return err
+	}
+	Models = models
+	return nil
+}
@@ -0,0 +1,48 @@
+package config
+
+// A rule of the local moderation. A text is flagged if one of the keywords or patterns matches
+type ModerationRule struct {
+	Category string
+	Action   string   // "annotate" or "block"
+	Stages   []string // "input", "output" or both if empty
+	Keywords []string // Whole words, case insensitive
+	Patterns []string // Regular expressions (Go syntax)
+}
+
+// Rules of the local moderation
+var ModerationRules = []ModerationRule{
+	{
+		// API keys should never show up in a chat, neither from the user nor from the AI
+		Category: "secret",
+		Action:   "block",
+		Patterns: []string{`\bsk-[A-Za-z0-9_-]{20,}\b`},
+	},
+	{
+		Category: "payment_data",
+		Action:   "annotate",
+		Patterns: []string{`\b(?:\d[ -]?){13,16}\b`},
+	},
+}
+
+// The classifier of the AI provider checks every text in addition to the rules (costs one request per text)
+var ModerationClassifierEnabled bool = false
+var ModerationClassifierAction string = "block" // What happens with texts the classifier flags
+
+// A pattern of the prompt injection guard
+type InjectionPattern struct {
+	Name    string
+	Pattern string // Regular expression (Go syntax)
+}
+
+// Common ways to override the system prompt. Matching messages and tool results are logged as suspicious
+var InjectionPatterns = []InjectionPattern{
+	{Name: "ignore_instructions", Pattern: `(?i)\b(ignore|disregard|forget|override)\b.{0,40}\b(previous|prior|above|earlier|system|your|all)\b.{0,20}\b(instructions?|prompts?|rules|directions)\b`},
+	{Name: "reveal_prompt", Pattern: `(?i)\b(reveal|show|print|repeat|output|leak)\b.{0,40}\b(system prompt|hidden instructions|initial instructions|your instructions)\b`},
+	{Name: "new_persona", Pattern: `(?i)\b(you are now|from now on,? you are|pretend you have)\b.{0,40}\b(no|without)\b.{0,20}\b(restrictions|rules|filters|limits)\b`},
+	{Name: "jailbreak_mode", Pattern: `(?i)\b(developer|dan|god|jailbreak) mode\b`},
+	{Name: "fake_role_marker", Pattern: `(?im)(<\|?(system|im_start|im_end)\|?>|^\s*\[?(system|assistant)\]?\s*:)`},
+}
+
+// A cheap model checks every user message and tool result for prompt injections in addition to the patterns (costs one request per text)
+var InjectionClassifierEnabled bool = false
+var InjectionClassifierModel string = "gpt-4.1-nano"
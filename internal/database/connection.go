@@ -33,13 +33,34 @@ func Connect() {
 		os.Exit(1)
 	}
 
+	// Chats from before alternatives existed have to get their message tree once the column is added
+	needsParentBackfill := DB.Migrator().HasTable(&Message{}) && !DB.Migrator().HasColumn(&Message{}, "ParentID")
+	// The usage of answers from before the usage ledger existed is only saved in the messages
+	needsUsageBackfill := DB.Migrator().HasTable(&Message{}) && !DB.Migrator().HasTable(&UsageRecord{})
+
+	// Role names used to be unique over all users, now they are unique per user (see the indexes of Role)
+	if DB.Migrator().HasTable(&Role{}) {
+		if err := dropGlobalRoleNameConstraint(); err != nil {
+			slog.LogAttrs(context.Background(), slog.LevelError, "Error dropping the old unique constraint of the role names",
+				slog.String("error", err.Error()),
+			)
+			os.Exit(1)
+		}
+	}
+
 	// Creates all neccessary tables on startup. When they already exist it does nothing
 	err = DB.AutoMigrate(
 		&User{},
 		&Role{},
 		&Chat{},
+		&ChatRole{},
+		&Debate{},
 		&Message{},
 		&RoleSnapshot{},
+		&ChatSummary{},
+		&UserQuota{},
+		&ModerationEvent{},
+		&UsageRecord{},
 	)
 	if err != nil {
 		slog.LogAttrs(context.Background(), slog.LevelError, "Error creating tables with AutoMigrate for database after connecting",
@@ -48,5 +69,48 @@ func Connect() {
 		os.Exit(1)
 	}
 
+	if needsParentBackfill {
+		if err := backfillMessageParents(); err != nil {
+			slog.LogAttrs(context.Background(), slog.LevelError, "Error backfilling the parents of the messages",
+				slog.String("error", err.Error()),
+			)
+			os.Exit(1)
+		}
+	}
+
+	if needsUsageBackfill {
+		if err := backfillUsageRecords(); err != nil {
+			slog.LogAttrs(context.Background(), slog.LevelError, "Error backfilling the usage records",
+				slog.String("error", err.Error()),
+			)
+			os.Exit(1)
+		}
+	}
+
 	slog.LogAttrs(context.Background(), slog.LevelInfo, "Connected to database successfully")
 }
+
+// Every message of an old chat gets the message before it as parent, so the chat becomes a tree with a single path
+func backfillMessageParents() error {
+	return DB.Exec(`UPDATE messages SET parent_id = previous.id
+		FROM (SELECT id AS child_id, LAG(id) OVER (PARTITION BY chat_id ORDER BY created_at, id) AS id FROM messages) AS previous
+		WHERE messages.id = previous.child_id AND previous.id IS NOT NULL`).Error
+}
+
+// Every answer that was saved before the usage ledger existed gets its usage record, so the quotas stay the same
+func backfillUsageRecords() error {
+	return DB.Exec(`INSERT INTO usage_records (user_id, chat_id, message_id, purpose, model, prompt_tokens, completion_tokens, cost, created_at)
+		SELECT chats.user_id, messages.chat_id, messages.id, ?, messages.model, messages.prompt_tokens, messages.completion_tokens, messages.cost, messages.created_at
+		FROM messages JOIN chats ON chats.id = messages.chat_id
+		WHERE messages.prompt_tokens + messages.completion_tokens > 0 OR messages.cost > 0`, UsagePurposeAnswer).Error
+}
+
+// Drops the unique constraint on roles.name. Depending on the gorm version that created the table it has one of these names
+func dropGlobalRoleNameConstraint() error {
+	for _, constraint := range []string{"uni_roles_name", "roles_name_key"} {
+		if err := DB.Exec("ALTER TABLE roles DROP CONSTRAINT IF EXISTS " + constraint).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
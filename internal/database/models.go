@@ -10,31 +10,103 @@ type User struct {
 	ID        uuid.UUID `gorm:"type:uuid;default:gen_random_uuid();primaryKey"`
 	Email     string    `gorm:"unique;not null"`
 	Password  string    `gorm:"not null"`
+	IsAdmin   bool      `gorm:"not null;default:false"` // Admins can manage the default roles
 	CreatedAt time.Time
 }
 
 type Role struct {
-	ID           uuid.UUID  `gorm:"type:uuid;default:gen_random_uuid();primaryKey"`
-	UserID       *uuid.UUID `gorm:"type:uuid"` // null is for default roles
-	Name         string     `gorm:"unique;not null"`
-	SystemPrompt string
-	CreatedAt    time.Time
+	ID             uuid.UUID  `gorm:"type:uuid;default:gen_random_uuid();primaryKey"`
+	UserID         *uuid.UUID `gorm:"type:uuid;uniqueIndex:idx_roles_user_name,priority:1"`                                                         // null is for default roles
+	Name           string     `gorm:"not null;uniqueIndex:idx_roles_user_name,priority:2;uniqueIndex:idx_roles_default_name,where:user_id IS NULL"` // Unique per user and among the default roles
+	SystemPrompt   string
+	FallbackModels []string        `gorm:"serializer:json"` // Models that are tried in this order when the chosen model fails (empty means config.FallbackModels)
+	Tools          []string        `gorm:"serializer:json"` // Names of the server side tools the AI may call in chats with this role
+	OutputSchema   string          // JSON schema the answers have to match (empty means free text)
+	Parameters     []RoleParameter `gorm:"serializer:json"` // Custom variables the system prompt can use as {{name}}
+	CreatedAt      time.Time
+}
+
+// A custom variable of a role. Its value is set when a chat starts
+type RoleParameter struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"` // Tells the user what to fill in
+	Default     string `json:"default,omitempty"`     // Used if the chat doesn't set the parameter
 }
 
 type Chat struct {
-	ID        uuid.UUID `gorm:"type:uuid;default:gen_random_uuid();primaryKey"`
-	UserID    uuid.UUID `gorm:"type:uuid;not null"`
-	Title     string
-	CreatedAt time.Time
+	ID          uuid.UUID `gorm:"type:uuid;default:gen_random_uuid();primaryKey"`
+	UserID      uuid.UUID `gorm:"type:uuid;not null"`
+	Title       string
+	TitleManual bool              // true if the user set the title, then it is never generated automatically
+	RoleID      *uuid.UUID        `gorm:"type:uuid"`                      // Role that answers the new messages (null if the chat has no role yet). In group chats the first role
+	TurnPolicy  string            `gorm:"not null;default:'round_robin'"` // Which roles of a group chat answer a message of the user
+	Variables   map[string]string `gorm:"serializer:json"`                // Values of the placeholders in the system prompts of the roles, set when the chat starts
+	SummaryID   *uuid.UUID        `gorm:"type:uuid"`                      // The newest summary of the older messages (null if the chat is still short)
+	CreatedAt   time.Time
 }
 
+// Turn policies of chats with several roles
+const (
+	TurnPolicyRoundRobin = "round_robin" // The roles answer one after another, one role per message of the user
+	TurnPolicyAll        = "all"         // Every role answers every message of the user
+	TurnPolicyMention    = "mention"     // The roles the user @mentions answer (the next role in turn if nobody is mentioned)
+)
+
+// A role that takes part in a chat. Chats without these rows only have the role of Chat.RoleID
+type ChatRole struct {
+	ChatID   uuid.UUID `gorm:"type:uuid;primaryKey"`
+	RoleID   uuid.UUID `gorm:"type:uuid;primaryKey"`
+	Position int       `gorm:"not null"` // The roles answer in this order
+}
+
+// A debate between the two roles of a chat. Every turn is saved as a normal message of the chat
+type Debate struct {
+	ChatID        uuid.UUID  `gorm:"type:uuid;primaryKey"`
+	Topic         string     // Saved as the first message of the chat too
+	Turns         int        // How many answers the two roles write together
+	TurnsDone     int        // Answers that are already written, the roles take turns starting with the first role of the chat
+	ModeratorID   *uuid.UUID `gorm:"type:uuid"` // Role that summarizes the debate after the last turn (null if there is no moderator)
+	Model         string
+	ModeratorDone bool   // The moderator wrote its summary, so a resumed debate doesn't summarize again
+	Status        string `gorm:"not null;default:'running'"` // "running", "paused" or "finished"
+	CreatedAt     time.Time
+}
+
+// States of a debate
+const (
+	DebateStatusRunning  = "running"
+	DebateStatusPaused   = "paused"
+	DebateStatusFinished = "finished"
+)
+
+// Kinds of messages
+const (
+	MessageKindText       = "text"
+	MessageKindToolCall   = "tool_call"   // The AI called a tool, the content are the arguments
+	MessageKindToolResult = "tool_result" // The result of a tool call, the content is what the tool returned
+	MessageKindStructured = "structured"  // An answer that matches the output schema of the role, the content is JSON
+)
+
 type Message struct {
-	ID             uuid.UUID `gorm:"type:uuid;default:gen_random_uuid();primaryKey"`
-	ChatID         uuid.UUID `gorm:"type:uuid;not null"`
+	ID             uuid.UUID  `gorm:"type:uuid;default:gen_random_uuid();primaryKey;index:idx_messages_chat_position,priority:3"`
+	ChatID         uuid.UUID  `gorm:"type:uuid;not null;index:idx_messages_chat_position,priority:1"` // The index is used for the paginated history
+	ParentID       *uuid.UUID `gorm:"type:uuid;index"`                                                // The message this message follows (null for the first message). Messages with the same parent are alternatives
+	IsActive       bool       `gorm:"not null;default:true"`                                          // The alternative that is shown, only one of the messages with the same parent is active
 	SenderRole     string
 	Content        string
-	CreatedAt      time.Time
+	Truncated      bool   // true if the generation was canceled and only a part of the answer was saved
+	Flagged        bool   // true if the moderation annotated the message
+	Kind           string `gorm:"not null;default:'text'"` // "text", "tool_call", "tool_result" or "structured"
+	ToolCallID     string // Connects a tool call with its result
+	ToolName       string
+	CreatedAt      time.Time `gorm:"index:idx_messages_chat_position,priority:2"`
 	RoleSnapshotID uuid.UUID `gorm:"type:uuid;not null"`
+
+	// Token usage and costs of assistant messages (empty for user messages)
+	Model            string
+	PromptTokens     int64
+	CompletionTokens int64
+	Cost             float64 // US dollars
 }
 
 type RoleSnapshot struct {
@@ -44,3 +116,63 @@ type RoleSnapshot struct {
 	SystemPrompt string
 	CreatedAt    time.Time
 }
+
+// Condensed version of the older messages of a chat. A new summary always contains the previous one,
+// so it covers every message from FromMessageID up to ToMessageID
+type ChatSummary struct {
+	ID                uuid.UUID  `gorm:"type:uuid;default:gen_random_uuid();primaryKey"`
+	ChatID            uuid.UUID  `gorm:"type:uuid;not null;index"`
+	PreviousSummaryID *uuid.UUID `gorm:"type:uuid"`
+	Content           string
+	FromMessageID     uuid.UUID `gorm:"type:uuid;not null"` // First message that is covered
+	ToMessageID       uuid.UUID `gorm:"type:uuid;not null"` // Last message that is covered
+	MessageCount      int       // How many messages are covered
+	CreatedAt         time.Time
+}
+
+// Limits of a user that differ from the default limits in the config. A null value means the default is used, 0 means no limit
+type UserQuota struct {
+	UserID            uuid.UUID `gorm:"type:uuid;primaryKey"`
+	DailyTokenLimit   *int64
+	MonthlyTokenLimit *int64
+	DailyCostLimit    *float64 // US dollars
+	MonthlyCostLimit  *float64 // US dollars
+	UpdatedAt         time.Time
+}
+
+// Tokens and costs of one AI request for a user. The quotas are computed from these rows, so they are kept when the chat is deleted
+type UsageRecord struct {
+	ID               uuid.UUID  `gorm:"type:uuid;default:gen_random_uuid();primaryKey"`
+	UserID           uuid.UUID  `gorm:"type:uuid;not null;index:idx_usage_records_user_time,priority:1"`
+	ChatID           *uuid.UUID `gorm:"type:uuid"` // The chat the request was made for (can be deleted already)
+	MessageID        *uuid.UUID `gorm:"type:uuid"` // The answer that was saved (null if the request didn't save a message)
+	Purpose          string     `gorm:"not null"`  // What the request was made for, see the UsagePurpose constants
+	Model            string
+	PromptTokens     int64
+	CompletionTokens int64
+	Cost             float64   // US dollars
+	CreatedAt        time.Time `gorm:"index:idx_usage_records_user_time,priority:2"`
+}
+
+// Purposes of AI requests
+const (
+	UsagePurposeAnswer         = "answer"          // An answer of a role in a chat
+	UsagePurposeSummary        = "summary"         // A summary of the older messages of a chat
+	UsagePurposeTitle          = "title"           // A generated title of a chat
+	UsagePurposeModeration     = "moderation"      // A check of the moderation classifier
+	UsagePurposeInjectionCheck = "injection_check" // A check of the prompt injection classifier
+)
+
+// A text that was flagged by the moderation
+type ModerationEvent struct {
+	ID         uuid.UUID  `gorm:"type:uuid;default:gen_random_uuid();primaryKey"`
+	UserID     uuid.UUID  `gorm:"type:uuid;not null;index"`
+	ChatID     uuid.UUID  `gorm:"type:uuid;not null"`
+	MessageID  *uuid.UUID `gorm:"type:uuid"` // null if the text was never saved
+	Stage      string     // "input" or "output"
+	Source     string     // Which moderator flagged the text
+	Action     string     // "annotate" or "block"
+	Categories []string   `gorm:"serializer:json"`
+	Excerpt    string
+	CreatedAt  time.Time
+}
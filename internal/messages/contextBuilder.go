@@ -0,0 +1,172 @@
+package messages
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/google/uuid"
+	"github.com/roly-backend/internal/ai"
+	"github.com/roly-backend/internal/config"
+	"github.com/roly-backend/internal/database"
+)
+
+var ErrContextTooLarge = errors.New("the system prompt and the newest message don't fit into the context window of the model")
+
+// Introduces the summary of the older messages in the prompt
+const summaryPrefix = "Summary of the earlier conversation:\n"
+
+// Marker that is appended to a message that was shortened so it fits into the context window
+const shortenedMarker = " [...]"
+
+// The messages that are sent to the AI and which messages of the history were left out
+type BuiltContext struct {
+	Messages     []ai.ChatMessage
+	PromptTokens int
+	Excluded     []uuid.UUID // Messages that were dropped because they didn't fit
+	Shortened    []uuid.UUID // Messages that were cut off so at least their beginning fits
+}
+
+// Builds the messages for an AI request so they fit into the context window of the model.
+// The system prompt, the summary of the older messages (if there is one) and the newest message are always kept. Older messages are added from newest to oldest
+// until the token budget (context window minus the tokens reserved for the answer) is used up.
+// The oldest message that doesn't fit anymore is shortened if enough budget is left, all older ones are dropped
+func BuildContext(provider ai.Provider, model, systemPrompt, summary string, history []database.Message) (BuiltContext, error) {
+	budget := ai.ContextWindow(model)
+	if config.MaxContextTokens > 0 && config.MaxContextTokens < budget {
+		budget = config.MaxContextTokens
+	}
+	budget -= config.ReservedOutputTokens
+
+	system := []ai.ChatMessage{{Role: "system", Content: systemPrompt}}
+	if summary != "" {
+		system = append(system, ai.ChatMessage{Role: "system", Content: summaryPrefix + summary})
+	}
+	used := provider.CountTokens(model, system)
+
+	built := BuiltContext{}
+	included := make([]ai.ChatMessage, 0, len(history))
+	cutoff := -1 // Index of the newest message that is not completely included
+
+	parts := contextParts(history)
+	end := len(history) // Index after the newest message of the part
+	for p := len(parts) - 1; p >= 0; p-- {
+		part := parts[p]
+		start := end - len(part)
+		messages := make([]ai.ChatMessage, 0, len(part))
+		tokens := 0
+		for _, saved := range part {
+			message := toChatMessage(saved, len(part) > 1)
+			messages = append(messages, message)
+			tokens += messageTokens(provider, model, message)
+		}
+
+		if used+tokens <= budget {
+			// included is collected from newest to oldest
+			for i := len(messages) - 1; i >= 0; i-- {
+				included = append(included, messages[i])
+			}
+			used += tokens
+			end = start
+			continue
+		}
+
+		// Without the newest message the AI has nothing to answer
+		if p == len(parts)-1 {
+			return built, ErrContextTooLarge
+		}
+
+		// Shortens the message if at least a meaningful part of it fits. A tool call and its result are only kept completely
+		cutoff = end - 1
+		if len(part) == 1 {
+			if shortened, ok := shortenMessage(provider, model, messages[0], budget-used); ok {
+				included = append(included, shortened)
+				used += messageTokens(provider, model, shortened)
+				built.Shortened = append(built.Shortened, part[0].ID)
+				cutoff = start - 1
+			}
+		}
+		break
+	}
+
+	for i := 0; i <= cutoff; i++ {
+		built.Excluded = append(built.Excluded, history[i].ID)
+	}
+
+	// The messages were collected from newest to oldest
+	built.Messages = append(built.Messages, system...)
+	for i := len(included) - 1; i >= 0; i-- {
+		built.Messages = append(built.Messages, included[i])
+	}
+	built.PromptTokens = used
+	return built, nil
+}
+
+// Returns how many tokens a single message needs inside a prompt
+func messageTokens(provider ai.Provider, model string, message ai.ChatMessage) int {
+	return provider.CountTokens(model, []ai.ChatMessage{message}) - provider.CountTokens(model, nil)
+}
+
+// Cuts off the end of the message so it needs at most the given tokens.
+// Returns false if less than config.MinShortenedMessageTokens would be left of the message
+func shortenMessage(provider ai.Provider, model string, message ai.ChatMessage, maxTokens int) (ai.ChatMessage, bool) {
+	if maxTokens < config.MinShortenedMessageTokens {
+		return message, false
+	}
+
+	runes := []rune(message.Content)
+	low, high := 0, len(runes)
+	// Binary search for the longest beginning of the message that still fits
+	for low < high {
+		middle := (low + high + 1) / 2
+		candidate := ai.ChatMessage{Role: message.Role, Content: string(runes[:middle]) + shortenedMarker}
+		if messageTokens(provider, model, candidate) <= maxTokens {
+			low = middle
+		} else {
+			high = middle - 1
+		}
+	}
+
+	shortened := ai.ChatMessage{Role: message.Role, Content: string(runes[:low]) + shortenedMarker}
+	if low == 0 || messageTokens(provider, model, shortened) < config.MinShortenedMessageTokens {
+		return message, false
+	}
+	return shortened, true
+}
+
+// Splits the history into the parts that are kept or dropped together: a tool call and the result that directly follows it
+// form one part, every other message is a part of its own
+func contextParts(history []database.Message) [][]database.Message {
+	parts := make([][]database.Message, 0, len(history))
+	for i := 0; i < len(history); i++ {
+		message := history[i]
+		if message.Kind == database.MessageKindToolCall && message.ToolCallID != "" && i+1 < len(history) {
+			result := history[i+1]
+			if result.Kind == database.MessageKindToolResult && result.ToolCallID == message.ToolCallID {
+				parts = append(parts, history[i:i+2])
+				i++
+				continue
+			}
+		}
+		parts = append(parts, history[i:i+1])
+	}
+	return parts
+}
+
+// Converts a saved message into a message for the AI. A tool call that is sent together with its result (paired) is passed
+// as a call of the assistant and the result as the tool message that answers it. Without its counterpart (for example
+// when the answer was canceled during the call) the API doesn't accept them, so they are passed as notes of the assistant instead
+func toChatMessage(message database.Message, paired bool) ai.ChatMessage {
+	switch message.Kind {
+	case database.MessageKindToolCall:
+		if paired {
+			return ai.ChatMessage{Role: "assistant", ToolCalls: []ai.ToolCall{{ID: message.ToolCallID, Name: message.ToolName, Arguments: message.Content}}}
+		}
+		return ai.ChatMessage{Role: "assistant", Content: fmt.Sprintf("[Called the tool %s with %s]", message.ToolName, message.Content)}
+	case database.MessageKindToolResult:
+		if paired {
+			return ai.ChatMessage{Role: "tool", Content: message.Content, ToolCallID: message.ToolCallID}
+		}
+		return ai.ChatMessage{Role: "assistant", Content: fmt.Sprintf("[Result of the tool %s: %s]", message.ToolName, message.Content)}
+	}
+	return ai.ChatMessage{Role: message.SenderRole, Content: message.Content}
+}
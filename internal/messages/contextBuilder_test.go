@@ -0,0 +1,188 @@
+package messages
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/roly-backend/internal/ai"
+	"github.com/roly-backend/internal/config"
+	"github.com/roly-backend/internal/database"
+)
+
+// Creates a chat history where every message needs about the given tokens
+func testHistory(count, tokensPerMessage int) []database.Message {
+	history := make([]database.Message, count)
+	for i := range history {
+		role := "user"
+		if i%2 == 1 {
+			role = "assistant"
+		}
+		history[i] = database.Message{ID: uuid.New(), SenderRole: role, Content: strings.Repeat("abcd", tokensPerMessage)}
+	}
+	return history
+}
+
+func setContextLimits(t *testing.T, maxContext, reserved, minShortened int) {
+	t.Helper()
+	oldMax, oldReserved, oldMin := config.MaxContextTokens, config.ReservedOutputTokens, config.MinShortenedMessageTokens
+	config.MaxContextTokens, config.ReservedOutputTokens, config.MinShortenedMessageTokens = maxContext, reserved, minShortened
+	t.Cleanup(func() {
+		config.MaxContextTokens, config.ReservedOutputTokens, config.MinShortenedMessageTokens = oldMax, oldReserved, oldMin
+	})
+}
+
+func TestBuildContextKeepsEverythingThatFits(t *testing.T) {
+	setContextLimits(t, 1000, 100, 50)
+	history := testHistory(4, 10)
+
+	built, err := BuildContext(ai.NewFakeProvider(), "fake", "You are a pirate", "", history)
+	if err != nil {
+		t.Fatalf("Error building context: %v", err)
+	}
+	if len(built.Messages) != 5 || len(built.Excluded) != 0 {
+		t.Errorf("Expected system prompt and 4 messages, got %d messages and %d excluded", len(built.Messages), len(built.Excluded))
+	}
+	if built.Messages[0].Role != "system" || built.Messages[0].Content != "You are a pirate" {
+		t.Errorf("System prompt is not the first message: %+v", built.Messages[0])
+	}
+	if built.PromptTokens > 900 {
+		t.Errorf("Prompt exceeds the budget: %d tokens", built.PromptTokens)
+	}
+}
+
+func TestBuildContextDropsOldestMessages(t *testing.T) {
+	setContextLimits(t, 300, 100, 1000)
+	history := testHistory(10, 36) // every message needs 40 tokens
+
+	built, err := BuildContext(ai.NewFakeProvider(), "fake", "You are a pirate", "", history)
+	if err != nil {
+		t.Fatalf("Error building context: %v", err)
+	}
+	if built.PromptTokens > 200 {
+		t.Errorf("Prompt exceeds the budget: %d tokens", built.PromptTokens)
+	}
+	if built.Messages[0].Role != "system" {
+		t.Errorf("System prompt was dropped")
+	}
+	kept := len(built.Messages) - 1
+	if kept+len(built.Excluded) != len(history) {
+		t.Errorf("Kept %d and excluded %d of %d messages", kept, len(built.Excluded), len(history))
+	}
+	// The excluded messages have to be the oldest ones
+	for i, id := range built.Excluded {
+		if id != history[i].ID {
+			t.Errorf("Excluded message %d is not one of the oldest messages", i)
+		}
+	}
+}
+
+func TestBuildContextShortensOldMessage(t *testing.T) {
+	setContextLimits(t, 300, 100, 20)
+	history := testHistory(2, 10)
+	history[0].Content = strings.Repeat("abcd", 500)
+
+	built, err := BuildContext(ai.NewFakeProvider(), "fake", "You are a pirate", "", history)
+	if err != nil {
+		t.Fatalf("Error building context: %v", err)
+	}
+	if len(built.Shortened) != 1 || built.Shortened[0] != history[0].ID || len(built.Excluded) != 0 {
+		t.Fatalf("Expected the old message to be shortened: %+v", built)
+	}
+	if !strings.HasSuffix(built.Messages[1].Content, shortenedMarker) {
+		t.Errorf("Shortened message has no marker")
+	}
+	if built.PromptTokens > 200 {
+		t.Errorf("Prompt exceeds the budget: %d tokens", built.PromptTokens)
+	}
+}
+
+func TestBuildContextKeepsSummary(t *testing.T) {
+	setContextLimits(t, 300, 100, 1000)
+	history := testHistory(10, 36)
+
+	built, err := BuildContext(ai.NewFakeProvider(), "fake", "You are a pirate", "The user likes ships", history)
+	if err != nil {
+		t.Fatalf("Error building context: %v", err)
+	}
+	if built.Messages[1].Role != "system" || !strings.Contains(built.Messages[1].Content, "The user likes ships") {
+		t.Errorf("Summary is not the second message: %+v", built.Messages[1])
+	}
+	if built.PromptTokens > 200 {
+		t.Errorf("Prompt exceeds the budget: %d tokens", built.PromptTokens)
+	}
+}
+
+func TestBuildContextNewestMessageTooLarge(t *testing.T) {
+	setContextLimits(t, 300, 100, 20)
+	history := testHistory(1, 1000)
+
+	_, err := BuildContext(ai.NewFakeProvider(), "fake", "You are a pirate", "", history)
+	if !errors.Is(err, ErrContextTooLarge) {
+		t.Errorf("Expected ErrContextTooLarge, got %v", err)
+	}
+}
+
+// Creates a tool call and its result
+func testToolCall(arguments, result string) (database.Message, database.Message) {
+	callID := "call-" + uuid.NewString()
+	call := database.Message{ID: uuid.New(), SenderRole: "assistant", Kind: database.MessageKindToolCall, Content: arguments, ToolCallID: callID, ToolName: "current_time"}
+	answer := database.Message{ID: uuid.New(), SenderRole: "tool", Kind: database.MessageKindToolResult, Content: result, ToolCallID: callID, ToolName: "current_time"}
+	return call, answer
+}
+
+func TestBuildContextReplaysToolCalls(t *testing.T) {
+	setContextLimits(t, 1000, 100, 50)
+	call, result := testToolCall(`{"timezone":"UTC"}`, "Monday")
+	history := []database.Message{
+		{ID: uuid.New(), SenderRole: "user", Content: "Which day is it?"},
+		call,
+		result,
+		{ID: uuid.New(), SenderRole: "assistant", Content: "It is Monday."},
+		{ID: uuid.New(), SenderRole: "user", Content: "Thanks"},
+	}
+
+	built, err := BuildContext(ai.NewFakeProvider(), "fake", "You are a pirate", "", history)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replayedCall, replayedResult := built.Messages[2], built.Messages[3]
+	if replayedCall.Role != "assistant" || len(replayedCall.ToolCalls) != 1 || replayedCall.ToolCalls[0].ID != call.ToolCallID || replayedCall.ToolCalls[0].Arguments != call.Content {
+		t.Errorf("expected the call of the assistant, got %+v", replayedCall)
+	}
+	if replayedResult.Role != "tool" || replayedResult.ToolCallID != call.ToolCallID || replayedResult.Content != "Monday" {
+		t.Errorf("expected the tool message with the result, got %+v", replayedResult)
+	}
+}
+
+func TestBuildContextDropsToolCallsWithTheirResult(t *testing.T) {
+	setContextLimits(t, 200, 100, 1000)
+	// The short result would still fit after the newest message, but not the call it answers
+	call, result := testToolCall(`{"timezone":"`+strings.Repeat("abcd", 20)+`"}`, "Monday")
+	question := database.Message{ID: uuid.New(), SenderRole: "user", Content: strings.Repeat("abcd", 70)}
+	history := []database.Message{call, result, question}
+
+	built, err := BuildContext(ai.NewFakeProvider(), "fake", "You are a pirate", "", history)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(built.Messages) != 2 || len(built.Excluded) != 2 || built.Excluded[0] != call.ID || built.Excluded[1] != result.ID {
+		t.Errorf("expected the call and its result to be dropped together, got %+v", built)
+	}
+}
+
+func TestBuildContextReplaysUnpairedToolCallsAsNotes(t *testing.T) {
+	setContextLimits(t, 1000, 100, 50)
+	// The answer was canceled while the tool ran, so the call has no result
+	call, _ := testToolCall(`{}`, "")
+	history := []database.Message{call, {ID: uuid.New(), SenderRole: "user", Content: "Hello?"}}
+
+	built, err := BuildContext(ai.NewFakeProvider(), "fake", "You are a pirate", "", history)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if note := built.Messages[1]; note.Role != "assistant" || len(note.ToolCalls) != 0 || !strings.Contains(note.Content, "current_time") {
+		t.Errorf("expected a note of the assistant, got %+v", note)
+	}
+}
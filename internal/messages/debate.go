@@ -0,0 +1,334 @@
+package messages
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/roly-backend/internal/ai"
+	"github.com/roly-backend/internal/chats"
+	"github.com/roly-backend/internal/config"
+	"github.com/roly-backend/internal/database"
+	"github.com/roly-backend/internal/quotas"
+	"github.com/roly-backend/internal/roles"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrDebateNotFound = errors.New("debate not found")
+	ErrDebateRunning  = errors.New("debate is already running")
+	ErrDebateFinished = errors.New("debate is already finished")
+	ErrDebateRoles    = errors.New("a debate needs two different roles")
+	ErrDebateTurns    = errors.New("invalid number of debate turns")
+)
+
+// Tells a role of a debate how to take its turn
+const debateInstructions = "You are in a debate with %s about the topic of the first message. Argue for your own position, " +
+	"answer the last argument of %s directly and keep every turn short. Don't summarize the debate and don't agree just to end it."
+
+// Tells the moderator of a debate what to do after the last turn
+const moderatorInstructions = "You moderate the debate above and it is over now. Summarize the strongest arguments of each side " +
+	"and where they agree and disagree, then close the debate. Don't take a side."
+
+// A debate how the client gets it
+type DebateInfo struct {
+	ChatID        uuid.UUID   `json:"chat_id"` // The chat with the messages of the debate
+	Topic         string      `json:"topic"`
+	RoleIDs       []uuid.UUID `json:"role_ids"` // The two roles that debate, the first one started
+	ModeratorID   *uuid.UUID  `json:"moderator_id"`
+	Turns         int         `json:"turns"`
+	TurnsDone     int         `json:"turns_done"`
+	ModeratorDone bool        `json:"moderator_done"`
+	Model         string      `json:"model"`
+	Status        string      `json:"status"` // "running", "paused" or "finished"
+	CreatedAt     time.Time   `json:"created_at"`
+}
+
+// Input for a new debate
+type NewDebate struct {
+	Topic       string            `json:"topic"`
+	RoleIDs     []uuid.UUID       `json:"role_ids"`     // The two roles that debate, the first one starts
+	Turns       int               `json:"turns"`        // Answers of both roles together (config.DefaultDebateTurns if 0)
+	ModeratorID *uuid.UUID        `json:"moderator_id"` // Role that summarizes the debate at the end (optional)
+	Model       string            `json:"model"`
+	Variables   map[string]string `json:"variables"` // Values of the parameters of the roles and the moderator, like for a new chat
+}
+
+// Debates that are running right now with the function that pauses them, stored by their chat id
+var runningDebates sync.Map
+
+// Creates a new chat with the two roles, saves the topic as its first message and runs the debate without further input of the user.
+// Every turn is passed to the sink like a normal answer. The debate runs until all turns are written or until it is paused
+// (by PauseDebate or because ctx was canceled), then it can be continued with ResumeDebate
+func StartDebate(ctx context.Context, userID uuid.UUID, input NewDebate, sink Sink) (DebateInfo, error) {
+	topic, model, err := checkUserMessage(input.Topic, input.Model)
+	if err != nil {
+		return DebateInfo{}, err
+	}
+	if len(input.RoleIDs) != 2 || input.RoleIDs[0] == input.RoleIDs[1] {
+		return DebateInfo{}, ErrDebateRoles
+	}
+	if input.Turns == 0 {
+		input.Turns = config.DefaultDebateTurns
+	}
+	if input.Turns < 1 || input.Turns > config.MaxDebateTurns {
+		return DebateInfo{}, ErrDebateTurns
+	}
+	if input.ModeratorID != nil {
+		if _, err := roles.GetRole(ctx, userID, *input.ModeratorID); err != nil {
+			if errors.Is(err, roles.ErrRoleNotFound) {
+				return DebateInfo{}, chats.ErrRoleNotFound
+			}
+			return DebateInfo{}, err
+		}
+	}
+	if err := quotas.Check(ctx, userID); err != nil {
+		return DebateInfo{}, err
+	}
+
+	// The chat gets a title after the first turn like every other chat
+	created, err := chats.CreateChat(ctx, userID, chats.NewChat{
+		RoleIDs:     input.RoleIDs,
+		TurnPolicy:  database.TurnPolicyRoundRobin,
+		Variables:   input.Variables,
+		ModeratorID: input.ModeratorID,
+	})
+	if err != nil {
+		return DebateInfo{}, err
+	}
+	chat, err := getChat(ctx, userID, created.ID)
+	if err != nil {
+		return DebateInfo{}, err
+	}
+
+	debate := database.Debate{
+		ChatID:      chat.ID,
+		Topic:       topic,
+		Turns:       input.Turns,
+		ModeratorID: input.ModeratorID,
+		Model:       model,
+		Status:      database.DebateStatusRunning,
+		CreatedAt:   time.Now(),
+	}
+	if err := database.DB.WithContext(ctx).Create(&debate).Error; err != nil {
+		return DebateInfo{}, err
+	}
+
+	// Both roles answer to the topic, so it is the first message of the chat
+	snapshot, err := resolveSnapshot(ctx, chat, input.RoleIDs[0])
+	if err != nil {
+		return DebateInfo{}, err
+	}
+	message, err := saveUserMessage(ctx, userID, chat, nil, topic, snapshot, sink)
+	if err != nil {
+		// A debate without topic can't run, so it is removed again (for example if the moderation blocked the topic)
+		if message.ID == uuid.Nil {
+			if deleteErr := chats.DeleteChat(context.Background(), userID, chat.ID); deleteErr != nil {
+				slog.LogAttrs(ctx, slog.LevelError, "Error deleting debate without topic",
+					slog.String("chat_id", chat.ID.String()),
+					slog.String("error", deleteErr.Error()),
+				)
+			}
+		}
+		return DebateInfo{}, err
+	}
+
+	return runDebate(ctx, userID, chat, debate, sink)
+}
+
+// Continues a paused debate with the next turn. An empty model keeps the model of the debate
+func ResumeDebate(ctx context.Context, userID, chatID uuid.UUID, model string, sink Sink) (DebateInfo, error) {
+	chat, debate, err := getDebate(ctx, userID, chatID)
+	if err != nil {
+		return DebateInfo{}, err
+	}
+	if debate.Status == database.DebateStatusFinished {
+		return DebateInfo{}, ErrDebateFinished
+	}
+	if model != "" {
+		if !ai.IsAvailableModel(model) {
+			return DebateInfo{}, ErrModelUnavailable
+		}
+		debate.Model = model
+	}
+	return runDebate(ctx, userID, chat, debate, sink)
+}
+
+// Stops a running debate after the part of the current turn that was already written.
+// A debate that is not running anymore (for example after a restart of the server) is only marked as paused
+func PauseDebate(ctx context.Context, userID, chatID uuid.UUID) (DebateInfo, error) {
+	chat, debate, err := getDebate(ctx, userID, chatID)
+	if err != nil {
+		return DebateInfo{}, err
+	}
+	if debate.Status == database.DebateStatusFinished {
+		return DebateInfo{}, ErrDebateFinished
+	}
+
+	if pause, running := runningDebates.Load(chat.ID); running {
+		// The runner saves the new status when it stopped
+		pause.(context.CancelFunc)()
+	} else if err := database.DB.WithContext(ctx).Model(&debate).Update("status", database.DebateStatusPaused).Error; err != nil {
+		return DebateInfo{}, err
+	}
+	debate.Status = database.DebateStatusPaused
+	return debateInfo(ctx, chat, debate)
+}
+
+// Returns the debate of a chat of the user
+func GetDebate(ctx context.Context, userID, chatID uuid.UUID) (DebateInfo, error) {
+	chat, debate, err := getDebate(ctx, userID, chatID)
+	if err != nil {
+		return DebateInfo{}, err
+	}
+	return debateInfo(ctx, chat, debate)
+}
+
+func getDebate(ctx context.Context, userID, chatID uuid.UUID) (database.Chat, database.Debate, error) {
+	var debate database.Debate
+	chat, err := getChat(ctx, userID, chatID)
+	if err != nil {
+		if errors.Is(err, ErrChatNotFound) {
+			return chat, debate, ErrDebateNotFound
+		}
+		return chat, debate, err
+	}
+	if err := database.DB.WithContext(ctx).First(&debate, "chat_id = ?", chat.ID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return chat, debate, ErrDebateNotFound
+		}
+		return chat, debate, err
+	}
+	return chat, debate, nil
+}
+
+func debateInfo(ctx context.Context, chat database.Chat, debate database.Debate) (DebateInfo, error) {
+	roleIDs, err := chats.RoleIDs(ctx, chat)
+	if err != nil {
+		return DebateInfo{}, err
+	}
+	return DebateInfo{
+		ChatID:        debate.ChatID,
+		Topic:         debate.Topic,
+		RoleIDs:       roleIDs,
+		ModeratorID:   debate.ModeratorID,
+		Turns:         debate.Turns,
+		TurnsDone:     debate.TurnsDone,
+		ModeratorDone: debate.ModeratorDone,
+		Model:         debate.Model,
+		Status:        debate.Status,
+		CreatedAt:     debate.CreatedAt,
+	}, nil
+}
+
+// Writes the missing turns of the debate and lets the moderator summarize it. A debate that stops early is saved as paused.
+// Pausing isn't an error, the returned debate tells the caller if it was finished
+func runDebate(ctx context.Context, userID uuid.UUID, chat database.Chat, debate database.Debate, sink Sink) (DebateInfo, error) {
+	err := debates.run(ctx, userID, chat, &debate, sink)
+	if errors.Is(err, ErrDebateRunning) {
+		return DebateInfo{}, err
+	}
+	// The request could have ended while the debate was written
+	info, infoErr := debateInfo(context.WithoutCancel(ctx), chat, debate)
+	if err == nil {
+		err = infoErr
+	}
+	return info, err
+}
+
+// Runs debates. The steps that need the database are functions, so a debate can run in tests too
+type debateRunner struct {
+	debaters func(ctx context.Context, chat database.Chat) ([]database.Role, error) // The roles of the chat in the order they speak
+	role     func(ctx context.Context, roleID uuid.UUID) (database.Role, error)     // Loads the moderator (without id if it was deleted)
+	answer   func(ctx context.Context, userID uuid.UUID, chat database.Chat, model string, role database.Role, instructions string, sink Sink) (Reply, error)
+	save     func(debate *database.Debate, columns ...string) error // Saves the columns of the debate
+}
+
+var debates = debateRunner{debaters: loadChatRoles, role: loadRole, answer: answerAs, save: saveDebate}
+
+// The context isn't used, so a paused debate is still saved
+func saveDebate(debate *database.Debate, columns ...string) error {
+	return database.DB.Model(debate).Select(columns).Updates(debate).Error
+}
+
+// Runs the debate until it is finished or paused and saves its new status
+func (r debateRunner) run(ctx context.Context, userID uuid.UUID, chat database.Chat, debate *database.Debate, sink Sink) error {
+	ctx, pause := context.WithCancel(ctx)
+	defer pause()
+	if _, running := runningDebates.LoadOrStore(chat.ID, pause); running {
+		return ErrDebateRunning
+	}
+	defer runningDebates.Delete(chat.ID)
+
+	debate.Status = database.DebateStatusRunning
+	if err := r.save(debate, "status", "model"); err != nil {
+		return err
+	}
+
+	err := r.write(ctx, userID, chat, debate, sink)
+	debate.Status = database.DebateStatusPaused
+	if err == nil && debate.TurnsDone >= debate.Turns && (debate.ModeratorID == nil || debate.ModeratorDone) {
+		debate.Status = database.DebateStatusFinished
+	}
+	if saveErr := r.save(debate, "status"); saveErr != nil && err == nil {
+		err = saveErr
+	}
+	if ctx.Err() != nil {
+		err = nil
+	}
+	return err
+}
+
+// Lets the two roles of the chat take turns until all turns are written, then the moderator (if there is one) closes the debate
+func (r debateRunner) write(ctx context.Context, userID uuid.UUID, chat database.Chat, debate *database.Debate, sink Sink) error {
+	// The roles of the chat could have changed since the debate was started
+	debaters, err := r.debaters(ctx, chat)
+	if err != nil {
+		return err
+	}
+	if len(debaters) != 2 {
+		return ErrDebateRoles
+	}
+
+	for debate.TurnsDone < debate.Turns {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		speaker := debaters[debate.TurnsDone%2]
+		opponent := debaters[(debate.TurnsDone+1)%2]
+		instructions := fmt.Sprintf(debateInstructions, opponent.Name, opponent.Name)
+		if _, err := r.answer(ctx, userID, chat, debate.Model, speaker, instructions, sink); err != nil {
+			return err
+		}
+
+		// A turn that was paused while it was written is saved as a truncated message and counts as well
+		debate.TurnsDone++
+		if err := r.save(debate, "turns_done"); err != nil {
+			return err
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if debate.ModeratorID == nil || debate.ModeratorDone {
+		return nil
+	}
+	moderator, err := r.role(ctx, *debate.ModeratorID)
+	if err != nil {
+		return err
+	}
+	// A moderator that was deleted can't summarize, the debate ends without summary
+	if moderator.ID != uuid.Nil {
+		if _, err := r.answer(ctx, userID, chat, debate.Model, moderator, moderatorInstructions, sink); err != nil {
+			return err
+		}
+	}
+	// Like a turn, a summary that was paused while it was written counts as done
+	debate.ModeratorDone = true
+	return r.save(debate, "moderator_done")
+}
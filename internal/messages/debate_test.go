@@ -0,0 +1,209 @@
+package messages
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/roly-backend/internal/ai"
+	"github.com/roly-backend/internal/database"
+)
+
+// A debate that runs without database. The turns are streamed by the fake provider and only kept in memory
+type testDebate struct {
+	chat         database.Chat
+	debate       database.Debate
+	moderator    database.Role
+	speakers     []string // Names of the roles in the order they answered
+	instructions []string
+	truncated    []bool
+	runner       debateRunner
+}
+
+func newTestDebate(turns int, provider *ai.FakeProvider) *testDebate {
+	alice := database.Role{ID: uuid.New(), Name: "Alice"}
+	bob := database.Role{ID: uuid.New(), Name: "Bob"}
+	test := &testDebate{
+		chat:      database.Chat{ID: uuid.New()},
+		moderator: database.Role{ID: uuid.New(), Name: "Moderator"},
+	}
+	test.debate = database.Debate{ChatID: test.chat.ID, Turns: turns, ModeratorID: &test.moderator.ID, Model: "gpt-4.1-nano"}
+
+	test.runner = debateRunner{
+		debaters: func(ctx context.Context, chat database.Chat) ([]database.Role, error) {
+			return []database.Role{alice, bob}, nil
+		},
+		role: func(ctx context.Context, roleID uuid.UUID) (database.Role, error) {
+			if roleID == test.moderator.ID {
+				return test.moderator, nil
+			}
+			return database.Role{}, nil
+		},
+		answer: func(ctx context.Context, userID uuid.UUID, chat database.Chat, model string, role database.Role, instructions string, sink Sink) (Reply, error) {
+			request := ai.Request{Model: model, Messages: []ai.ChatMessage{{Role: "system", Content: instructions}}}
+			response, err := provider.Stream(ctx, request, func(delta string) error {
+				if sink.Delta != nil {
+					return sink.Delta(delta)
+				}
+				return nil
+			})
+			// Like generateReply, a canceled answer keeps the text that was written until then
+			if err != nil && (ctx.Err() == nil || response.Content == "") {
+				return Reply{}, err
+			}
+			test.speakers = append(test.speakers, role.Name)
+			test.instructions = append(test.instructions, instructions)
+			test.truncated = append(test.truncated, err != nil)
+			return Reply{Message: database.Message{Content: response.Content, Truncated: err != nil}}, nil
+		},
+		save: func(debate *database.Debate, columns ...string) error {
+			test.debate = *debate
+			return nil
+		},
+	}
+	return test
+}
+
+func (d *testDebate) run(sink Sink) error {
+	return d.runner.run(context.Background(), uuid.New(), d.chat, &d.debate, sink)
+}
+
+// Pauses the debate like PauseDebate does while it is running
+func (d *testDebate) pause() {
+	if pause, running := runningDebates.Load(d.chat.ID); running {
+		pause.(context.CancelFunc)()
+	}
+}
+
+func TestDebateTurnOrder(t *testing.T) {
+	test := newTestDebate(4, ai.NewFakeProvider("I disagree."))
+	if err := test.run(Sink{}); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"Alice", "Bob", "Alice", "Bob", "Moderator"}
+	if !slices.Equal(test.speakers, expected) {
+		t.Errorf("expected %v, got %v", expected, test.speakers)
+	}
+	if test.instructions[0] != fmt.Sprintf(debateInstructions, "Bob", "Bob") || test.instructions[1] != fmt.Sprintf(debateInstructions, "Alice", "Alice") {
+		t.Errorf("expected every role to debate the other one, got %q", test.instructions[:2])
+	}
+	if test.instructions[4] != moderatorInstructions {
+		t.Errorf("expected the moderator to summarize, got %q", test.instructions[4])
+	}
+	if test.debate.TurnsDone != 4 || !test.debate.ModeratorDone || test.debate.Status != database.DebateStatusFinished {
+		t.Errorf("expected a finished debate, got %+v", test.debate)
+	}
+}
+
+func TestDebatePauseDuringTurn(t *testing.T) {
+	test := newTestDebate(4, ai.NewFakeProvider("One two three four"))
+
+	// The second turn is paused after its first word
+	err := test.run(Sink{Delta: func(delta string) error {
+		if len(test.speakers) == 1 {
+			test.pause()
+		}
+		return nil
+	}})
+	if err != nil {
+		t.Fatalf("expected pausing not to be an error, got %v", err)
+	}
+	if !slices.Equal(test.speakers, []string{"Alice", "Bob"}) || !test.truncated[1] {
+		t.Errorf("expected the second turn to be truncated, got %v %v", test.speakers, test.truncated)
+	}
+	if test.debate.TurnsDone != 2 || test.debate.Status != database.DebateStatusPaused {
+		t.Errorf("expected the truncated turn to count, got %+v", test.debate)
+	}
+
+	// Resuming continues with the next role
+	if err := test.run(Sink{}); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"Alice", "Bob", "Alice", "Bob", "Moderator"}
+	if !slices.Equal(test.speakers, expected) || test.debate.Status != database.DebateStatusFinished {
+		t.Errorf("expected %v and a finished debate, got %v %+v", expected, test.speakers, test.debate)
+	}
+}
+
+func TestDebateResumeAfterRestart(t *testing.T) {
+	// The server stopped during the fourth turn, so the debate is still marked as running but nothing runs it
+	test := newTestDebate(5, ai.NewFakeProvider("Next argument."))
+	test.debate.TurnsDone = 3
+	test.debate.Status = database.DebateStatusRunning
+
+	if err := test.run(Sink{}); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"Bob", "Alice", "Moderator"}
+	if !slices.Equal(test.speakers, expected) {
+		t.Errorf("expected %v, got %v", expected, test.speakers)
+	}
+	if test.debate.TurnsDone != 5 || test.debate.Status != database.DebateStatusFinished {
+		t.Errorf("expected a finished debate, got %+v", test.debate)
+	}
+}
+
+func TestDebateRunsOnlyOnce(t *testing.T) {
+	test := newTestDebate(2, ai.NewFakeProvider("Hello"))
+
+	var secondErr error
+	err := test.run(Sink{Delta: func(delta string) error {
+		if secondErr == nil {
+			other := test.debate
+			secondErr = test.runner.run(context.Background(), uuid.New(), test.chat, &other, Sink{})
+		}
+		return nil
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !errors.Is(secondErr, ErrDebateRunning) {
+		t.Errorf("expected ErrDebateRunning while the debate runs, got %v", secondErr)
+	}
+	if _, running := runningDebates.Load(test.chat.ID); running {
+		t.Error("expected the debate to be removed from the running debates")
+	}
+}
+
+func TestDebatePauseDuringModerator(t *testing.T) {
+	test := newTestDebate(2, ai.NewFakeProvider("One two three four"))
+
+	err := test.run(Sink{Delta: func(delta string) error {
+		if len(test.speakers) == 2 {
+			test.pause()
+		}
+		return nil
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(test.speakers, []string{"Alice", "Bob", "Moderator"}) || !test.truncated[2] {
+		t.Errorf("expected a truncated summary, got %v %v", test.speakers, test.truncated)
+	}
+	if !test.debate.ModeratorDone || test.debate.Status != database.DebateStatusFinished {
+		t.Errorf("expected the truncated summary to finish the debate, got %+v", test.debate)
+	}
+
+	// The moderator doesn't summarize a second time
+	if err := test.run(Sink{}); err != nil {
+		t.Fatal(err)
+	}
+	if len(test.speakers) != 3 {
+		t.Errorf("expected no further answers, got %v", test.speakers)
+	}
+}
+
+func TestDebateWithoutModerator(t *testing.T) {
+	test := newTestDebate(2, ai.NewFakeProvider("Hello"))
+	test.debate.ModeratorID = nil
+	if err := test.run(Sink{}); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(test.speakers, []string{"Alice", "Bob"}) || test.debate.Status != database.DebateStatusFinished {
+		t.Errorf("expected only the two roles to answer, got %v %+v", test.speakers, test.debate)
+	}
+}
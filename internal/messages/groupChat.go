@@ -0,0 +1,135 @@
+package messages
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"unicode"
+
+	"github.com/google/uuid"
+	"github.com/roly-backend/internal/chats"
+	"github.com/roly-backend/internal/database"
+)
+
+// Returns the roles of the chat that still exist, in the order they answer
+func loadChatRoles(ctx context.Context, chat database.Chat) ([]database.Role, error) {
+	roleIDs, err := chats.RoleIDs(ctx, chat)
+	if err != nil || len(roleIDs) == 0 {
+		return nil, err
+	}
+
+	var found []database.Role
+	if err := database.DB.WithContext(ctx).Where("id IN ?", roleIDs).Find(&found).Error; err != nil {
+		return nil, err
+	}
+	byID := map[uuid.UUID]database.Role{}
+	for _, role := range found {
+		byID[role.ID] = role
+	}
+
+	// Deleted roles don't answer anymore
+	ordered := make([]database.Role, 0, len(found))
+	for _, roleID := range roleIDs {
+		if role, ok := byID[roleID]; ok {
+			ordered = append(ordered, role)
+		}
+	}
+	return ordered, nil
+}
+
+// Returns the roles that answer the new message of the user, in the order they answer
+func respondingRoles(ctx context.Context, chat database.Chat, history []database.Message, content string) ([]database.Role, error) {
+	chatRoles, err := loadChatRoles(ctx, chat)
+	if err != nil {
+		return nil, err
+	}
+	if len(chatRoles) == 0 {
+		return nil, ErrChatHasNoRole
+	}
+	if len(chatRoles) == 1 {
+		return chatRoles, nil
+	}
+
+	// Round robin continues after the role that answered last
+	lastRoleID := uuid.Nil
+	for i := len(history) - 1; i >= 0; i-- {
+		if history[i].SenderRole == "assistant" {
+			var snapshot database.RoleSnapshot
+			if err := database.DB.WithContext(ctx).Select("role_id").First(&snapshot, "id = ?", history[i].RoleSnapshotID).Error; err != nil {
+				return nil, err
+			}
+			lastRoleID = snapshot.RoleID
+			break
+		}
+	}
+	return chooseResponders(chat.TurnPolicy, chatRoles, lastRoleID, content), nil
+}
+
+// Applies the turn policy of a group chat. lastRoleID is the role that answered last (uuid.Nil if no role answered yet)
+func chooseResponders(policy string, chatRoles []database.Role, lastRoleID uuid.UUID, content string) []database.Role {
+	switch policy {
+	case database.TurnPolicyAll:
+		return chatRoles
+	case database.TurnPolicyMention:
+		var mentioned []database.Role
+		for _, role := range chatRoles {
+			if mentions(content, role.Name) {
+				mentioned = append(mentioned, role)
+			}
+		}
+		if len(mentioned) > 0 {
+			return mentioned
+		}
+	}
+
+	next := 0
+	for i, role := range chatRoles {
+		if role.ID == lastRoleID {
+			next = (i + 1) % len(chatRoles)
+		}
+	}
+	return chatRoles[next : next+1]
+}
+
+// Returns true if the content contains @name (case insensitive), so "@Bob" doesn't mention a role named "Bo"
+func mentions(content, name string) bool {
+	if name == "" {
+		return false
+	}
+	content = strings.ToLower(content)
+	mention := "@" + strings.ToLower(name)
+	for {
+		index := strings.Index(content, mention)
+		if index < 0 {
+			return false
+		}
+		content = content[index+len(mention):]
+		next := []rune(content)
+		if len(next) == 0 || !(unicode.IsLetter(next[0]) || unicode.IsDigit(next[0]) || next[0] == '_') {
+			return true
+		}
+	}
+}
+
+// Shows the turns of the other roles of a group chat to the AI as messages of the user that start with the name of the role,
+// so the AI only speaks as its own role. The messages of the history aren't changed
+func labelPersonas(history []database.Message, snapshots map[uuid.UUID]SnapshotInfo, roleID uuid.UUID) []database.Message {
+	labeled := make([]database.Message, 0, len(history))
+	for _, message := range history {
+		snapshot, ok := snapshots[message.RoleSnapshotID]
+		if message.SenderRole != "user" && ok && snapshot.RoleID != roleID {
+			content := toChatMessage(message, false).Content
+			message.SenderRole = "user"
+			message.Kind = database.MessageKindText
+			message.Content = snapshot.Name + ": " + content
+		}
+		labeled = append(labeled, message)
+	}
+	return labeled
+}
+
+// Tells the role who else takes part in the group chat
+func groupInstructions(name string, others []string) string {
+	return fmt.Sprintf("You are %s in a group chat with the user and %s. Messages of the other participants start with their name. "+
+		"Answer only as %s and never write for the other participants.", name, strings.Join(others, ", "), name)
+}
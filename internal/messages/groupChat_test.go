@@ -0,0 +1,78 @@
+package messages
+
+import (
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/roly-backend/internal/database"
+)
+
+func TestChooseResponders(t *testing.T) {
+	alice := database.Role{ID: uuid.New(), Name: "Alice"}
+	bob := database.Role{ID: uuid.New(), Name: "Bob"}
+	carol := database.Role{ID: uuid.New(), Name: "Carol Smith"}
+	chatRoles := []database.Role{alice, bob, carol}
+
+	names := func(chosen []database.Role) []string {
+		var result []string
+		for _, role := range chosen {
+			result = append(result, role.Name)
+		}
+		return result
+	}
+
+	tests := []struct {
+		name     string
+		policy   string
+		lastRole uuid.UUID
+		content  string
+		expected []string
+	}{
+		{"round robin starts with the first role", database.TurnPolicyRoundRobin, uuid.Nil, "Hi", []string{"Alice"}},
+		{"round robin continues after the last role", database.TurnPolicyRoundRobin, alice.ID, "Hi", []string{"Bob"}},
+		{"round robin wraps around", database.TurnPolicyRoundRobin, carol.ID, "Hi", []string{"Alice"}},
+		{"all roles answer in order", database.TurnPolicyAll, bob.ID, "Hi", []string{"Alice", "Bob", "Carol Smith"}},
+		{"mentioned roles answer", database.TurnPolicyMention, uuid.Nil, "@carol smith and @Alice, what do you think?", []string{"Alice", "Carol Smith"}},
+		{"without mention the next role answers", database.TurnPolicyMention, alice.ID, "What do you think?", []string{"Bob"}},
+		{"a longer name isn't a mention", database.TurnPolicyMention, bob.ID, "@Bobby?", []string{"Carol Smith"}},
+	}
+	for _, test := range tests {
+		got := names(chooseResponders(test.policy, chatRoles, test.lastRole, test.content))
+		if len(got) != len(test.expected) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected, got)
+			continue
+		}
+		for i := range got {
+			if got[i] != test.expected[i] {
+				t.Errorf("%s: expected %v, got %v", test.name, test.expected, got)
+				break
+			}
+		}
+	}
+}
+
+func TestLabelPersonas(t *testing.T) {
+	alice := SnapshotInfo{ID: uuid.New(), RoleID: uuid.New(), Name: "Alice"}
+	bob := SnapshotInfo{ID: uuid.New(), RoleID: uuid.New(), Name: "Bob"}
+	snapshots := map[uuid.UUID]SnapshotInfo{alice.ID: alice, bob.ID: bob}
+
+	history := []database.Message{
+		{SenderRole: "user", Kind: database.MessageKindText, Content: "Hi", RoleSnapshotID: alice.ID},
+		{SenderRole: "assistant", Kind: database.MessageKindText, Content: "Hello from Alice", RoleSnapshotID: alice.ID},
+		{SenderRole: "assistant", Kind: database.MessageKindText, Content: "Hello from Bob", RoleSnapshotID: bob.ID},
+	}
+
+	labeled := labelPersonas(history, snapshots, bob.RoleID)
+	if labeled[0].SenderRole != "user" || labeled[0].Content != "Hi" {
+		t.Errorf("expected the message of the user to stay, got %+v", labeled[0])
+	}
+	if labeled[1].SenderRole != "user" || labeled[1].Content != "Alice: Hello from Alice" {
+		t.Errorf("expected the answer of the other role to be labeled, got %+v", labeled[1])
+	}
+	if labeled[2].SenderRole != "assistant" || labeled[2].Content != "Hello from Bob" {
+		t.Errorf("expected the own answer to stay, got %+v", labeled[2])
+	}
+	if history[1].SenderRole != "assistant" {
+		t.Error("expected the history to stay unchanged")
+	}
+}
@@ -1,3 +1,356 @@
 package messages
 
-// TODO: alles zu Nachrichten
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/roly-backend/internal/ai"
+	"github.com/roly-backend/internal/chats"
+	"github.com/roly-backend/internal/config"
+	"github.com/roly-backend/internal/moderation"
+	"github.com/roly-backend/internal/quotas"
+	"github.com/roly-backend/internal/roles"
+	"github.com/roly-backend/internal/users"
+)
+
+// Saves a message of the user and returns it together with the answer of the AI.
+// Unlike the websocket the answer isn't streamed, the response is sent when the answer is complete
+func SendMessageHandler(c *gin.Context) {
+	userID, err := users.GetUserID(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	chatID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid chat id"})
+		return
+	}
+
+	var input struct {
+		Content string `json:"content" binding:"required"`
+		Model   string `json:"model"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	reply, err := SendMessage(c.Request.Context(), userID, chatID, input.Content, input.Model, Sink{})
+	if err != nil {
+		// The message of the user can be saved even if the AI failed, so the client knows it doesn't have to send it again
+		status, body := httpError(userID, err)
+		if reply.UserMessage.ID != uuid.Nil {
+			body["user_message"] = ToMessageInfo(reply.UserMessage)
+		}
+		// In group chats the roles before the one that failed already answered
+		if reply.Message.ID != uuid.Nil {
+			body["reply"] = ToMessageInfo(reply.Message)
+			body["followups"] = followupInfos(reply)
+		}
+		c.JSON(status, body)
+		return
+	}
+
+	userMessage := ToMessageInfo(reply.UserMessage)
+	c.JSON(http.StatusCreated, sendMessageResponse{
+		UserMessage:    &userMessage,
+		Reply:          ToMessageInfo(reply.Message),
+		Data:           reply.Data,
+		RequestedModel: reply.RequestedModel,
+		Usage:          reply.Usage,
+		Excluded:       reply.ExcludedMessageIDs,
+		Followups:      followupInfos(reply),
+	})
+}
+
+// Returns a page of the messages of a chat. ?before= takes the next_cursor of the previous page to load older messages
+func HistoryHandler(c *gin.Context) {
+	userID, err := users.GetUserID(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	chatID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid chat id"})
+		return
+	}
+	limit := 0
+	if value := c.Query("limit"); value != "" {
+		if limit, err = strconv.Atoi(value); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "limit has to be a number"})
+			return
+		}
+	}
+
+	page, err := LoadHistory(c.Request.Context(), userID, chatID, c.Query("before"), limit)
+	if err != nil {
+		c.JSON(httpError(userID, err))
+		return
+	}
+	c.JSON(http.StatusOK, page)
+}
+
+// Lets the AI answer again instead of the given answer. The old answer stays as an alternative
+func RegenerateHandler(c *gin.Context) {
+	userID, err := users.GetUserID(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	messageID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid message id"})
+		return
+	}
+
+	// The body is optional, without it the default model answers
+	var input struct {
+		Model string `json:"model"`
+	}
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&input); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	reply, err := Regenerate(c.Request.Context(), userID, messageID, input.Model, Sink{})
+	if err != nil {
+		c.JSON(httpError(userID, err))
+		return
+	}
+	c.JSON(http.StatusCreated, sendMessageResponse{
+		Reply:          ToMessageInfo(reply.Message),
+		Data:           reply.Data,
+		RequestedModel: reply.RequestedModel,
+		Usage:          reply.Usage,
+		Excluded:       reply.ExcludedMessageIDs,
+	})
+}
+
+// Saves a new version of an earlier message of the user as a new branch and returns it together with the answer of the AI
+func EditMessageHandler(c *gin.Context) {
+	userID, err := users.GetUserID(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	messageID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid message id"})
+		return
+	}
+
+	var input struct {
+		Content string `json:"content" binding:"required"`
+		Model   string `json:"model"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	reply, err := EditMessage(c.Request.Context(), userID, messageID, input.Content, input.Model, Sink{})
+	if err != nil {
+		status, body := httpError(userID, err)
+		if reply.UserMessage.ID != uuid.Nil {
+			body["user_message"] = ToMessageInfo(reply.UserMessage)
+		}
+		// In group chats the roles before the one that failed already answered
+		if reply.Message.ID != uuid.Nil {
+			body["reply"] = ToMessageInfo(reply.Message)
+			body["followups"] = followupInfos(reply)
+		}
+		c.JSON(status, body)
+		return
+	}
+
+	userMessage := ToMessageInfo(reply.UserMessage)
+	c.JSON(http.StatusCreated, sendMessageResponse{
+		UserMessage:    &userMessage,
+		Reply:          ToMessageInfo(reply.Message),
+		Data:           reply.Data,
+		RequestedModel: reply.RequestedModel,
+		Usage:          reply.Usage,
+		Excluded:       reply.ExcludedMessageIDs,
+		Followups:      followupInfos(reply),
+	})
+}
+
+// Returns the branches of a chat
+func ListBranchesHandler(c *gin.Context) {
+	userID, err := users.GetUserID(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	chatID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid chat id"})
+		return
+	}
+
+	branches, err := ListBranches(c.Request.Context(), userID, chatID)
+	if err != nil {
+		c.JSON(httpError(userID, err))
+		return
+	}
+	c.JSON(http.StatusOK, branches)
+}
+
+// Makes an alternative of a message the one that is shown in the chat. Activating the newest message of a branch switches to the branch
+func ActivateMessageHandler(c *gin.Context) {
+	userID, err := users.GetUserID(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	messageID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid message id"})
+		return
+	}
+
+	if err := ActivateMessage(c.Request.Context(), userID, messageID); err != nil {
+		c.JSON(httpError(userID, err))
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// Returns the debate of a chat
+func GetDebateHandler(c *gin.Context) {
+	userID, chatID, ok := debateRequest(c)
+	if !ok {
+		return
+	}
+
+	debate, err := GetDebate(c.Request.Context(), userID, chatID)
+	if err != nil {
+		c.JSON(httpError(userID, err))
+		return
+	}
+	c.JSON(http.StatusOK, debate)
+}
+
+// Pauses a running debate after the part of the current turn that was already written
+func PauseDebateHandler(c *gin.Context) {
+	userID, chatID, ok := debateRequest(c)
+	if !ok {
+		return
+	}
+
+	debate, err := PauseDebate(c.Request.Context(), userID, chatID)
+	if err != nil {
+		c.JSON(httpError(userID, err))
+		return
+	}
+	c.JSON(http.StatusOK, debate)
+}
+
+// Reads the user and the chat id of the debate routes. Sends the error response if one of them is missing
+func debateRequest(c *gin.Context) (uuid.UUID, uuid.UUID, bool) {
+	userID, err := users.GetUserID(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return userID, uuid.Nil, false
+	}
+	chatID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid chat id"})
+		return userID, chatID, false
+	}
+	return userID, chatID, true
+}
+
+// Response of SendMessageHandler and RegenerateHandler
+type sendMessageResponse struct {
+	UserMessage    *MessageInfo    `json:"user_message,omitempty"`
+	Reply          MessageInfo     `json:"reply"`
+	Data           json.RawMessage `json:"data,omitempty"` // Typed JSON answer of roles with an output schema
+	RequestedModel string          `json:"requested_model"`
+	Usage          ai.Usage        `json:"usage"`
+	Excluded       []uuid.UUID     `json:"excluded_message_ids,omitempty"`
+	Followups      []MessageInfo   `json:"followups,omitempty"` // Answers of the further roles of a group chat
+}
+
+// Returns the answers of the further roles of a group chat for the client
+func followupInfos(reply Reply) []MessageInfo {
+	var infos []MessageInfo
+	for _, followup := range reply.Followups {
+		infos = append(infos, ToMessageInfo(followup.Message))
+	}
+	return infos
+}
+
+// Converts the errors of this package into a status and a body for the client. Unexpected errors are logged
+func httpError(userID uuid.UUID, err error) (int, gin.H) {
+	var quotaErr *quotas.ExceededError
+	var blockedErr *moderation.BlockedError
+	var aiErr *ai.Error
+	var validationErr *roles.ValidationError
+	switch {
+	case errors.As(err, &validationErr):
+		return http.StatusBadRequest, gin.H{"error": validationErr.Error()}
+	case errors.As(err, &blockedErr):
+		return http.StatusUnprocessableEntity, gin.H{"error": "Content was blocked by the moderation", "stage": blockedErr.Stage}
+	case errors.As(err, &quotaErr):
+		return http.StatusTooManyRequests, gin.H{"error": fmt.Sprintf("Your %s %s limit is used up", quotaErr.Period, quotaErr.Limit), "reset_at": quotaErr.ResetAt.Format(time.RFC3339)}
+	case errors.As(err, &aiErr) && aiErr.Kind == ai.ErrKindRateLimited:
+		return http.StatusServiceUnavailable, gin.H{"error": "The AI is busy right now, please try again in a moment"}
+	case errors.As(err, &aiErr) && aiErr.Kind != ai.ErrKindUnknown:
+		return http.StatusBadGateway, gin.H{"error": "The AI is not available right now, please try again later"}
+	case errors.Is(err, ErrChatNotFound):
+		return http.StatusNotFound, gin.H{"error": "Chat not found"}
+	case errors.Is(err, ErrMessageNotFound):
+		return http.StatusNotFound, gin.H{"error": "Message not found"}
+	case errors.Is(err, ErrNotAnAnswer):
+		return http.StatusBadRequest, gin.H{"error": "Only answers of the AI can be regenerated"}
+	case errors.Is(err, ErrNotAUserMessage):
+		return http.StatusBadRequest, gin.H{"error": "Only messages of the user can be edited"}
+	case errors.Is(err, ErrNothingToAnswer):
+		return http.StatusBadRequest, gin.H{"error": "There is no user message to answer"}
+	case errors.Is(err, ErrInvalidCursor):
+		return http.StatusBadRequest, gin.H{"error": "Invalid cursor"}
+	case errors.Is(err, ErrEmptyMessage):
+		return http.StatusBadRequest, gin.H{"error": "Message is empty"}
+	case errors.Is(err, ErrMessageTooLong):
+		return http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Message must not be longer than %d characters", config.MaxMessageLength)}
+	case errors.Is(err, ErrChatHasNoRole):
+		return http.StatusBadRequest, gin.H{"error": "The chat has no role"}
+	case errors.Is(err, ErrModelUnavailable):
+		return http.StatusBadRequest, gin.H{"error": "Model is not available"}
+	case errors.Is(err, ErrContextTooLarge):
+		return http.StatusBadRequest, gin.H{"error": "The message is too long for the model"}
+	case errors.Is(err, ai.ErrInvalidStructuredOutput):
+		return http.StatusBadGateway, gin.H{"error": "The AI didn't manage to answer in the format of the role"}
+	case errors.Is(err, ErrDebateNotFound):
+		return http.StatusNotFound, gin.H{"error": "Debate not found"}
+	case errors.Is(err, ErrDebateRunning):
+		return http.StatusConflict, gin.H{"error": "The debate is already running"}
+	case errors.Is(err, ErrDebateFinished):
+		return http.StatusConflict, gin.H{"error": "The debate is already finished"}
+	case errors.Is(err, ErrDebateRoles):
+		return http.StatusBadRequest, gin.H{"error": "A debate needs two different roles"}
+	case errors.Is(err, ErrDebateTurns):
+		return http.StatusBadRequest, gin.H{"error": fmt.Sprintf("turns has to be between 1 and %d", config.MaxDebateTurns)}
+	case errors.Is(err, chats.ErrRoleNotFound):
+		return http.StatusBadRequest, gin.H{"error": "Role not found"}
+	}
+
+	slog.LogAttrs(context.Background(), slog.LevelError, "Error handling chat message",
+		slog.String("user_id", userID.String()),
+		slog.String("error", err.Error()),
+	)
+	return http.StatusInternalServerError, gin.H{"error": "Internal server error"}
+}
@@ -0,0 +1,61 @@
+package messages
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/roly-backend/internal/users"
+)
+
+// Sends a request to the handler, authorized as the user unless userID is empty, and returns the status and the decoded body
+func callHandler(t *testing.T, handler gin.HandlerFunc, userID, chatID, body string) (int, map[string]any) {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	recorder := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(recorder)
+	c.Request = httptest.NewRequest(http.MethodPost, "/api/chats/"+chatID+"/messages", strings.NewReader(body))
+	c.Request.Header.Set("Content-Type", "application/json")
+	c.Params = gin.Params{{Key: "id", Value: chatID}}
+	if userID != "" {
+		c.Set(string(users.UserContextKey), &users.Claims{UserID: userID})
+	}
+	handler(c)
+
+	var decoded map[string]any
+	if err := json.Unmarshal(recorder.Body.Bytes(), &decoded); err != nil {
+		t.Fatalf("response is not JSON: %s", recorder.Body.String())
+	}
+	return recorder.Code, decoded
+}
+
+// The requests are rejected before the database is used
+func TestSendMessageHandlerRejectsInvalidRequests(t *testing.T) {
+	userID, chatID := uuid.NewString(), uuid.NewString()
+	tests := []struct {
+		name   string
+		userID string
+		chatID string
+		body   string
+		status int
+	}{
+		{"unauthorized", "", chatID, `{"content": "Hi"}`, http.StatusUnauthorized},
+		{"invalid chat id", userID, "not-a-uuid", `{"content": "Hi"}`, http.StatusBadRequest},
+		{"missing content", userID, chatID, `{"model": "gpt-4.1-nano"}`, http.StatusBadRequest},
+		{"empty content", userID, chatID, `{"content": "   "}`, http.StatusBadRequest},
+		{"unknown model", userID, chatID, `{"content": "Hi", "model": "does-not-exist"}`, http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		status, body := callHandler(t, SendMessageHandler, test.userID, test.chatID, test.body)
+		if status != test.status || body["error"] == "" {
+			t.Errorf("%s: expected status %d with an error, got %d %v", test.name, test.status, status, body)
+		}
+		if _, ok := body["user_message"]; ok {
+			t.Errorf("%s: expected no saved message, got %v", test.name, body)
+		}
+	}
+}
@@ -0,0 +1,213 @@
+package messages
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+
+	"github.com/google/uuid"
+	"github.com/roly-backend/internal/config"
+	"github.com/roly-backend/internal/database"
+)
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// The role that was used for a message, so the client can show which persona wrote it
+type SnapshotInfo struct {
+	ID     uuid.UUID `json:"id"`
+	RoleID uuid.UUID `json:"role_id"`
+	Name   string    `json:"name"`
+}
+
+// One page of the messages of a chat, ordered from oldest to newest
+type HistoryPage struct {
+	Messages   []MessageInfo `json:"messages"`
+	NextCursor string        `json:"next_cursor,omitempty"` // Loads the messages before this page (empty if there are no older messages)
+}
+
+// Returns the newest messages of a chat that are older than the cursor. An empty cursor starts at the newest message.
+// Only the active path is returned, the alternatives of every message are listed so the client can switch to them.
+// Paging follows the message tree and not the creation time: the cursor is the oldest message of the previous page, the next page are its parent and the parents before it.
+// So the pages stay stable while new messages are written, and a page only reads its own messages and not the whole chat
+func LoadHistory(ctx context.Context, userID, chatID uuid.UUID, before string, limit int) (HistoryPage, error) {
+	if limit <= 0 {
+		limit = config.DefaultHistoryPageSize
+	}
+	if limit > config.MaxHistoryPageSize {
+		limit = config.MaxHistoryPageSize
+	}
+
+	chat, err := getChat(ctx, userID, chatID)
+	if err != nil {
+		return HistoryPage{}, err
+	}
+
+	// One message more than the page tells if there are older messages
+	var ids []uuid.UUID
+	if before == "" {
+		ids, err = newestPathIDs(ctx, chat.ID, limit+1)
+	} else {
+		cursorID, cursorErr := decodeCursor(before)
+		if cursorErr != nil {
+			return HistoryPage{}, cursorErr
+		}
+		ids, err = pathIDsBefore(ctx, chat.ID, cursorID, limit+1)
+	}
+	if err != nil {
+		return HistoryPage{}, err
+	}
+
+	page := HistoryPage{Messages: []MessageInfo{}}
+	if len(ids) == 0 {
+		return page, nil
+	}
+	hasMore := len(ids) > limit
+	if hasMore {
+		ids = ids[:limit]
+	}
+
+	var rows []database.Message
+	if err := database.DB.WithContext(ctx).Where("id IN ?", ids).Order("created_at ASC, id ASC").Find(&rows).Error; err != nil {
+		return HistoryPage{}, err
+	}
+	if hasMore && len(rows) > 0 {
+		page.NextCursor = encodeCursor(rows[0].ID)
+	}
+
+	snapshots, err := loadSnapshotInfos(ctx, rows)
+	if err != nil {
+		return HistoryPage{}, err
+	}
+	siblings, err := loadSiblings(ctx, chat.ID, rows)
+	if err != nil {
+		return HistoryPage{}, err
+	}
+	for _, row := range rows {
+		info := ToMessageInfo(row)
+		if snapshot, ok := snapshots[row.RoleSnapshotID]; ok {
+			info.RoleSnapshot = &snapshot
+		}
+		if alternatives := siblings.alternatives(row); len(alternatives) > 1 {
+			info.Alternatives = alternatives
+		}
+		page.Messages = append(page.Messages, info)
+	}
+	return page, nil
+}
+
+// Walks the active path from the first message of the chat, like messageTree.activePath, and returns the ids of its newest messages, the newest first.
+// Only the ids are read, one index lookup per message
+func newestPathIDs(ctx context.Context, chatID uuid.UUID, limit int) ([]uuid.UUID, error) {
+	var rows []struct{ ID uuid.UUID }
+	err := database.DB.WithContext(ctx).Raw(`WITH RECURSIVE active_path AS (
+			(SELECT id, 1 AS depth FROM messages WHERE chat_id = ? AND parent_id IS NULL ORDER BY is_active DESC, created_at DESC, id DESC LIMIT 1)
+			UNION ALL
+			SELECT child.id, active_path.depth + 1 FROM active_path CROSS JOIN LATERAL (
+				SELECT id FROM messages WHERE parent_id = active_path.id ORDER BY is_active DESC, created_at DESC, id DESC LIMIT 1
+			) AS child
+		)
+		SELECT id FROM active_path ORDER BY depth DESC LIMIT ?`, chatID, limit).Scan(&rows).Error
+	return rowIDs(rows), err
+}
+
+// Walks from the message of the cursor to the first message of the chat and returns the ids of the messages before the cursor, the newest first
+func pathIDsBefore(ctx context.Context, chatID, cursorID uuid.UUID, limit int) ([]uuid.UUID, error) {
+	var cursor database.Message
+	err := database.DB.WithContext(ctx).Select("id", "parent_id").Where("id = ? AND chat_id = ?", cursorID, chatID).Limit(1).Find(&cursor).Error
+	if err != nil {
+		return nil, err
+	}
+	if cursor.ID == uuid.Nil {
+		return nil, ErrInvalidCursor
+	}
+	if cursor.ParentID == nil {
+		return nil, nil
+	}
+
+	var rows []struct{ ID uuid.UUID }
+	err = database.DB.WithContext(ctx).Raw(`WITH RECURSIVE ancestors AS (
+			SELECT id, parent_id, 1 AS depth FROM messages WHERE id = ?
+			UNION ALL
+			SELECT messages.id, messages.parent_id, ancestors.depth + 1 FROM messages JOIN ancestors ON messages.id = ancestors.parent_id WHERE ancestors.depth < ?
+		)
+		SELECT id FROM ancestors ORDER BY depth ASC`, *cursor.ParentID, limit).Scan(&rows).Error
+	return rowIDs(rows), err
+}
+
+func rowIDs(rows []struct{ ID uuid.UUID }) []uuid.UUID {
+	ids := make([]uuid.UUID, len(rows))
+	for i, row := range rows {
+		ids[i] = row.ID
+	}
+	return ids
+}
+
+// Loads the alternatives of the messages as a tree that only contains the messages with the same parents
+func loadSiblings(ctx context.Context, chatID uuid.UUID, rows []database.Message) (messageTree, error) {
+	var parentIDs []uuid.UUID
+	first := false
+	for _, row := range rows {
+		if row.ParentID == nil {
+			first = true
+		} else {
+			parentIDs = append(parentIDs, *row.ParentID)
+		}
+	}
+
+	query := database.DB.WithContext(ctx).Select("id", "chat_id", "parent_id", "is_active", "created_at").Where("chat_id = ?", chatID)
+	switch {
+	case first && len(parentIDs) > 0:
+		query = query.Where("(parent_id IS NULL OR parent_id IN ?)", parentIDs)
+	case first:
+		query = query.Where("parent_id IS NULL")
+	default:
+		query = query.Where("parent_id IN ?", parentIDs)
+	}
+	var siblings []database.Message
+	if err := query.Order("created_at ASC, id ASC").Find(&siblings).Error; err != nil {
+		return messageTree{}, err
+	}
+	return newMessageTree(siblings), nil
+}
+
+// Loads the role snapshots of the messages with one query
+func loadSnapshotInfos(ctx context.Context, rows []database.Message) (map[uuid.UUID]SnapshotInfo, error) {
+	infos := map[uuid.UUID]SnapshotInfo{}
+	seen := map[uuid.UUID]bool{}
+	var ids []uuid.UUID
+	for _, row := range rows {
+		if !seen[row.RoleSnapshotID] {
+			seen[row.RoleSnapshotID] = true
+			ids = append(ids, row.RoleSnapshotID)
+		}
+	}
+	if len(ids) == 0 {
+		return infos, nil
+	}
+
+	var snapshots []database.RoleSnapshot
+	if err := database.DB.WithContext(ctx).Where("id IN ?", ids).Find(&snapshots).Error; err != nil {
+		return nil, err
+	}
+	for _, snapshot := range snapshots {
+		infos[snapshot.ID] = SnapshotInfo{ID: snapshot.ID, RoleID: snapshot.RoleID, Name: snapshot.Name}
+	}
+	return infos, nil
+}
+
+// The cursor is the id of a message, encoded so clients treat it as an opaque string
+func encodeCursor(id uuid.UUID) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(id.String()))
+}
+
+func decodeCursor(cursor string) (uuid.UUID, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return uuid.Nil, ErrInvalidCursor
+	}
+	id, err := uuid.Parse(string(raw))
+	if err != nil {
+		return uuid.Nil, ErrInvalidCursor
+	}
+	return id, nil
+}
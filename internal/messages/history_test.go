@@ -0,0 +1,25 @@
+package messages
+
+import (
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestCursor(t *testing.T) {
+	id := uuid.New()
+
+	decodedID, err := decodeCursor(encodeCursor(id))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decodedID != id {
+		t.Errorf("expected %v, got %v", id, decodedID)
+	}
+
+	for _, cursor := range []string{"not base64!", "bm8tdXVpZA", encodeCursor(id)[:10]} {
+		if _, err := decodeCursor(cursor); err != ErrInvalidCursor {
+			t.Errorf("%q: expected ErrInvalidCursor, got %v", cursor, err)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package messages
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/roly-backend/internal/database"
+)
+
+// A message how the client gets it
+type MessageInfo struct {
+	ID             uuid.UUID     `json:"id"`
+	ChatID         uuid.UUID     `json:"chat_id"`
+	ParentID       *uuid.UUID    `json:"parent_id"`
+	SenderRole     string        `json:"sender_role"`
+	Kind           string        `json:"kind"`
+	Content        string        `json:"content"`
+	Truncated      bool          `json:"truncated"`
+	Flagged        bool          `json:"flagged"`
+	ToolCallID     string        `json:"tool_call_id,omitempty"`
+	ToolName       string        `json:"tool_name,omitempty"`
+	RoleSnapshotID uuid.UUID     `json:"role_snapshot_id"`
+	RoleSnapshot   *SnapshotInfo `json:"role_snapshot,omitempty"` // Only set in the history
+	Alternatives   []uuid.UUID   `json:"alternatives,omitempty"`  // All versions of this message (including this one) if there is more than one. Only set in the history
+	CreatedAt      time.Time     `json:"created_at"`
+
+	// Only set for answers of the AI
+	Model            string  `json:"model,omitempty"`
+	PromptTokens     int64   `json:"prompt_tokens,omitempty"`
+	CompletionTokens int64   `json:"completion_tokens,omitempty"`
+	Cost             float64 `json:"cost,omitempty"` // US dollars
+}
+
+// Converts a message of the database into the format for the client
+func ToMessageInfo(message database.Message) MessageInfo {
+	return MessageInfo{
+		ID:               message.ID,
+		ChatID:           message.ChatID,
+		ParentID:         message.ParentID,
+		SenderRole:       message.SenderRole,
+		Kind:             message.Kind,
+		Content:          message.Content,
+		Truncated:        message.Truncated,
+		Flagged:          message.Flagged,
+		ToolCallID:       message.ToolCallID,
+		ToolName:         message.ToolName,
+		RoleSnapshotID:   message.RoleSnapshotID,
+		CreatedAt:        message.CreatedAt,
+		Model:            message.Model,
+		PromptTokens:     message.PromptTokens,
+		CompletionTokens: message.CompletionTokens,
+		Cost:             message.Cost,
+	}
+}
@@ -1,3 +1,644 @@
 package messages
 
-// TODO: alles weitere zu messages
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/roly-backend/internal/ai"
+	"github.com/roly-backend/internal/config"
+	"github.com/roly-backend/internal/database"
+	"github.com/roly-backend/internal/moderation"
+	"github.com/roly-backend/internal/quotas"
+	"github.com/roly-backend/internal/roles"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrChatNotFound     = errors.New("chat not found")
+	ErrNothingToAnswer  = errors.New("the last message of the chat is not a user message")
+	ErrModelUnavailable = errors.New("model is not available")
+	ErrEmptyMessage     = errors.New("message is empty")
+	ErrMessageTooLong   = errors.New("message is too long")
+	ErrChatHasNoRole    = errors.New("chat has no role")
+)
+
+// Result of a generated AI reply
+type Reply struct {
+	UserMessage        database.Message // Only set by SendMessage
+	Message            database.Message
+	Data               json.RawMessage // The validated JSON if the role has an output schema
+	Model              string          // The model that answered (can be a fallback model)
+	RequestedModel     string
+	Usage              ai.Usage
+	ExcludedMessageIDs []uuid.UUID // Messages of the chat that didn't fit into the context window
+	Followups          []Reply     // Answers of the further roles of a group chat, in the order they were written (only set by SendMessage and EditMessage)
+}
+
+// Receives everything that happens while an answer is generated. Every callback is optional
+type Sink struct {
+	UserMessage func(message database.Message) error       // The message of the user was saved (only called by SendMessage)
+	Answering   func(snapshot database.RoleSnapshot) error // A role starts to answer, the following pieces belong to it
+	Delta       func(delta string) error                   // A piece of the answer
+	ToolCall    func(message database.Message) error       // The AI called a tool (the message is already saved)
+	ToolResult  func(message database.Message) error       // The tool returned its result (the message is already saved)
+	Answered    func(reply Reply) error                    // The answer is saved. In group chats every answer is passed on before the next role starts
+}
+
+// Saves a new message of the user in the chat and lets the AI answer it with the current role of the chat.
+// In group chats the turn policy decides which roles answer, each after the answers of the roles before it.
+// The message is moderated before it is saved, a blocked message is never saved.
+// The reply works like GenerateReply, Reply.UserMessage is the saved message of the user
+func SendMessage(ctx context.Context, userID, chatID uuid.UUID, content, model string, sink Sink) (Reply, error) {
+	content, model, err := checkUserMessage(content, model)
+	if err != nil {
+		return Reply{}, err
+	}
+
+	chat, err := getChat(ctx, userID, chatID)
+	if err != nil {
+		return Reply{}, err
+	}
+
+	// The message continues the path the user currently sees
+	history, err := loadActivePath(ctx, chat.ID)
+	if err != nil {
+		return Reply{}, err
+	}
+	return answerUserMessage(ctx, userID, chat, history, content, model, sink)
+}
+
+// Replaces an earlier message of the user with a new version and lets the AI answer it. The new version starts a new branch:
+// the old message and everything after it stays as an alternative the user can switch back to.
+// Works like SendMessage otherwise
+func EditMessage(ctx context.Context, userID, messageID uuid.UUID, content, model string, sink Sink) (Reply, error) {
+	content, model, err := checkUserMessage(content, model)
+	if err != nil {
+		return Reply{}, err
+	}
+
+	message, chat, err := getMessage(ctx, userID, messageID)
+	if err != nil {
+		return Reply{}, err
+	}
+	if message.SenderRole != "user" {
+		return Reply{}, ErrNotAUserMessage
+	}
+
+	// The new version follows the same messages as the old one
+	tree, err := loadTree(ctx, chat.ID, true)
+	if err != nil {
+		return Reply{}, err
+	}
+	return answerUserMessage(ctx, userID, chat, tree.historyBefore(message.ID), content, model, sink)
+}
+
+// Checks the content and the model of a new message of the user
+func checkUserMessage(content, model string) (string, string, error) {
+	content = strings.TrimSpace(content)
+	if content == "" {
+		return content, model, ErrEmptyMessage
+	}
+	if len([]rune(content)) > config.MaxMessageLength {
+		return content, model, ErrMessageTooLong
+	}
+	if model == "" {
+		model = ai.DefaultModel()
+	}
+	if !ai.IsAvailableModel(model) {
+		return content, model, ErrModelUnavailable
+	}
+	return content, model, nil
+}
+
+// Saves the message of the user after the history, makes it the active alternative and lets the AI answer it
+func answerUserMessage(ctx context.Context, userID uuid.UUID, chat database.Chat, history []database.Message, content, model string, sink Sink) (Reply, error) {
+	responders, err := respondingRoles(ctx, chat, history, content)
+	if err != nil {
+		return Reply{}, err
+	}
+
+	// The message isn't saved if the user can't get an answer anyway
+	if err := quotas.Check(ctx, userID); err != nil {
+		return Reply{}, err
+	}
+
+	// The message gets a snapshot of the first role that answers so the chat history stays the same when the role changes later
+	snapshot, err := resolveSnapshot(ctx, chat, responders[0].ID)
+	if err != nil {
+		return Reply{}, err
+	}
+
+	message, err := saveUserMessage(ctx, userID, chat, history, content, snapshot, sink)
+	if err != nil {
+		return Reply{UserMessage: message}, err
+	}
+
+	reply, err := generateReply(ctx, userID, chat, model, append(history, message), snapshot, "", sink)
+	reply.UserMessage = message
+	if err != nil {
+		return reply, err
+	}
+
+	// The further roles of a group chat see the answers of the roles before them
+	for _, role := range responders[1:] {
+		followup, err := answerAs(ctx, userID, chat, model, role, "", sink)
+		if err != nil {
+			return reply, err
+		}
+		reply.Followups = append(reply.Followups, followup)
+	}
+	return reply, nil
+}
+
+// Moderates the message of the user and saves it after the history as the active alternative.
+// Returns a message without id if the message wasn't saved
+func saveUserMessage(ctx context.Context, userID uuid.UUID, chat database.Chat, history []database.Message, content string, snapshot database.RoleSnapshot, sink Sink) (database.Message, error) {
+	message := database.Message{
+		ID:             uuid.New(),
+		ChatID:         chat.ID,
+		IsActive:       true,
+		SenderRole:     "user",
+		Kind:           database.MessageKindText,
+		Content:        content,
+		CreatedAt:      time.Now(),
+		RoleSnapshotID: snapshot.ID,
+	}
+	verdict, err := moderation.Check(ctx, moderation.StageInput, moderation.Subject{UserID: userID, ChatID: chat.ID, MessageID: &message.ID, Text: content})
+	if err != nil {
+		return database.Message{}, err
+	}
+	message.Flagged = verdict.Flagged()
+	moderation.GuardTurn(ctx, moderation.SourceUserMessage, userID, chat.ID, content)
+
+	if len(history) > 0 {
+		message.ParentID = &history[len(history)-1].ID
+	}
+	if err := database.DB.WithContext(ctx).Create(&message).Error; err != nil {
+		return database.Message{}, err
+	}
+	// The history could be a path the user doesn't see right now (an edited message)
+	if err := activatePath(ctx, history); err != nil {
+		return message, err
+	}
+	if err := activateAlternative(database.DB.WithContext(ctx), message); err != nil {
+		return message, err
+	}
+	if sink.UserMessage != nil {
+		if err := sink.UserMessage(message); err != nil {
+			return message, err
+		}
+	}
+	return message, nil
+}
+
+// Lets another role of a group chat answer after the newest message of the chat
+func answerAs(ctx context.Context, userID uuid.UUID, chat database.Chat, model string, role database.Role, instructions string, sink Sink) (Reply, error) {
+	if err := quotas.Check(ctx, userID); err != nil {
+		return Reply{}, err
+	}
+	snapshot, err := resolveSnapshot(ctx, chat, role.ID)
+	if err != nil {
+		return Reply{}, err
+	}
+	history, err := loadActivePath(ctx, chat.ID)
+	if err != nil {
+		return Reply{}, err
+	}
+	return generateReply(ctx, userID, chat, model, history, snapshot, instructions, sink)
+}
+
+// Returns the snapshot of the role with the system prompt rendered for the chat. A role that was deleted can't answer anymore
+func resolveSnapshot(ctx context.Context, chat database.Chat, roleID uuid.UUID) (database.RoleSnapshot, error) {
+	variables, err := roles.ChatVariables(ctx, chat)
+	if err != nil {
+		return database.RoleSnapshot{}, err
+	}
+	snapshot, err := roles.ResolveSnapshot(ctx, roleID, variables)
+	if errors.Is(err, roles.ErrRoleNotFound) {
+		return snapshot, ErrChatHasNoRole
+	}
+	return snapshot, err
+}
+
+// Lets the AI answer the last user message of a chat (for example again after the generation failed).
+// Every piece of the answer is passed to the sink as soon as it arrives.
+// Tools of the role that the AI calls are executed and saved as their own messages.
+// The complete answer is saved as an assistant message with the same role snapshot as the user message.
+// If ctx is canceled while the answer is generated, the part that was already received is saved as a truncated message.
+// The user message isn't moderated or checked for prompt injections again: that happened when it was saved, and a blocked message is never saved
+func GenerateReply(ctx context.Context, userID, chatID uuid.UUID, model string, sink Sink) (Reply, error) {
+	if model == "" {
+		model = ai.DefaultModel()
+	}
+	if !ai.IsAvailableModel(model) {
+		return Reply{}, ErrModelUnavailable
+	}
+
+	chat, err := getChat(ctx, userID, chatID)
+	if err != nil {
+		return Reply{}, err
+	}
+
+	// Users that used up their limits don't get any more answers
+	if err := quotas.Check(ctx, userID); err != nil {
+		return Reply{}, err
+	}
+
+	history, err := loadActivePath(ctx, chat.ID)
+	if err != nil {
+		return Reply{}, err
+	}
+	if len(history) == 0 || history[len(history)-1].SenderRole != "user" {
+		return Reply{}, ErrNothingToAnswer
+	}
+
+	// The role of the last user message decides how the AI behaves
+	snapshot, err := loadSnapshot(ctx, history[len(history)-1].RoleSnapshotID)
+	if err != nil {
+		return Reply{}, err
+	}
+	return generateReply(ctx, userID, chat, model, history, snapshot, "", sink)
+}
+
+// Lets the AI answer the user message before the given answer again. The new answer is saved as an alternative of the old one
+// and becomes the active one, the old answer stays so the user can switch back to it.
+// Works like GenerateReply otherwise
+func Regenerate(ctx context.Context, userID, messageID uuid.UUID, model string, sink Sink) (Reply, error) {
+	if model == "" {
+		model = ai.DefaultModel()
+	}
+	if !ai.IsAvailableModel(model) {
+		return Reply{}, ErrModelUnavailable
+	}
+
+	message, chat, err := getMessage(ctx, userID, messageID)
+	if err != nil {
+		return Reply{}, err
+	}
+	if message.SenderRole == "user" {
+		return Reply{}, ErrNotAnAnswer
+	}
+
+	if err := quotas.Check(ctx, userID); err != nil {
+		return Reply{}, err
+	}
+
+	// The answer can consist of several messages (tool calls), so the message before it is searched.
+	// In group chats that can be the answer of another role, which then stays
+	tree, err := loadTree(ctx, chat.ID, true)
+	if err != nil {
+		return Reply{}, err
+	}
+	history := tree.pathTo(message.ID)
+	for len(history) > 0 && history[len(history)-1].SenderRole != "user" && history[len(history)-1].RoleSnapshotID == message.RoleSnapshotID {
+		history = history[:len(history)-1]
+	}
+	if len(history) == 0 {
+		return Reply{}, ErrNothingToAnswer
+	}
+
+	// The same role answers again
+	snapshot, err := loadSnapshot(ctx, message.RoleSnapshotID)
+	if err != nil {
+		return Reply{}, err
+	}
+
+	// The answer could be on a path the user doesn't see right now. The writer switches to it once the new answer is saved,
+	// so a failed generation leaves the chat as it was
+	return generateReply(ctx, userID, chat, model, history, snapshot, "", sink)
+}
+
+// Returns a role snapshot by its id
+func loadSnapshot(ctx context.Context, snapshotID uuid.UUID) (database.RoleSnapshot, error) {
+	var snapshot database.RoleSnapshot
+	err := database.DB.WithContext(ctx).First(&snapshot, "id = ?", snapshotID).Error
+	return snapshot, err
+}
+
+// Generates and saves the answer of the role of the snapshot to the history. The instructions are added to the system prompt (can be empty).
+// The messages of the answer are saved after the last message of the history, an earlier answer to the same message becomes an inactive alternative
+func generateReply(ctx context.Context, userID uuid.UUID, chat database.Chat, model string, history []database.Message, snapshot database.RoleSnapshot, instructions string, sink Sink) (Reply, error) {
+	if len(history) == 0 {
+		return Reply{}, ErrNothingToAnswer
+	}
+	lastMessage := history[len(history)-1]
+
+	if sink.Answering != nil {
+		if err := sink.Answering(snapshot); err != nil {
+			return Reply{}, err
+		}
+	}
+
+	// Messages that are covered by the summary are replaced by it
+	summary, uncovered, err := loadSummary(ctx, chat, history)
+	if err != nil {
+		return Reply{}, err
+	}
+	summaryContent := ""
+	if summary != nil {
+		summaryContent = summary.Content
+	}
+
+	// The system prompt is delimited so messages of the user can't pass themselves off as part of it
+	systemPrompt := moderation.HardenSystemPrompt(snapshot.SystemPrompt)
+	chatRoles, err := loadChatRoles(ctx, chat)
+	if err != nil {
+		return Reply{}, err
+	}
+	if len(chatRoles) > 1 {
+		var others []string
+		for _, role := range chatRoles {
+			if role.ID != snapshot.RoleID {
+				others = append(others, role.Name)
+			}
+		}
+		snapshots, err := loadSnapshotInfos(ctx, uncovered)
+		if err != nil {
+			return Reply{}, err
+		}
+		systemPrompt += "\n\n" + groupInstructions(snapshot.Name, others)
+		uncovered = labelPersonas(uncovered, snapshots, snapshot.RoleID)
+	}
+	if instructions != "" {
+		systemPrompt += "\n\n" + instructions
+	}
+
+	// Leaves out old messages if the whole chat doesn't fit into the context window
+	provider := ai.Current()
+	prompt, err := BuildContext(provider, model, systemPrompt, summaryContent, uncovered)
+	if err != nil {
+		return Reply{}, err
+	}
+	if len(prompt.Excluded) > 0 && config.DebugMode {
+		slog.LogAttrs(ctx, slog.LevelDebug, "Old messages were left out of the AI context",
+			slog.String("chat_id", chat.ID.String()),
+			slog.Int("excluded", len(prompt.Excluded)),
+			slog.Int("shortened", len(prompt.Shortened)),
+			slog.Int("prompt_tokens", prompt.PromptTokens),
+		)
+	}
+
+	writer := &answerWriter{chatID: chat.ID, snapshotID: snapshot.ID, parentID: lastMessage.ID, history: history}
+	// The streamed text is moderated before it reaches the user, so a blocked answer is never shown
+	subject := moderation.Subject{UserID: userID, ChatID: chat.ID}
+	guard := moderation.NewStreamGuard(ctx, moderation.StageOutput, subject)
+	role, err := loadRole(ctx, snapshot.RoleID)
+	if err != nil {
+		return Reply{}, err
+	}
+	fallbacks := role.FallbackModels
+	if len(fallbacks) == 0 {
+		fallbacks = config.FallbackModels
+	}
+	req := ai.Request{Model: model, Messages: prompt.Messages}
+	if info, ok := ai.GetModel(model); ok && info.HasCapability(config.CapabilityTools) {
+		req.Tools = ai.ToolDefinitions(role.Tools)
+	}
+
+	// Roles with an output schema answer with validated JSON instead of streamed text
+	var result ai.Response
+	var data json.RawMessage
+	kind := database.MessageKindText
+	if role.OutputSchema != "" {
+		schema, schemaErr := ai.ParseSchema(role.OutputSchema)
+		if schemaErr != nil {
+			return Reply{}, schemaErr
+		}
+		kind = database.MessageKindStructured
+		result, data, err = ai.CompleteStructured(ctx, provider, req, ai.ResponseFormat{Name: "role_output", Schema: schema}, fallbacks)
+		result.Content = string(data)
+	} else {
+		result, err = ai.RunToolLoop(ctx, provider, req, fallbacks, toolLoopHooks(ctx, subject, writer, guard, sink))
+	}
+	truncated := false
+	if err != nil {
+		if !keepsPartialAnswer(ctx, result) {
+			// Failed tries (for example answers that didn't match the output schema) still cost tokens
+			quotas.RecordUsage(quotas.Usage{UserID: userID, ChatID: &chat.ID, Purpose: database.UsagePurposeAnswer, Model: result.Model, Tokens: result.Usage})
+			return Reply{Model: result.Model, RequestedModel: model, Usage: result.Usage}, err
+		}
+		truncated = true
+	}
+
+	// A canceled stream never receives the usage chunk, so the tokens are estimated to still count the costs
+	if result.Usage.TotalTokens == 0 {
+		result.Usage.PromptTokens = int64(prompt.PromptTokens)
+		result.Usage.CompletionTokens = int64(ai.EstimateTextTokens(result.Content))
+		result.Usage.TotalTokens = result.Usage.PromptTokens + result.Usage.CompletionTokens
+	}
+
+	reply := database.Message{
+		ID:         uuid.New(),
+		SenderRole: "assistant",
+		Kind:       kind,
+		Content:    result.Content,
+		Truncated:  truncated,
+
+		Model:            result.Model,
+		PromptTokens:     result.Usage.PromptTokens,
+		CompletionTokens: result.Usage.CompletionTokens,
+		Cost:             ai.Cost(result.Model, result.Usage),
+	}
+
+	// The complete answer of the AI is checked before it is saved. A blocked answer is never saved but its tokens still count.
+	subject.MessageID = &reply.ID
+	subject.Text = reply.Content
+	verdict, err := moderation.Check(outputCheckContext(ctx, truncated), moderation.StageOutput, subject)
+	if err != nil {
+		quotas.RecordUsage(quotas.Usage{UserID: userID, ChatID: &chat.ID, Purpose: database.UsagePurposeAnswer, Model: result.Model, Tokens: result.Usage})
+		return Reply{Model: result.Model, RequestedModel: model, Usage: result.Usage}, err
+	}
+	reply.Flagged = verdict.Flagged()
+
+	if err := writer.save(&reply); err != nil {
+		return Reply{}, err
+	}
+	quotas.RecordUsage(quotas.Usage{UserID: userID, ChatID: &chat.ID, MessageID: &reply.ID, Purpose: database.UsagePurposeAnswer, Model: result.Model, Tokens: result.Usage})
+
+	// Long chats get a summary of their older messages so they aren't lost when the history is cut
+	SummarizeInBackground(chat.ID)
+	// New chats get a title after the first answer (in group chats after the answer of the first role)
+	if lastMessage.SenderRole == "user" {
+		GenerateTitleInBackground(chat, lastMessage.Content, reply.Content)
+	}
+
+	answer := Reply{Message: reply, Data: data, Model: result.Model, RequestedModel: model, Usage: result.Usage, ExcludedMessageIDs: prompt.Excluded}
+	// The end of the answer that the guard held back
+	if rest := guard.Flush(); rest != "" && sink.Delta != nil {
+		if err := sink.Delta(rest); err != nil {
+			return answer, err
+		}
+	}
+	if sink.Answered != nil {
+		if err := sink.Answered(answer); err != nil {
+			return answer, err
+		}
+	}
+	return answer, nil
+}
+
+// Tells if the text of a failed generation is saved as a truncated answer. Only a canceled generation keeps the text
+// that was generated until then, every other error discards it
+func keepsPartialAnswer(ctx context.Context, result ai.Response) bool {
+	return ctx.Err() != nil && result.Content != ""
+}
+
+// Returns the context the finished answer is moderated with. The request of a truncated answer was canceled,
+// but the answer is still saved, so the classifier has to check it and the moderation events have to be saved anyway
+func outputCheckContext(ctx context.Context, truncated bool) context.Context {
+	if truncated {
+		return context.WithoutCancel(ctx)
+	}
+	return ctx
+}
+
+// Token usage and costs of a whole chat
+type ChatCost struct {
+	ChatID           uuid.UUID `json:"chat_id"`
+	Messages         int64     `json:"messages"` // Assistant messages that were generated
+	PromptTokens     int64     `json:"prompt_tokens"`
+	CompletionTokens int64     `json:"completion_tokens"`
+	Cost             float64   `json:"cost"` // US dollars
+}
+
+// Sums up the token usage and costs of all AI answers of a chat
+func GetChatCost(ctx context.Context, userID, chatID uuid.UUID) (ChatCost, error) {
+	chat, err := getChat(ctx, userID, chatID)
+	if err != nil {
+		return ChatCost{}, err
+	}
+
+	cost := ChatCost{ChatID: chat.ID}
+	err = database.DB.WithContext(ctx).Model(&database.Message{}).
+		Select("COUNT(*) AS messages, COALESCE(SUM(prompt_tokens), 0) AS prompt_tokens, "+
+			"COALESCE(SUM(completion_tokens), 0) AS completion_tokens, COALESCE(SUM(cost), 0) AS cost").
+		Where("chat_id = ? AND sender_role = ? AND kind IN ?", chat.ID, "assistant", []string{database.MessageKindText, database.MessageKindStructured}).
+		Scan(&cost).Error
+	return cost, err
+}
+
+// Returns the chat if it belongs to the user. Only the owner of a chat is allowed to use it
+func getChat(ctx context.Context, userID, chatID uuid.UUID) (database.Chat, error) {
+	var chat database.Chat
+	if err := database.DB.WithContext(ctx).Where("id = ? AND user_id = ?", chatID, userID).First(&chat).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return chat, ErrChatNotFound
+		}
+		return chat, err
+	}
+	return chat, nil
+}
+
+// Returns the role with its AI settings. A role that doesn't exist anymore has no settings and no id
+func loadRole(ctx context.Context, roleID uuid.UUID) (database.Role, error) {
+	var role database.Role
+	err := database.DB.WithContext(ctx).Where("id = ?", roleID).Limit(1).Find(&role).Error
+	return role, err
+}
+
+// Saves the tool calls and results of the AI as their own messages and passes everything on to the sink.
+// The streamed text only reaches the sink after the guard let it through. Tool results are checked for prompt injections
+func toolLoopHooks(ctx context.Context, subject moderation.Subject, writer *answerWriter, guard *moderation.StreamGuard, sink Sink) ai.ToolLoopHooks {
+	sendDelta := func(delta string) error {
+		if delta != "" && sink.Delta != nil {
+			return sink.Delta(delta)
+		}
+		return nil
+	}
+	return ai.ToolLoopHooks{
+		OnDelta: func(delta string) error {
+			release, err := guard.Write(delta)
+			if err != nil {
+				return err
+			}
+			return sendDelta(release)
+		},
+		OnToolCall: func(content string, call ai.ToolCall) error {
+			// Text the AI wrote before it called the tool is moderated like an answer and kept as its own message
+			if content != "" {
+				text := database.Message{ID: uuid.New(), SenderRole: "assistant", Kind: database.MessageKindText, Content: content}
+				subject.MessageID = &text.ID
+				subject.Text = content
+				verdict, err := moderation.Check(ctx, moderation.StageOutput, subject)
+				if err != nil {
+					return err
+				}
+				text.Flagged = verdict.Flagged()
+				if err := writer.save(&text); err != nil {
+					return err
+				}
+			}
+			if err := sendDelta(guard.Flush()); err != nil {
+				return err
+			}
+			message := toolMessage("assistant", database.MessageKindToolCall, call.Arguments, call)
+			if err := writer.save(&message); err != nil || sink.ToolCall == nil {
+				return err
+			}
+			return sink.ToolCall(message)
+		},
+		OnToolResult: func(call ai.ToolCall, result string, failed bool) error {
+			// Retrieved content can contain instructions that are meant for the AI
+			moderation.GuardTurn(ctx, moderation.SourceToolResult, subject.UserID, writer.chatID, result)
+
+			message := toolMessage("tool", database.MessageKindToolResult, result, call)
+			if err := writer.save(&message); err != nil || sink.ToolResult == nil {
+				return err
+			}
+			return sink.ToolResult(message)
+		},
+	}
+}
+
+// Creates a message that belongs to a tool call
+func toolMessage(senderRole, kind, content string, call ai.ToolCall) database.Message {
+	return database.Message{
+		SenderRole: senderRole,
+		Kind:       kind,
+		Content:    content,
+		ToolCallID: call.ID,
+		ToolName:   call.Name,
+	}
+}
+
+// Saves the messages of one answer as a chain after the message that is answered
+type answerWriter struct {
+	chatID     uuid.UUID
+	snapshotID uuid.UUID
+	parentID   uuid.UUID          // The message the next message follows
+	history    []database.Message // The messages the answer follows
+	saved      bool               // true as soon as the first message of the answer was saved
+}
+
+// Saves the message after the previous message of the answer. The context isn't used, so a canceled answer is still saved.
+// The first message of the answer becomes the active alternative together with the history, earlier answers to the same message are kept but hidden
+func (w *answerWriter) save(message *database.Message) error {
+	if message.ID == uuid.Nil {
+		message.ID = uuid.New()
+	}
+	parentID := w.parentID
+	message.ChatID = w.chatID
+	message.ParentID = &parentID
+	message.IsActive = true
+	message.RoleSnapshotID = w.snapshotID
+	message.CreatedAt = time.Now()
+
+	if err := database.DB.Create(message).Error; err != nil {
+		return err
+	}
+	w.parentID = message.ID
+
+	if !w.saved {
+		w.saved = true
+		if err := activatePath(context.Background(), w.history); err != nil {
+			return err
+		}
+		return activateAlternative(database.DB, *message)
+	}
+	return nil
+}
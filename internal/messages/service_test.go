@@ -0,0 +1,86 @@
+package messages
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/roly-backend/internal/ai"
+	"github.com/roly-backend/internal/config"
+	"github.com/roly-backend/internal/database"
+)
+
+func TestCheckUserMessage(t *testing.T) {
+	content, model, err := checkUserMessage("  Hello  ", "")
+	if err != nil || content != "Hello" || model != ai.DefaultModel() {
+		t.Errorf("expected the trimmed message for the default model, got %q %q %v", content, model, err)
+	}
+
+	tests := []struct {
+		content string
+		model   string
+		err     error
+	}{
+		{" \n\t", "", ErrEmptyMessage},
+		{strings.Repeat("a", config.MaxMessageLength+1), "", ErrMessageTooLong},
+		{"Hello", "does-not-exist", ErrModelUnavailable},
+	}
+	for _, test := range tests {
+		if _, _, err := checkUserMessage(test.content, test.model); !errors.Is(err, test.err) {
+			t.Errorf("expected %v for %.20q, got %v", test.err, test.content, err)
+		}
+	}
+}
+
+// Invalid messages are rejected before anything is loaded or saved (the database isn't set up in the tests)
+func TestSendMessageRejectsInvalidMessages(t *testing.T) {
+	var saved bool
+	sink := Sink{UserMessage: func(message database.Message) error {
+		saved = true
+		return nil
+	}}
+	reply, err := SendMessage(context.Background(), uuid.New(), uuid.New(), "", "", sink)
+	if !errors.Is(err, ErrEmptyMessage) || saved || reply.UserMessage.ID != uuid.Nil {
+		t.Errorf("expected ErrEmptyMessage without a saved message, got %v", err)
+	}
+	if _, err := EditMessage(context.Background(), uuid.New(), uuid.New(), "Hello", "does-not-exist", sink); !errors.Is(err, ErrModelUnavailable) {
+		t.Errorf("expected ErrModelUnavailable, got %v", err)
+	}
+}
+
+func TestCanceledAnswerIsKeptTruncated(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// The client cancels after the first piece of the answer
+	result, err := ai.RunToolLoop(ctx, ai.NewFakeProvider("Ahoy there matey"), ai.Request{Model: "gpt-4.1-nano"}, nil, ai.ToolLoopHooks{
+		OnDelta: func(delta string) error {
+			cancel()
+			return nil
+		},
+	})
+	if !errors.Is(err, context.Canceled) || result.Content != "Ahoy " {
+		t.Fatalf("expected the partial answer with the cancel error, got %q %v", result.Content, err)
+	}
+	if !keepsPartialAnswer(ctx, result) {
+		t.Error("expected the partial answer to be kept")
+	}
+	// The kept answer is moderated although the request is canceled
+	if err := outputCheckContext(ctx, true).Err(); err != nil {
+		t.Errorf("expected the truncated answer to be checked with a live context, got %v", err)
+	}
+	if outputCheckContext(ctx, false).Err() == nil {
+		t.Error("expected complete answers to be checked with the context of the request")
+	}
+
+	// Without any text there is nothing to keep
+	if keepsPartialAnswer(ctx, ai.Response{}) {
+		t.Error("expected an empty answer not to be kept")
+	}
+	// Other errors discard the text, the generation wasn't canceled by the user
+	if keepsPartialAnswer(context.Background(), result) {
+		t.Error("expected the answer of a failed generation not to be kept")
+	}
+}
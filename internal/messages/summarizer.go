@@ -0,0 +1,169 @@
+package messages
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/roly-backend/internal/ai"
+	"github.com/roly-backend/internal/config"
+	"github.com/roly-backend/internal/database"
+	"github.com/roly-backend/internal/quotas"
+	"gorm.io/gorm"
+)
+
+// Instructions for the model that writes the summaries
+const summaryInstructions = "You condense conversations between a user and an AI assistant. " +
+	"Write a compact summary of the conversation that keeps every fact, decision, name, number and open question " +
+	"that could be important later. If a previous summary is given, merge it with the new messages into one summary. " +
+	"Answer only with the summary in the language of the conversation."
+
+// Chats that are summarized right now so the same chat isn't summarized twice at the same time
+var summarizing sync.Map
+
+// Summarizes the older messages of the chat in the background if enough new messages came in since the last summary
+func SummarizeInBackground(chatID uuid.UUID) {
+	if _, running := summarizing.LoadOrStore(chatID, true); running {
+		return
+	}
+
+	go func() {
+		defer summarizing.Delete(chatID)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+		defer cancel()
+
+		if err := summarizeChat(ctx, chatID); err != nil {
+			slog.LogAttrs(context.Background(), slog.LevelError, "Error summarizing chat",
+				slog.String("chat_id", chatID.String()),
+				slog.String("error", err.Error()),
+			)
+		}
+	}()
+}
+
+// Returns the current summary of the chat and the messages that are not covered by it
+func loadSummary(ctx context.Context, chat database.Chat, history []database.Message) (*database.ChatSummary, []database.Message, error) {
+	if chat.SummaryID == nil {
+		return nil, history, nil
+	}
+
+	var summary database.ChatSummary
+	if err := database.DB.WithContext(ctx).First(&summary, "id = ?", *chat.SummaryID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, history, nil
+		}
+		return nil, nil, err
+	}
+
+	uncovered, ok := uncoveredMessages(summary, history)
+	if !ok {
+		return nil, history, nil
+	}
+	return &summary, uncovered, nil
+}
+
+// Returns the messages of the history after the last message the summary covers.
+// Returns false if that message isn't part of the history anymore, then the summary can't be matched with the history
+func uncoveredMessages(summary database.ChatSummary, history []database.Message) ([]database.Message, bool) {
+	for i, message := range history {
+		if message.ID == summary.ToMessageID {
+			return history[i+1:], true
+		}
+	}
+	return nil, false
+}
+
+// Returns the messages that are summarized next: all uncovered messages except the newest ones, which stay in the prompt as they are.
+// Returns nil as long as not enough new messages came in
+func messagesToSummarize(uncovered []database.Message) []database.Message {
+	if len(uncovered) < config.SummarizeAfterMessages+config.SummaryKeepRecentMessages {
+		return nil
+	}
+	return uncovered[:len(uncovered)-config.SummaryKeepRecentMessages]
+}
+
+// Condenses the older messages of the chat together with the previous summary into a new summary
+func summarizeChat(ctx context.Context, chatID uuid.UUID) error {
+	var chat database.Chat
+	if err := database.DB.WithContext(ctx).First(&chat, "id = ?", chatID).Error; err != nil {
+		return err
+	}
+
+	// Only the path the user sees is summarized, other alternatives get their own summary when they become active
+	history, err := loadActivePath(ctx, chat.ID)
+	if err != nil {
+		return err
+	}
+
+	previous, uncovered, err := loadSummary(ctx, chat, history)
+	if err != nil {
+		return err
+	}
+	toSummarize := messagesToSummarize(uncovered)
+	if len(toSummarize) == 0 {
+		return nil
+	}
+
+	var transcript strings.Builder
+	if previous != nil {
+		fmt.Fprintf(&transcript, "Previous summary:\n%s\n\nNew messages:\n", previous.Content)
+	}
+	for _, message := range toSummarize {
+		fmt.Fprintf(&transcript, "%s: %s\n", message.SenderRole, message.Content)
+	}
+
+	model := config.SummaryModel
+	if !ai.IsAvailableModel(model) {
+		model = ai.DefaultModel()
+	}
+	response, err := ai.CompleteWithFallback(ctx, ai.Current(), ai.Request{
+		Model: model,
+		Messages: []ai.ChatMessage{
+			{Role: "system", Content: summaryInstructions},
+			{Role: "user", Content: transcript.String()},
+		},
+	}, config.FallbackModels)
+	if err != nil {
+		return err
+	}
+	quotas.RecordUsage(quotas.Usage{UserID: chat.UserID, ChatID: &chat.ID, Purpose: database.UsagePurposeSummary, Model: response.Model, Tokens: response.Usage})
+
+	summary := database.ChatSummary{
+		ID:            uuid.New(),
+		ChatID:        chat.ID,
+		Content:       strings.TrimSpace(response.Content),
+		FromMessageID: toSummarize[0].ID,
+		ToMessageID:   toSummarize[len(toSummarize)-1].ID,
+		MessageCount:  len(toSummarize),
+		CreatedAt:     time.Now(),
+	}
+	if previous != nil {
+		summary.PreviousSummaryID = &previous.ID
+		summary.FromMessageID = previous.FromMessageID
+		summary.MessageCount += previous.MessageCount
+	}
+
+	// Saves the summary and attaches it to the chat
+	err = database.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&summary).Error; err != nil {
+			return err
+		}
+		return tx.Model(&database.Chat{}).Where("id = ?", chat.ID).Update("summary_id", summary.ID).Error
+	})
+	if err != nil {
+		return err
+	}
+
+	slog.LogAttrs(ctx, slog.LevelInfo, "Chat was summarized",
+		slog.String("chat_id", chat.ID.String()),
+		slog.String("summary_id", summary.ID.String()),
+		slog.Int("messages", summary.MessageCount),
+	)
+	return nil
+}
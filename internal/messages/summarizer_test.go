@@ -0,0 +1,53 @@
+package messages
+
+import (
+	"context"
+	"testing"
+
+	"github.com/roly-backend/internal/config"
+	"github.com/roly-backend/internal/database"
+)
+
+func TestMessagesToSummarize(t *testing.T) {
+	previousAfter, previousKeep := config.SummarizeAfterMessages, config.SummaryKeepRecentMessages
+	config.SummarizeAfterMessages, config.SummaryKeepRecentMessages = 4, 2
+	t.Cleanup(func() { config.SummarizeAfterMessages, config.SummaryKeepRecentMessages = previousAfter, previousKeep })
+
+	if toSummarize := messagesToSummarize(testHistory(5, 1)); toSummarize != nil {
+		t.Errorf("expected no summary before the threshold, got %d messages", len(toSummarize))
+	}
+
+	history := testHistory(6, 1)
+	toSummarize := messagesToSummarize(history)
+	if len(toSummarize) != 4 || toSummarize[0].ID != history[0].ID || toSummarize[3].ID != history[3].ID {
+		t.Errorf("expected the oldest four messages, got %d", len(toSummarize))
+	}
+
+	// Messages that came in later are summarized as well, only the newest ones are kept
+	if toSummarize := messagesToSummarize(testHistory(9, 1)); len(toSummarize) != 7 {
+		t.Errorf("expected all but the two newest messages, got %d", len(toSummarize))
+	}
+}
+
+func TestUncoveredMessages(t *testing.T) {
+	history := testHistory(5, 1)
+
+	uncovered, ok := uncoveredMessages(database.ChatSummary{ToMessageID: history[2].ID}, history)
+	if !ok || len(uncovered) != 2 || uncovered[0].ID != history[3].ID {
+		t.Errorf("expected the messages after the summary, got %d (%t)", len(uncovered), ok)
+	}
+	if uncovered, ok := uncoveredMessages(database.ChatSummary{ToMessageID: history[4].ID}, history); !ok || len(uncovered) != 0 {
+		t.Errorf("expected no uncovered message, got %d (%t)", len(uncovered), ok)
+	}
+
+	// The summary belongs to another branch of the chat (or its last message was deleted)
+	if _, ok := uncoveredMessages(database.ChatSummary{ToMessageID: testHistory(1, 1)[0].ID}, history); ok {
+		t.Error("expected the summary not to match the history")
+	}
+
+	// Chats without a summary don't load anything (the database isn't set up in the tests)
+	summary, uncovered, err := loadSummary(context.Background(), database.Chat{}, history)
+	if err != nil || summary != nil || len(uncovered) != len(history) {
+		t.Errorf("expected the whole history without a summary, got %v %d %v", summary, len(uncovered), err)
+	}
+}
@@ -0,0 +1,89 @@
+package messages
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/roly-backend/internal/ai"
+	"github.com/roly-backend/internal/chats"
+	"github.com/roly-backend/internal/config"
+	"github.com/roly-backend/internal/database"
+	"github.com/roly-backend/internal/quotas"
+)
+
+// Instructions for the model that writes the titles
+const titleInstructions = "You write titles for conversations between a user and an AI assistant. " +
+	"Answer only with a short title of at most six words that describes the topic, in the language of the conversation, " +
+	"without quotes and without a period at the end."
+
+// Chats that get a title right now so the same chat doesn't get two titles at the same time
+var titling sync.Map
+
+// Lets a cheap model write a title for the chat in the background if the chat has no title yet.
+// The question and the answer are the first exchange the title is based on
+func GenerateTitleInBackground(chat database.Chat, question, answer string) {
+	if chat.Title != "" || chat.TitleManual {
+		return
+	}
+	if _, running := titling.LoadOrStore(chat.ID, true); running {
+		return
+	}
+
+	go func() {
+		defer titling.Delete(chat.ID)
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+
+		if err := generateTitle(ctx, chat, question, answer); err != nil {
+			slog.LogAttrs(context.Background(), slog.LevelError, "Error generating chat title",
+				slog.String("chat_id", chat.ID.String()),
+				slog.String("error", err.Error()),
+			)
+		}
+	}()
+}
+
+// Asks the title model for a title and saves it
+func generateTitle(ctx context.Context, chat database.Chat, question, answer string) error {
+	model := config.TitleModel
+	if !ai.IsAvailableModel(model) {
+		model = ai.DefaultModel()
+	}
+	response, err := ai.CompleteWithFallback(ctx, ai.Current(), ai.Request{
+		Model: model,
+		Messages: []ai.ChatMessage{
+			{Role: "system", Content: titleInstructions},
+			{Role: "user", Content: fmt.Sprintf("User: %s\n\nAssistant: %s", excerpt(question), excerpt(answer))},
+		},
+		MaxTokens: 30,
+	}, config.FallbackModels)
+	if err != nil {
+		return err
+	}
+	quotas.RecordUsage(quotas.Usage{UserID: chat.UserID, ChatID: &chat.ID, Purpose: database.UsagePurposeTitle, Model: response.Model, Tokens: response.Usage})
+
+	title := strings.Trim(strings.TrimSpace(response.Content), "\"'.")
+	saved, err := chats.SetGeneratedTitle(ctx, chat.ID, title)
+	if saved && config.DebugMode {
+		slog.LogAttrs(ctx, slog.LevelDebug, "Chat got a generated title",
+			slog.String("chat_id", chat.ID.String()),
+			slog.String("title", title),
+		)
+	}
+	return err
+}
+
+// Returns the beginning of a long message, the title only needs the topic
+func excerpt(content string) string {
+	const maxRunes = 1000
+	runes := []rune(content)
+	if len(runes) <= maxRunes {
+		return content
+	}
+	return string(runes[:maxRunes])
+}
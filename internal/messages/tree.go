@@ -0,0 +1,259 @@
+package messages
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/roly-backend/internal/database"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrMessageNotFound = errors.New("message not found")
+	ErrNotAnAnswer     = errors.New("message is not an answer of the AI")
+	ErrNotAUserMessage = errors.New("message is not a message of the user")
+)
+
+// The messages of a chat as a tree. Every message points to the message it follows,
+// messages with the same parent are alternatives of each other (for example regenerated answers)
+type messageTree struct {
+	byID     map[uuid.UUID]database.Message
+	children map[uuid.UUID][]database.Message // uuid.Nil holds the first messages of the chat
+}
+
+// Builds the tree. The messages have to be ordered by creation
+func newMessageTree(messages []database.Message) messageTree {
+	tree := messageTree{byID: map[uuid.UUID]database.Message{}, children: map[uuid.UUID][]database.Message{}}
+	for _, message := range messages {
+		tree.byID[message.ID] = message
+		parentID := uuid.Nil
+		if message.ParentID != nil {
+			parentID = *message.ParentID
+		}
+		tree.children[parentID] = append(tree.children[parentID], message)
+	}
+	return tree
+}
+
+// Returns the messages the user sees: starting at the first message, the active alternative is followed until the newest message
+func (t messageTree) activePath() []database.Message {
+	var path []database.Message
+	parentID := uuid.Nil
+	for len(path) < len(t.byID) {
+		children := t.children[parentID]
+		if len(children) == 0 {
+			break
+		}
+		// If no alternative is marked as active the newest one is shown
+		chosen := children[len(children)-1]
+		for _, child := range children {
+			if child.IsActive {
+				chosen = child
+			}
+		}
+		path = append(path, chosen)
+		parentID = chosen.ID
+	}
+	return path
+}
+
+// Returns the message and all messages before it, starting with the first message of the chat
+func (t messageTree) pathTo(messageID uuid.UUID) []database.Message {
+	var path []database.Message
+	message, ok := t.byID[messageID]
+	for ok && len(path) < len(t.byID) {
+		path = append(path, message)
+		if message.ParentID == nil {
+			break
+		}
+		message, ok = t.byID[*message.ParentID]
+	}
+	for i, j := 0, len(path)-1; i < j; i, j = i+1, j-1 {
+		path[i], path[j] = path[j], path[i]
+	}
+	return path
+}
+
+// Returns the messages before the message, which a new version of the message follows
+func (t messageTree) historyBefore(messageID uuid.UUID) []database.Message {
+	path := t.pathTo(messageID)
+	if len(path) == 0 {
+		return nil
+	}
+	return path[:len(path)-1]
+}
+
+// Returns the ids of the alternatives of the message (including the message itself) in the order they were written
+func (t messageTree) alternatives(message database.Message) []uuid.UUID {
+	parentID := uuid.Nil
+	if message.ParentID != nil {
+		parentID = *message.ParentID
+	}
+	siblings := t.children[parentID]
+	ids := make([]uuid.UUID, 0, len(siblings))
+	for _, sibling := range siblings {
+		ids = append(ids, sibling.ID)
+	}
+	return ids
+}
+
+// Loads all messages of the chat as a tree. Only the fields are loaded that are needed to walk the tree, unless full is true
+func loadTree(ctx context.Context, chatID uuid.UUID, full bool) (messageTree, error) {
+	query := database.DB.WithContext(ctx).Where("chat_id = ?", chatID).Order("created_at ASC, id ASC")
+	if !full {
+		query = query.Select("id", "chat_id", "parent_id", "is_active", "sender_role", "created_at")
+	}
+	var messages []database.Message
+	if err := query.Find(&messages).Error; err != nil {
+		return messageTree{}, err
+	}
+	return newMessageTree(messages), nil
+}
+
+// Returns the messages of the chat the user currently sees, ordered from the first to the newest message
+func loadActivePath(ctx context.Context, chatID uuid.UUID) ([]database.Message, error) {
+	tree, err := loadTree(ctx, chatID, true)
+	if err != nil {
+		return nil, err
+	}
+	return tree.activePath(), nil
+}
+
+// Makes the message and all messages before it the active alternatives, so the message is shown in the chat again.
+// Messages that are already active are skipped, since only one alternative is ever marked as active
+func activatePath(ctx context.Context, path []database.Message) error {
+	return database.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		for _, message := range inactiveMessages(path) {
+			if err := activateAlternative(tx, message); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Returns the messages of the path that aren't the active one of their alternatives yet
+func inactiveMessages(path []database.Message) []database.Message {
+	var inactive []database.Message
+	for _, message := range path {
+		if !message.IsActive {
+			inactive = append(inactive, message)
+		}
+	}
+	return inactive
+}
+
+// Marks the message as the active one of its alternatives
+func activateAlternative(tx *gorm.DB, message database.Message) error {
+	query := tx.Model(&database.Message{}).Where("chat_id = ?", message.ChatID)
+	if message.ParentID == nil {
+		query = query.Where("parent_id IS NULL")
+	} else {
+		query = query.Where("parent_id = ?", *message.ParentID)
+	}
+	return query.Update("is_active", gorm.Expr("id = ?", message.ID)).Error
+}
+
+// Returns a message of a chat of the user
+func getMessage(ctx context.Context, userID, messageID uuid.UUID) (database.Message, database.Chat, error) {
+	var message database.Message
+	if err := database.DB.WithContext(ctx).First(&message, "id = ?", messageID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return message, database.Chat{}, ErrMessageNotFound
+		}
+		return message, database.Chat{}, err
+	}
+	chat, err := getChat(ctx, userID, message.ChatID)
+	if errors.Is(err, ErrChatNotFound) {
+		return message, chat, ErrMessageNotFound
+	}
+	return message, chat, err
+}
+
+// Makes one of the alternatives of a message the active one, together with all messages before it.
+// Activating the newest message of a branch switches to that branch
+func ActivateMessage(ctx context.Context, userID, messageID uuid.UUID) error {
+	message, chat, err := getMessage(ctx, userID, messageID)
+	if err != nil {
+		return err
+	}
+	tree, err := loadTree(ctx, chat.ID, false)
+	if err != nil {
+		return err
+	}
+	return activatePath(ctx, tree.pathTo(message.ID))
+}
+
+// A branch of a chat: the path from the first message to a message without any following messages
+type BranchInfo struct {
+	LeafID    uuid.UUID  `json:"leaf_id"` // Newest message of the branch. Activating it switches to the branch
+	ForkID    *uuid.UUID `json:"fork_id"` // First message of the branch that isn't part of the active branch (null for the active branch)
+	Length    int        `json:"length"`  // Number of messages of the branch
+	Preview   string     `json:"preview"` // Beginning of the fork message (or of the newest message for the active branch)
+	Active    bool       `json:"active"`
+	UpdatedAt time.Time  `json:"updated_at"` // When the newest message of the branch was written
+}
+
+// Returns all branches of the chat, the branch with the newest message first
+func ListBranches(ctx context.Context, userID, chatID uuid.UUID) ([]BranchInfo, error) {
+	chat, err := getChat(ctx, userID, chatID)
+	if err != nil {
+		return nil, err
+	}
+	tree, err := loadTree(ctx, chat.ID, true)
+	if err != nil {
+		return nil, err
+	}
+	return tree.branches(), nil
+}
+
+// Returns the branches of the tree, the branch with the newest message first
+func (t messageTree) branches() []BranchInfo {
+	onActivePath := map[uuid.UUID]bool{}
+	for _, message := range t.activePath() {
+		onActivePath[message.ID] = true
+	}
+
+	branches := []BranchInfo{}
+	for _, message := range t.byID {
+		if len(t.children[message.ID]) > 0 {
+			continue
+		}
+		path := t.pathTo(message.ID)
+		branch := BranchInfo{
+			LeafID:    message.ID,
+			Length:    len(path),
+			Preview:   preview(message.Content),
+			Active:    onActivePath[message.ID],
+			UpdatedAt: message.CreatedAt,
+		}
+		if !branch.Active {
+			for _, pathMessage := range path {
+				if !onActivePath[pathMessage.ID] {
+					branch.ForkID = &pathMessage.ID
+					branch.Preview = preview(pathMessage.Content)
+					break
+				}
+			}
+		}
+		branches = append(branches, branch)
+	}
+
+	slices.SortFunc(branches, func(a, b BranchInfo) int {
+		return b.UpdatedAt.Compare(a.UpdatedAt)
+	})
+	return branches
+}
+
+// Returns the beginning of a message for lists
+func preview(content string) string {
+	const maxRunes = 100
+	runes := []rune(content)
+	if len(runes) <= maxRunes {
+		return content
+	}
+	return string(runes[:maxRunes]) + "..."
+}
@@ -0,0 +1,185 @@
+package messages
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/roly-backend/internal/database"
+)
+
+// Creates a message that follows the parent (nil for the first message)
+func testMessage(parent *database.Message, role string, active bool) database.Message {
+	message := database.Message{ID: uuid.New(), SenderRole: role, IsActive: active}
+	if parent != nil {
+		message.ParentID = &parent.ID
+	}
+	return message
+}
+
+func TestMessageTree(t *testing.T) {
+	question := testMessage(nil, "user", true)
+	oldAnswer := testMessage(&question, "assistant", false)
+	followUp := testMessage(&oldAnswer, "user", true)
+	newAnswer := testMessage(&question, "assistant", true)
+
+	tree := newMessageTree([]database.Message{question, oldAnswer, followUp, newAnswer})
+
+	path := tree.activePath()
+	if len(path) != 2 || path[0].ID != question.ID || path[1].ID != newAnswer.ID {
+		t.Errorf("expected the path to follow the new answer, got %v", path)
+	}
+
+	// The messages after an inactive alternative stay reachable
+	path = tree.pathTo(followUp.ID)
+	if len(path) != 3 || path[0].ID != question.ID || path[1].ID != oldAnswer.ID || path[2].ID != followUp.ID {
+		t.Errorf("unexpected path to the follow up: %v", path)
+	}
+
+	alternatives := tree.alternatives(newAnswer)
+	if len(alternatives) != 2 || alternatives[0] != oldAnswer.ID || alternatives[1] != newAnswer.ID {
+		t.Errorf("expected both answers as alternatives, got %v", alternatives)
+	}
+}
+
+// A chat of messages that are changed the way the queries of the service change them
+type testChat struct {
+	messages []database.Message
+	created  time.Time
+}
+
+// Adds a message with some content after the parent (nil for the first message). Like a saved message it is the active alternative
+func (c *testChat) add(parent *database.Message, role, content string) database.Message {
+	message := testMessage(parent, role, false)
+	message.Content = content
+	c.created = c.created.Add(time.Minute)
+	message.CreatedAt = c.created
+	c.messages = append(c.messages, message)
+	c.activate([]database.Message{message})
+	return message
+}
+
+// Applies activateAlternative to the messages that activatePath doesn't skip
+func (c *testChat) activate(path []database.Message) {
+	for _, activated := range inactiveMessages(path) {
+		for i, message := range c.messages {
+			if (message.ParentID == nil && activated.ParentID == nil) || (message.ParentID != nil && activated.ParentID != nil && *message.ParentID == *activated.ParentID) {
+				c.messages[i].IsActive = message.ID == activated.ID
+			}
+		}
+	}
+}
+
+// Saves a new version of the user message and its answer like EditMessage does
+func (c *testChat) edit(message database.Message, content string) (database.Message, database.Message) {
+	history := newMessageTree(c.messages).historyBefore(message.ID)
+	c.activate(history)
+	var parent *database.Message
+	if len(history) > 0 {
+		parent = &history[len(history)-1]
+	}
+	edited := c.add(parent, "user", content)
+	return edited, c.add(&edited, "assistant", "Answer to "+content)
+}
+
+func (c *testChat) tree() messageTree {
+	return newMessageTree(c.messages)
+}
+
+// Returns the ids of the messages
+func ids(messages []database.Message) []uuid.UUID {
+	var ids []uuid.UUID
+	for _, message := range messages {
+		ids = append(ids, message.ID)
+	}
+	return ids
+}
+
+// Creates a chat of two questions and their answers
+func newTestChat() (*testChat, []database.Message) {
+	chat := &testChat{created: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)}
+	first := chat.add(nil, "user", "First question")
+	firstAnswer := chat.add(&first, "assistant", "First answer")
+	second := chat.add(&firstAnswer, "user", "Second question")
+	secondAnswer := chat.add(&second, "assistant", "Second answer")
+	return chat, []database.Message{first, firstAnswer, second, secondAnswer}
+}
+
+func TestEditFirstMessage(t *testing.T) {
+	chat, old := newTestChat()
+	edited, answer := chat.edit(old[0], "Other first question")
+
+	tree := chat.tree()
+	if path := ids(tree.activePath()); !slices.Equal(path, []uuid.UUID{edited.ID, answer.ID}) {
+		t.Errorf("expected the new version to be shown, got %v", path)
+	}
+
+	branches := tree.branches()
+	if len(branches) != 2 {
+		t.Fatalf("expected two branches, got %+v", branches)
+	}
+	active, other := branches[0], branches[1]
+	if !active.Active || active.LeafID != answer.ID || active.ForkID != nil || active.Length != 2 || active.Preview != answer.Content {
+		t.Errorf("unexpected active branch %+v", active)
+	}
+	if other.Active || other.LeafID != old[3].ID || other.ForkID == nil || *other.ForkID != old[0].ID || other.Length != 4 || other.Preview != old[0].Content {
+		t.Errorf("expected the old branch to fork at the first message, got %+v", other)
+	}
+}
+
+func TestEditMiddleMessage(t *testing.T) {
+	chat, old := newTestChat()
+	if history := ids(chat.tree().historyBefore(old[2].ID)); !slices.Equal(history, ids(old[:2])) {
+		t.Errorf("expected the new version to follow the first answer, got %v", history)
+	}
+	edited, answer := chat.edit(old[2], "Other second question")
+
+	tree := chat.tree()
+	expected := []uuid.UUID{old[0].ID, old[1].ID, edited.ID, answer.ID}
+	if path := ids(tree.activePath()); !slices.Equal(path, expected) {
+		t.Errorf("expected %v, got %v", expected, path)
+	}
+	branches := tree.branches()
+	if len(branches) != 2 || branches[1].ForkID == nil || *branches[1].ForkID != old[2].ID || branches[1].Preview != old[2].Content {
+		t.Errorf("expected the old branch to fork at the second question, got %+v", branches)
+	}
+}
+
+func TestSwitchBranch(t *testing.T) {
+	chat, old := newTestChat()
+	editedSecond, _ := chat.edit(old[2], "Other second question")
+	chat.edit(old[0], "Other first question")
+
+	// The answers stayed the active alternatives below the replaced questions, so only the questions are activated again
+	path := chat.tree().pathTo(old[3].ID)
+	if inactive := ids(inactiveMessages(path)); !slices.Equal(inactive, []uuid.UUID{old[0].ID, old[2].ID}) {
+		t.Errorf("expected only the replaced questions to be activated, got %v", inactive)
+	}
+	chat.activate(path)
+
+	tree := chat.tree()
+	if active := ids(tree.activePath()); !slices.Equal(active, ids(old)) {
+		t.Errorf("expected the old branch to be shown, got %v", active)
+	}
+	for _, branch := range tree.branches() {
+		if branch.Active != (branch.LeafID == old[3].ID) {
+			t.Errorf("expected only the old branch to be active, got %+v", branch)
+		}
+		if branch.Length == 4 && branch.LeafID != old[3].ID && (branch.ForkID == nil || *branch.ForkID != editedSecond.ID) {
+			t.Errorf("expected the branch of the edited second question to fork after the first answer, got %+v", branch)
+		}
+	}
+
+	// Activating the active branch again changes nothing
+	if inactive := inactiveMessages(tree.activePath()); len(inactive) != 0 {
+		t.Errorf("expected no message to be activated, got %v", ids(inactive))
+	}
+}
+
+func TestHistoryBeforeUnknownMessage(t *testing.T) {
+	chat, _ := newTestChat()
+	if history := chat.tree().historyBefore(uuid.New()); len(history) != 0 {
+		t.Errorf("expected no history, got %v", ids(history))
+	}
+}
@@ -0,0 +1,48 @@
+package moderation
+
+import (
+	"context"
+	"errors"
+
+	"github.com/roly-backend/internal/ai"
+)
+
+var errNoClassifier = errors.New("the AI provider has no moderation classifier")
+
+// Moderator that asks the classifier of the AI provider
+type Classifier struct {
+	action string // What happens with flagged texts
+}
+
+// Creates a classifier moderator. Flagged texts get the given action
+func NewClassifier(action string) *Classifier {
+	return &Classifier{action: action}
+}
+
+func (c *Classifier) Name() string {
+	return "classifier"
+}
+
+// Returns true if the classifier blocks the texts it flags
+func (c *Classifier) CanBlock(stage string) bool {
+	return c.action == ActionBlock
+}
+
+// Lets the provider classify the text
+func (c *Classifier) Check(ctx context.Context, stage, text string) (Verdict, error) {
+	moderator, ok := ai.Current().(ai.Moderator)
+	if !ok {
+		return Verdict{Action: ActionAllow}, errNoClassifier
+	}
+
+	result, err := moderator.Moderate(ctx, text)
+	if err != nil {
+		return Verdict{Action: ActionAllow}, err
+	}
+	verdict := Verdict{Action: ActionAllow, Source: c.Name(), Model: result.Model, Usage: result.Usage}
+	if result.Flagged {
+		verdict.Action = c.action
+		verdict.Categories = result.Categories
+	}
+	return verdict, nil
+}
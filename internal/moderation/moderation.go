@@ -0,0 +1,179 @@
+package moderation
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/roly-backend/internal/ai"
+	"github.com/roly-backend/internal/config"
+	"github.com/roly-backend/internal/database"
+	"github.com/roly-backend/internal/quotas"
+)
+
+// Where in the pipeline the text is checked
+const (
+	StageInput  = "input"  // Message of the user before it is sent to the AI
+	StageOutput = "output" // Answer of the AI before it is saved
+)
+
+// What happens with a flagged text. Ordered by severity
+const (
+	ActionAllow    = "allow"
+	ActionAnnotate = "annotate" // The text goes through but is marked as flagged
+	ActionBlock    = "block"    // The text is stopped
+)
+
+var severity = map[string]int{ActionAllow: 0, ActionAnnotate: 1, ActionBlock: 2}
+
+// Result of a check
+type Verdict struct {
+	Action     string
+	Categories []string
+	Source     string // Which moderator flagged the text ("rules" or "classifier")
+	Model      string
+	Usage      ai.Usage // Tokens the moderator used if it asks a model (empty for the rules)
+}
+
+// Flagged returns true if any moderator flagged the text
+func (v Verdict) Flagged() bool {
+	return v.Action != ActionAllow
+}
+
+// A moderation stage. Moderators are pluggable, every registered moderator checks every text
+type Moderator interface {
+	Name() string
+	Check(ctx context.Context, stage, text string) (Verdict, error)
+}
+
+// Returned when a text was blocked
+type BlockedError struct {
+	Stage      string
+	Categories []string
+}
+
+func (e *BlockedError) Error() string {
+	return fmt.Sprintf("%s was blocked by the moderation (%s)", e.Stage, strings.Join(e.Categories, ", "))
+}
+
+// The text and who it belongs to
+type Subject struct {
+	UserID    uuid.UUID
+	ChatID    uuid.UUID
+	MessageID *uuid.UUID // null if the text wasn't saved (yet)
+	Text      string
+}
+
+var (
+	moderatorsMutex sync.RWMutex
+	moderators      []Moderator
+)
+
+// Creates the moderators that are configured (has to be called once on startup after the ENV is loaded)
+func Setup() {
+	moderatorsMutex.Lock()
+	defer moderatorsMutex.Unlock()
+
+	moderators = []Moderator{NewRuleEngine(config.ModerationRules)}
+	if config.ModerationClassifierEnabled {
+		moderators = append(moderators, NewClassifier(config.ModerationClassifierAction))
+	}
+}
+
+// Adds a moderator to the pipeline
+func Register(moderator Moderator) {
+	moderatorsMutex.Lock()
+	defer moderatorsMutex.Unlock()
+	moderators = append(moderators, moderator)
+}
+
+// Runs all moderators on the text. Every flagged text is saved as a moderation event, without the message id if the text is blocked
+// since a blocked text is never saved. Returns a BlockedError if one of the moderators blocks the text, the verdict tells if the text should be annotated
+func Check(ctx context.Context, stage string, subject Subject) (Verdict, error) {
+	moderatorsMutex.RLock()
+	active := append([]Moderator(nil), moderators...)
+	moderatorsMutex.RUnlock()
+
+	result := Verdict{Action: ActionAllow}
+	var flagged []Verdict
+	for _, moderator := range active {
+		verdict, err := moderator.Check(ctx, stage, subject.Text)
+		if err != nil {
+			// A moderator that doesn't work must not stop the chat
+			slog.LogAttrs(ctx, slog.LevelError, "Error running moderator",
+				slog.String("moderator", moderator.Name()),
+				slog.String("chat_id", subject.ChatID.String()),
+				slog.String("error", err.Error()),
+			)
+			continue
+		}
+		// Checks of the classifier count for the quotas of the user like every other AI request
+		quotas.RecordUsage(quotas.Usage{UserID: subject.UserID, ChatID: &subject.ChatID, Purpose: database.UsagePurposeModeration, Model: verdict.Model, Tokens: verdict.Usage})
+		if !verdict.Flagged() {
+			continue
+		}
+
+		flagged = append(flagged, verdict)
+		if severity[verdict.Action] > severity[result.Action] {
+			result.Action = verdict.Action
+			result.Source = verdict.Source
+		}
+		result.Categories = append(result.Categories, verdict.Categories...)
+	}
+
+	if result.Action == ActionBlock {
+		subject.MessageID = nil
+	}
+	for _, verdict := range flagged {
+		recordEvent(ctx, stage, subject, verdict)
+	}
+	if result.Action == ActionBlock {
+		return result, &BlockedError{Stage: stage, Categories: result.Categories}
+	}
+	return result, nil
+}
+
+// Saves the flagged text as a moderation event. Errors are only logged since the verdict is more important than the event
+func recordEvent(ctx context.Context, stage string, subject Subject, verdict Verdict) {
+	event := database.ModerationEvent{
+		ID:         uuid.New(),
+		UserID:     subject.UserID,
+		ChatID:     subject.ChatID,
+		MessageID:  subject.MessageID,
+		Stage:      stage,
+		Source:     verdict.Source,
+		Action:     verdict.Action,
+		Categories: verdict.Categories,
+		Excerpt:    excerpt(subject.Text),
+		CreatedAt:  time.Now(),
+	}
+	if err := database.DB.WithContext(ctx).Create(&event).Error; err != nil {
+		slog.LogAttrs(ctx, slog.LevelError, "Error saving moderation event",
+			slog.String("chat_id", subject.ChatID.String()),
+			slog.String("error", err.Error()),
+		)
+	}
+
+	slog.LogAttrs(ctx, slog.LevelInfo, "Content was flagged by the moderation",
+		slog.String("user_id", subject.UserID.String()),
+		slog.String("chat_id", subject.ChatID.String()),
+		slog.String("stage", stage),
+		slog.String("source", verdict.Source),
+		slog.String("action", verdict.Action),
+		slog.Any("categories", verdict.Categories),
+	)
+}
+
+// Returns the beginning of the text so the event shows what was flagged without storing huge texts twice
+func excerpt(text string) string {
+	const maxRunes = 300
+	runes := []rune(text)
+	if len(runes) <= maxRunes {
+		return text
+	}
+	return string(runes[:maxRunes]) + "..."
+}
@@ -0,0 +1,100 @@
+package moderation
+
+import (
+	"context"
+	"log/slog"
+	"regexp"
+	"strings"
+
+	"github.com/roly-backend/internal/config"
+)
+
+// A compiled rule of the rule engine
+type rule struct {
+	category string
+	action   string
+	stages   map[string]bool // empty means every stage
+	pattern  *regexp.Regexp
+}
+
+// Local moderator that flags texts with keywords or regular expressions
+type RuleEngine struct {
+	rules []rule
+}
+
+// Compiles the rules. Keywords match whole words without caring about upper and lower case.
+// Rules with an invalid pattern are skipped and logged
+func NewRuleEngine(rules []config.ModerationRule) *RuleEngine {
+	engine := &RuleEngine{}
+	for _, configRule := range rules {
+		patterns := append([]string(nil), configRule.Patterns...)
+		for _, keyword := range configRule.Keywords {
+			patterns = append(patterns, `(?i)\b`+regexp.QuoteMeta(keyword)+`\b`)
+		}
+
+		stages := map[string]bool{}
+		for _, stage := range configRule.Stages {
+			stages[stage] = true
+		}
+
+		for _, pattern := range patterns {
+			compiled, err := regexp.Compile(pattern)
+			if err != nil {
+				slog.LogAttrs(context.Background(), slog.LevelError, "Invalid moderation rule pattern",
+					slog.String("category", configRule.Category),
+					slog.String("pattern", pattern),
+					slog.String("error", err.Error()),
+				)
+				continue
+			}
+			engine.rules = append(engine.rules, rule{
+				category: configRule.Category,
+				action:   configRule.Action,
+				stages:   stages,
+				pattern:  compiled,
+			})
+		}
+	}
+	return engine
+}
+
+func (e *RuleEngine) Name() string {
+	return "rules"
+}
+
+// Returns true if one of the rules of the stage blocks texts
+func (e *RuleEngine) CanBlock(stage string) bool {
+	for _, rule := range e.rules {
+		if (len(rule.stages) == 0 || rule.stages[stage]) && strings.ToLower(rule.action) == ActionBlock {
+			return true
+		}
+	}
+	return false
+}
+
+// The rules are local regular expressions, so they can check a streamed text after every window
+func (e *RuleEngine) streamable() {}
+
+// Checks the text against all rules of the stage. The most severe action of the matching rules wins
+func (e *RuleEngine) Check(ctx context.Context, stage, text string) (Verdict, error) {
+	verdict := Verdict{Action: ActionAllow, Source: e.Name()}
+	seen := map[string]bool{}
+	for _, rule := range e.rules {
+		if len(rule.stages) > 0 && !rule.stages[stage] {
+			continue
+		}
+		if !rule.pattern.MatchString(text) {
+			continue
+		}
+
+		if !seen[rule.category] {
+			verdict.Categories = append(verdict.Categories, rule.category)
+			seen[rule.category] = true
+		}
+		action := strings.ToLower(rule.action)
+		if severity[action] > severity[verdict.Action] {
+			verdict.Action = action
+		}
+	}
+	return verdict, nil
+}
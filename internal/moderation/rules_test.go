@@ -0,0 +1,37 @@
+package moderation
+
+import (
+	"context"
+	"testing"
+
+	"github.com/roly-backend/internal/config"
+)
+
+func TestRuleEngine(t *testing.T) {
+	engine := NewRuleEngine([]config.ModerationRule{
+		{Category: "insult", Action: ActionAnnotate, Keywords: []string{"idiot"}},
+		{Category: "secret", Action: ActionBlock, Stages: []string{StageOutput}, Patterns: []string{`\bsk-[a-z]{5}\b`}},
+		{Category: "broken", Action: ActionBlock, Patterns: []string{`(`}},
+	})
+
+	tests := []struct {
+		stage  string
+		text   string
+		action string
+	}{
+		{StageInput, "hello there", ActionAllow},
+		{StageInput, "You IDIOT!", ActionAnnotate},
+		{StageInput, "idiots", ActionAllow},
+		{StageInput, "my key is sk-abcde", ActionAllow},
+		{StageOutput, "my key is sk-abcde, idiot", ActionBlock},
+	}
+	for _, test := range tests {
+		verdict, err := engine.Check(context.Background(), test.stage, test.text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if verdict.Action != test.action {
+			t.Errorf("%s %q: expected %s, got %s", test.stage, test.text, test.action, verdict.Action)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package moderation
+
+import (
+	"context"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Pieces of a streamed text are released in windows of at least this many bytes, so the rules don't run after every single piece
+const streamWindow = 40
+
+// Implemented by moderators that can tell which stages they block. Moderators without it are expected to block every stage
+type blockingModerator interface {
+	CanBlock(stage string) bool
+}
+
+// Implemented by moderators that are cheap enough to check a streamed text again after every window (the rules, but not the classifier)
+type streamModerator interface {
+	streamable()
+}
+
+// Checks a text while it is streamed, so text the moderation blocks never reaches the user.
+// The pieces are held back until the text so far passed the moderators that can check it again and again.
+// If a moderator that can block has to see the whole text (the classifier), everything is held back until the text is complete
+type StreamGuard struct {
+	ctx      context.Context
+	stage    string
+	subject  Subject
+	checkers []Moderator // Moderators that check every window
+	holdAll  bool
+	text     strings.Builder // Everything that was received
+	released int             // How many bytes of the text were already released
+}
+
+// Creates a guard for the streamed texts of the subject (the text of the subject isn't used)
+func NewStreamGuard(ctx context.Context, stage string, subject Subject) *StreamGuard {
+	moderatorsMutex.RLock()
+	defer moderatorsMutex.RUnlock()
+
+	guard := &StreamGuard{ctx: ctx, stage: stage, subject: subject}
+	for _, moderator := range moderators {
+		if blocking, ok := moderator.(blockingModerator); ok && !blocking.CanBlock(stage) {
+			continue
+		}
+		if _, ok := moderator.(streamModerator); ok {
+			guard.checkers = append(guard.checkers, moderator)
+		} else {
+			guard.holdAll = true
+		}
+	}
+	return guard
+}
+
+// Takes the next piece of the text and returns the text that can be passed on (can be empty).
+// Returns a BlockedError if the text so far is blocked, then nothing of it must be passed on anymore
+func (g *StreamGuard) Write(delta string) (string, error) {
+	g.text.WriteString(delta)
+	if g.holdAll {
+		return "", nil
+	}
+	// Nothing can block the text, so every piece is passed on at once
+	if len(g.checkers) == 0 {
+		g.released = g.text.Len()
+		return delta, nil
+	}
+
+	// Only whole words are released, so a blocked word can't be shown half before the rest of it arrives
+	text := g.text.String()
+	space := strings.LastIndexFunc(text, unicode.IsSpace)
+	if space < 0 {
+		return "", nil
+	}
+	_, size := utf8.DecodeRuneInString(text[space:])
+	end := space + size
+	if end-g.released < streamWindow {
+		return "", nil
+	}
+	if err := g.check(text); err != nil {
+		return "", err
+	}
+
+	release := text[g.released:end]
+	g.released = end
+	return release, nil
+}
+
+// Returns the part of the text that wasn't released yet and starts over with the next text (for example after a tool call).
+// Has to be called only after the complete text passed Check
+func (g *StreamGuard) Flush() string {
+	release := g.text.String()[g.released:]
+	g.text.Reset()
+	g.released = 0
+	return release
+}
+
+// Runs the moderators that check every window. A blocked text is saved as a moderation event like in Check
+func (g *StreamGuard) check(text string) error {
+	for _, moderator := range g.checkers {
+		verdict, err := moderator.Check(g.ctx, g.stage, text)
+		if err != nil || verdict.Action != ActionBlock {
+			continue
+		}
+		subject := g.subject
+		subject.Text = text
+		recordEvent(g.ctx, g.stage, subject, verdict)
+		return &BlockedError{Stage: g.stage, Categories: verdict.Categories}
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package moderation
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/roly-backend/internal/config"
+	"github.com/roly-backend/internal/database"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// Replaces the moderators for the test. Moderation events are only built, never sent to a database
+func useModerators(t *testing.T, active ...Moderator) {
+	t.Helper()
+	db, err := gorm.Open(postgres.New(postgres.Config{DSN: "host=localhost"}), &gorm.Config{DryRun: true, DisableAutomaticPing: true, Logger: logger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	previousDB, previous := database.DB, moderators
+	database.DB, moderators = db, active
+	t.Cleanup(func() { database.DB, moderators = previousDB, previous })
+}
+
+// Writes the pieces into the guard and returns what was released until the first error
+func streamThrough(guard *StreamGuard, pieces []string) (string, error) {
+	var released strings.Builder
+	for _, piece := range pieces {
+		release, err := guard.Write(piece)
+		released.WriteString(release)
+		if err != nil {
+			return released.String(), err
+		}
+	}
+	return released.String(), nil
+}
+
+func TestStreamGuardBlocksBeforeRelease(t *testing.T) {
+	useModerators(t, NewRuleEngine([]config.ModerationRule{
+		{Category: "secret", Action: ActionBlock, Patterns: []string{`\bsk-[a-z]{20,}\b`}},
+	}))
+
+	guard := NewStreamGuard(context.Background(), StageOutput, Subject{})
+	pieces := []string{"Sure, this is the key that ", "you asked for: ", "sk-abcdefgh", "ijklmnopqrst", "uvw and more ", "text after it."}
+	released, err := streamThrough(guard, pieces)
+
+	var blocked *BlockedError
+	if !errors.As(err, &blocked) {
+		t.Fatalf("expected the stream to be blocked, got %v", err)
+	}
+	if released == "" || strings.Contains(released, "sk-") {
+		t.Errorf("expected only the text before the key to be released, got %q", released)
+	}
+}
+
+func TestStreamGuardReleasesWholeWords(t *testing.T) {
+	useModerators(t, NewRuleEngine([]config.ModerationRule{
+		{Category: "secret", Action: ActionBlock, Patterns: []string{`\bsk-[a-z]{20,}\b`}},
+	}))
+
+	guard := NewStreamGuard(context.Background(), StageOutput, Subject{})
+	pieces := []string{"A harmless answer ", "that is long enough ", "to be released in win", "dows, word by word."}
+	released, err := streamThrough(guard, pieces)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if released != "A harmless answer that is long enough to be released in " {
+		t.Errorf("unexpected released text %q", released)
+	}
+	if rest := guard.Flush(); released+rest != strings.Join(pieces, "") {
+		t.Errorf("expected the flush to return the rest, got %q", rest)
+	}
+	if rest := guard.Flush(); rest != "" {
+		t.Errorf("expected the guard to start over after a flush, got %q", rest)
+	}
+}
+
+func TestStreamGuardHoldsBackForTheClassifier(t *testing.T) {
+	pieces := []string{"Every piece ", "is held back ", "until the whole answer ", "was checked."}
+
+	useModerators(t, NewRuleEngine(nil), NewClassifier(ActionBlock))
+	guard := NewStreamGuard(context.Background(), StageOutput, Subject{})
+	released, err := streamThrough(guard, pieces)
+	if err != nil || released != "" {
+		t.Errorf("expected nothing to be released, got %q (%v)", released, err)
+	}
+	if rest := guard.Flush(); rest != strings.Join(pieces, "") {
+		t.Errorf("expected the whole answer after the flush, got %q", rest)
+	}
+
+	// A classifier that only annotates can't stop the answer, so nothing is held back
+	useModerators(t, NewRuleEngine(nil), NewClassifier(ActionAnnotate))
+	guard = NewStreamGuard(context.Background(), StageOutput, Subject{})
+	released, err = streamThrough(guard, pieces)
+	if err != nil || released != strings.Join(pieces, "") {
+		t.Errorf("expected every piece to be released at once, got %q (%v)", released, err)
+	}
+}
@@ -0,0 +1,32 @@
+package quotas
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/roly-backend/internal/users"
+)
+
+// Returns the limits of the user and how much of them is left
+func GetQuotaHandler(c *gin.Context) {
+	userID, err := users.GetUserID(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	status, err := GetStatus(c.Request.Context(), userID)
+	if err != nil {
+		slog.LogAttrs(context.Background(), slog.LevelError, "Error loading quota status",
+			slog.String("user_id", userID.String()),
+			slog.String("error", err.Error()),
+		)
+		// Sends error to client
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, status)
+}
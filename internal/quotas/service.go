@@ -0,0 +1,200 @@
+package quotas
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/roly-backend/internal/ai"
+	"github.com/roly-backend/internal/config"
+	"github.com/roly-backend/internal/database"
+	"gorm.io/gorm"
+)
+
+// Returned when the user used up one of their limits
+type ExceededError struct {
+	Period  string    // "daily" or "monthly"
+	Limit   string    // "tokens" or "cost"
+	ResetAt time.Time // When the period starts again
+}
+
+func (e *ExceededError) Error() string {
+	return fmt.Sprintf("%s %s quota exceeded", e.Period, e.Limit)
+}
+
+// Limits and usage of one period. A limit of 0 means there is no limit
+type PeriodStatus struct {
+	TokenLimit      int64     `json:"token_limit"`
+	TokensUsed      int64     `json:"tokens_used"`
+	TokensRemaining int64     `json:"tokens_remaining"`
+	CostLimit       float64   `json:"cost_limit"` // US dollars
+	CostUsed        float64   `json:"cost_used"`
+	CostRemaining   float64   `json:"cost_remaining"`
+	ResetAt         time.Time `json:"reset_at"`
+}
+
+// Quota status of a user
+type Status struct {
+	Daily   PeriodStatus `json:"daily"`
+	Monthly PeriodStatus `json:"monthly"`
+}
+
+// Returns the start and the end of the UTC day and month of the time
+func periodBounds(now time.Time) (dayStart, dayEnd, monthStart, monthEnd time.Time) {
+	now = now.UTC()
+	dayStart = time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	monthStart = time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	return dayStart, dayStart.AddDate(0, 0, 1), monthStart, monthStart.AddDate(0, 1, 0)
+}
+
+// Returns the limits and how much of them the user already used
+func GetStatus(ctx context.Context, userID uuid.UUID) (Status, error) {
+	limits, err := getLimits(ctx, userID)
+	if err != nil {
+		return Status{}, err
+	}
+
+	dayStart, dayEnd, monthStart, monthEnd := periodBounds(time.Now())
+	daily, err := periodStatus(ctx, userID, dayStart, dayEnd, *limits.DailyTokenLimit, *limits.DailyCostLimit)
+	if err != nil {
+		return Status{}, err
+	}
+	monthly, err := periodStatus(ctx, userID, monthStart, monthEnd, *limits.MonthlyTokenLimit, *limits.MonthlyCostLimit)
+	if err != nil {
+		return Status{}, err
+	}
+	return Status{Daily: daily, Monthly: monthly}, nil
+}
+
+// Checks if the user is still allowed to make an AI request. Returns an ExceededError if not
+func Check(ctx context.Context, userID uuid.UUID) error {
+	status, err := GetStatus(ctx, userID)
+	if err != nil {
+		return err
+	}
+	return exceeded(status)
+}
+
+// Returns an ExceededError for the first limit of the status that is used up. The daily limits are checked before the monthly ones
+func exceeded(status Status) error {
+	periods := []struct {
+		name   string
+		status PeriodStatus
+	}{
+		{"daily", status.Daily},
+		{"monthly", status.Monthly},
+	}
+	for _, period := range periods {
+		if period.status.TokenLimit > 0 && period.status.TokensRemaining <= 0 {
+			return &ExceededError{Period: period.name, Limit: "tokens", ResetAt: period.status.ResetAt}
+		}
+		if period.status.CostLimit > 0 && period.status.CostRemaining <= 0 {
+			return &ExceededError{Period: period.name, Limit: "cost", ResetAt: period.status.ResetAt}
+		}
+	}
+	return nil
+}
+
+// Returns the limits of the user. Limits that are not set for the user come from the config
+func getLimits(ctx context.Context, userID uuid.UUID) (database.UserQuota, error) {
+	var quota database.UserQuota
+	err := database.DB.WithContext(ctx).First(&quota, "user_id = ?", userID).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return quota, err
+	}
+
+	if quota.DailyTokenLimit == nil {
+		quota.DailyTokenLimit = &config.DefaultDailyTokenLimit
+	}
+	if quota.MonthlyTokenLimit == nil {
+		quota.MonthlyTokenLimit = &config.DefaultMonthlyTokenLimit
+	}
+	if quota.DailyCostLimit == nil {
+		quota.DailyCostLimit = &config.DefaultDailyCostLimit
+	}
+	if quota.MonthlyCostLimit == nil {
+		quota.MonthlyCostLimit = &config.DefaultMonthlyCostLimit
+	}
+	return quota, nil
+}
+
+// One AI request that counts for the quotas of a user
+type Usage struct {
+	UserID    uuid.UUID
+	ChatID    *uuid.UUID // nil if the request doesn't belong to a chat
+	MessageID *uuid.UUID // The answer that was saved (nil if the request didn't save a message)
+	Purpose   string     // See the database.UsagePurpose constants
+	Model     string
+	Tokens    ai.Usage
+}
+
+// Saves the usage in the ledger the quotas are computed from. The context isn't used, so the usage of a canceled request still counts.
+// Errors are only logged because the request was already made
+func RecordUsage(usage Usage) {
+	record, ok := usageRecord(usage)
+	if !ok {
+		return
+	}
+	if err := database.DB.Create(&record).Error; err != nil {
+		slog.LogAttrs(context.Background(), slog.LevelError, "Error recording AI usage",
+			slog.String("user_id", usage.UserID.String()),
+			slog.String("purpose", usage.Purpose),
+			slog.String("error", err.Error()),
+		)
+	}
+}
+
+// Returns the ledger entry of the usage, false if the request didn't use any tokens
+func usageRecord(usage Usage) (database.UsageRecord, bool) {
+	if usage.Tokens.PromptTokens == 0 && usage.Tokens.CompletionTokens == 0 {
+		return database.UsageRecord{}, false
+	}
+	return database.UsageRecord{
+		UserID:           usage.UserID,
+		ChatID:           usage.ChatID,
+		MessageID:        usage.MessageID,
+		Purpose:          usage.Purpose,
+		Model:            usage.Model,
+		PromptTokens:     usage.Tokens.PromptTokens,
+		CompletionTokens: usage.Tokens.CompletionTokens,
+		Cost:             ai.Cost(usage.Model, usage.Tokens),
+	}, true
+}
+
+// Sums up the usage of all AI requests of the user in the period
+func periodStatus(ctx context.Context, userID uuid.UUID, start, end time.Time, tokenLimit int64, costLimit float64) (PeriodStatus, error) {
+	var used struct {
+		Tokens int64
+		Cost   float64
+	}
+	err := database.DB.WithContext(ctx).Model(&database.UsageRecord{}).
+		Select("COALESCE(SUM(prompt_tokens + completion_tokens), 0) AS tokens, COALESCE(SUM(cost), 0) AS cost").
+		Where("user_id = ? AND created_at >= ? AND created_at < ?", userID, start, end).
+		Scan(&used).Error
+	if err != nil {
+		return PeriodStatus{}, err
+	}
+
+	return newPeriodStatus(tokenLimit, costLimit, used.Tokens, used.Cost, end), nil
+}
+
+// Returns the status of a period with the remaining amounts clamped to 0. Without a limit nothing remains
+func newPeriodStatus(tokenLimit int64, costLimit float64, tokensUsed int64, costUsed float64, resetAt time.Time) PeriodStatus {
+	status := PeriodStatus{
+		TokenLimit: tokenLimit,
+		TokensUsed: tokensUsed,
+		CostLimit:  costLimit,
+		CostUsed:   costUsed,
+		ResetAt:    resetAt,
+	}
+	if tokenLimit > 0 {
+		status.TokensRemaining = max(tokenLimit-tokensUsed, 0)
+	}
+	if costLimit > 0 {
+		status.CostRemaining = max(costLimit-costUsed, 0)
+	}
+	return status
+}
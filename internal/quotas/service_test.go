@@ -0,0 +1,110 @@
+package quotas
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/roly-backend/internal/ai"
+	"github.com/roly-backend/internal/database"
+)
+
+func TestPeriodBounds(t *testing.T) {
+	// 00:30 on the first of May in Berlin is still the last day of April in UTC
+	berlin := time.FixedZone("CEST", 2*60*60)
+	dayStart, dayEnd, monthStart, monthEnd := periodBounds(time.Date(2025, 5, 1, 0, 30, 0, 0, berlin))
+
+	expected := []time.Time{
+		time.Date(2025, 4, 30, 0, 0, 0, 0, time.UTC),
+		time.Date(2025, 5, 1, 0, 0, 0, 0, time.UTC),
+		time.Date(2025, 4, 1, 0, 0, 0, 0, time.UTC),
+		time.Date(2025, 5, 1, 0, 0, 0, 0, time.UTC),
+	}
+	for i, got := range []time.Time{dayStart, dayEnd, monthStart, monthEnd} {
+		if !got.Equal(expected[i]) {
+			t.Errorf("bound %d: expected %v, got %v", i, expected[i], got)
+		}
+	}
+}
+
+func TestNewPeriodStatus(t *testing.T) {
+	resetAt := time.Date(2025, 5, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name            string
+		tokenLimit      int64
+		costLimit       float64
+		tokensUsed      int64
+		costUsed        float64
+		tokensRemaining int64
+		costRemaining   float64
+	}{
+		{"remaining amounts", 1000, 2, 400, 0.5, 600, 1.5},
+		{"used more than the limit", 1000, 2, 1200, 3, 0, 0},
+		{"no limits", 0, 0, 400, 0.5, 0, 0},
+	}
+	for _, test := range tests {
+		status := newPeriodStatus(test.tokenLimit, test.costLimit, test.tokensUsed, test.costUsed, resetAt)
+		if status.TokensRemaining != test.tokensRemaining || status.CostRemaining != test.costRemaining {
+			t.Errorf("%s: expected %d tokens and $%.2f remaining, got %+v", test.name, test.tokensRemaining, test.costRemaining, status)
+		}
+		if status.TokensUsed != test.tokensUsed || status.CostUsed != test.costUsed || !status.ResetAt.Equal(resetAt) {
+			t.Errorf("%s: expected the usage and the reset time to be kept, got %+v", test.name, status)
+		}
+	}
+}
+
+func TestExceeded(t *testing.T) {
+	dayEnd := time.Date(2025, 4, 2, 0, 0, 0, 0, time.UTC)
+	monthEnd := time.Date(2025, 5, 1, 0, 0, 0, 0, time.UTC)
+	daily := func(tokenLimit, tokensUsed int64, costLimit, costUsed float64) PeriodStatus {
+		return newPeriodStatus(tokenLimit, costLimit, tokensUsed, costUsed, dayEnd)
+	}
+	monthly := func(tokenLimit, tokensUsed int64, costLimit, costUsed float64) PeriodStatus {
+		return newPeriodStatus(tokenLimit, costLimit, tokensUsed, costUsed, monthEnd)
+	}
+
+	tests := []struct {
+		name     string
+		status   Status
+		expected *ExceededError // nil if the request is allowed
+	}{
+		{"within the limits", Status{daily(1000, 999, 1, 0.99), monthly(10000, 999, 10, 0.99)}, nil},
+		{"no limits", Status{daily(0, 5000, 0, 50), monthly(0, 5000, 0, 50)}, nil},
+		{"daily tokens used up", Status{daily(1000, 1000, 1, 0.5), monthly(10000, 1000, 10, 0.5)}, &ExceededError{Period: "daily", Limit: "tokens", ResetAt: dayEnd}},
+		{"daily cost used up", Status{daily(1000, 500, 1, 1.2), monthly(10000, 500, 10, 1.2)}, &ExceededError{Period: "daily", Limit: "cost", ResetAt: dayEnd}},
+		{"monthly tokens used up", Status{daily(1000, 100, 1, 0.1), monthly(10000, 10500, 10, 5)}, &ExceededError{Period: "monthly", Limit: "tokens", ResetAt: monthEnd}},
+		{"monthly cost used up", Status{daily(0, 100, 0, 0.1), monthly(0, 10500, 10, 10)}, &ExceededError{Period: "monthly", Limit: "cost", ResetAt: monthEnd}},
+		{"the daily limit comes first", Status{daily(1000, 1000, 1, 1), monthly(1000, 1000, 1, 1)}, &ExceededError{Period: "daily", Limit: "tokens", ResetAt: dayEnd}},
+	}
+	for _, test := range tests {
+		err := exceeded(test.status)
+		if test.expected == nil {
+			if err != nil {
+				t.Errorf("%s: expected no error, got %v", test.name, err)
+			}
+			continue
+		}
+		var exceededErr *ExceededError
+		if !errors.As(err, &exceededErr) || *exceededErr != *test.expected {
+			t.Errorf("%s: expected %+v, got %v", test.name, test.expected, err)
+		}
+	}
+}
+
+func TestUsageRecord(t *testing.T) {
+	usage := Usage{UserID: uuid.New(), Purpose: database.UsagePurposeAnswer, Model: "gpt-4.1-nano"}
+	if _, ok := usageRecord(usage); ok {
+		t.Error("expected a request without tokens not to be recorded")
+	}
+
+	usage.Tokens = ai.Usage{PromptTokens: 1000, CompletionTokens: 200, TotalTokens: 1200}
+	record, ok := usageRecord(usage)
+	if !ok || record.UserID != usage.UserID || record.PromptTokens != 1000 || record.CompletionTokens != 200 {
+		t.Errorf("expected the usage to be recorded, got %+v", record)
+	}
+	if record.Cost != ai.Cost("gpt-4.1-nano", usage.Tokens) || record.Cost == 0 {
+		t.Errorf("expected the cost of the model, got %f", record.Cost)
+	}
+}
@@ -1,3 +1,142 @@
 package roles
 
-// TODO: alle Rollen des users verwalten
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/roly-backend/internal/users"
+)
+
+// Returns the default roles and the own roles of the user
+func ListRolesHandler(c *gin.Context) {
+	userID, err := users.GetUserID(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	roles, err := ListRoles(c.Request.Context(), userID)
+	if err != nil {
+		roleError(c, "Error listing roles", userID, err)
+		return
+	}
+	c.JSON(http.StatusOK, roles)
+}
+
+// Returns a single role
+func GetRoleHandler(c *gin.Context) {
+	userID, roleID, ok := parseIDs(c)
+	if !ok {
+		return
+	}
+
+	role, err := GetRole(c.Request.Context(), userID, roleID)
+	if err != nil {
+		roleError(c, "Error loading role", userID, err)
+		return
+	}
+	c.JSON(http.StatusOK, role)
+}
+
+// Creates a new role for the user (or a default role if an admin sends "default": true)
+func CreateRoleHandler(c *gin.Context) {
+	userID, err := users.GetUserID(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	var input RoleInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	role, err := CreateRole(c.Request.Context(), userID, input)
+	if err != nil {
+		roleError(c, "Error creating role", userID, err)
+		return
+	}
+	c.JSON(http.StatusCreated, role)
+}
+
+// Changes the fields of a role that are in the body
+func UpdateRoleHandler(c *gin.Context) {
+	userID, roleID, ok := parseIDs(c)
+	if !ok {
+		return
+	}
+
+	var input RoleInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	role, err := UpdateRole(c.Request.Context(), userID, roleID, input)
+	if err != nil {
+		roleError(c, "Error updating role", userID, err)
+		return
+	}
+	c.JSON(http.StatusOK, role)
+}
+
+// Deletes a role
+func DeleteRoleHandler(c *gin.Context) {
+	userID, roleID, ok := parseIDs(c)
+	if !ok {
+		return
+	}
+
+	if err := DeleteRole(c.Request.Context(), userID, roleID); err != nil {
+		roleError(c, "Error deleting role", userID, err)
+		return
+	}
+
+	slog.LogAttrs(context.Background(), slog.LevelInfo, "Role deleted",
+		slog.String("user_id", userID.String()),
+		slog.String("role_id", roleID.String()),
+	)
+	c.Status(http.StatusNoContent)
+}
+
+// Reads the user id and the role id of the path. Sends an error to the client if one of them is invalid
+func parseIDs(c *gin.Context) (uuid.UUID, uuid.UUID, bool) {
+	userID, err := users.GetUserID(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return uuid.Nil, uuid.Nil, false
+	}
+	roleID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid role id"})
+		return uuid.Nil, uuid.Nil, false
+	}
+	return userID, roleID, true
+}
+
+// Sends the matching status for the errors of the service. Roles of other users are reported as not found so their ids aren't leaked
+func roleError(c *gin.Context, msg string, userID uuid.UUID, err error) {
+	var validationErr *ValidationError
+	switch {
+	case errors.As(err, &validationErr):
+		c.JSON(http.StatusBadRequest, gin.H{"error": validationErr.Error()})
+	case errors.Is(err, ErrRoleNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Role not found"})
+	case errors.Is(err, ErrNotAllowed):
+		c.JSON(http.StatusForbidden, gin.H{"error": "Default roles can only be changed by admins"})
+	case errors.Is(err, ErrNameTaken):
+		c.JSON(http.StatusConflict, gin.H{"error": "A role with this name already exists"})
+	default:
+		slog.LogAttrs(context.Background(), slog.LevelError, msg,
+			slog.String("user_id", userID.String()),
+			slog.String("error", err.Error()),
+		)
+		// Sends error to client
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+	}
+}
@@ -0,0 +1,257 @@
+package roles
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/roly-backend/internal/ai"
+	"github.com/roly-backend/internal/config"
+	"github.com/roly-backend/internal/database"
+	"github.com/roly-backend/internal/users"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrRoleNotFound = errors.New("role not found")
+	ErrNotAllowed   = errors.New("role can't be changed by this user")
+	ErrNameTaken    = errors.New("a role with this name already exists")
+)
+
+// Returned when the input of a role is invalid
+type ValidationError struct {
+	Field   string
+	Message string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Field, e.Message)
+}
+
+// A role how the client gets it
+type RoleInfo struct {
+	ID             uuid.UUID                `json:"id"`
+	Name           string                   `json:"name"`
+	SystemPrompt   string                   `json:"system_prompt"`
+	FallbackModels []string                 `json:"fallback_models"`
+	Tools          []string                 `json:"tools"`
+	OutputSchema   string                   `json:"output_schema,omitempty"`
+	Parameters     []database.RoleParameter `json:"parameters"` // Custom variables the chat can set when it starts
+	Default        bool                     `json:"default"`    // Default roles are available for every user
+	CreatedAt      time.Time                `json:"created_at"`
+}
+
+func toRoleInfo(role database.Role) RoleInfo {
+	parameters := role.Parameters
+	if parameters == nil {
+		parameters = []database.RoleParameter{}
+	}
+	return RoleInfo{
+		ID:             role.ID,
+		Name:           role.Name,
+		SystemPrompt:   role.SystemPrompt,
+		FallbackModels: emptyIfNil(role.FallbackModels),
+		Tools:          emptyIfNil(role.Tools),
+		OutputSchema:   role.OutputSchema,
+		Parameters:     parameters,
+		Default:        role.UserID == nil,
+		CreatedAt:      role.CreatedAt,
+	}
+}
+
+// Fields of a role the client can set. Fields that are nil stay unchanged when a role is updated
+type RoleInput struct {
+	Name           *string                   `json:"name"`
+	SystemPrompt   *string                   `json:"system_prompt"`
+	FallbackModels *[]string                 `json:"fallback_models"`
+	Tools          *[]string                 `json:"tools"`
+	OutputSchema   *string                   `json:"output_schema"`
+	Parameters     *[]database.RoleParameter `json:"parameters"`
+	Default        bool                      `json:"default"` // Only admins can create default roles
+}
+
+// Returns the default roles and the own roles of the user, sorted by name
+func ListRoles(ctx context.Context, userID uuid.UUID) ([]RoleInfo, error) {
+	var roles []database.Role
+	err := database.DB.WithContext(ctx).Where("user_id IS NULL OR user_id = ?", userID).Order("name ASC").Find(&roles).Error
+	if err != nil {
+		return nil, err
+	}
+
+	infos := make([]RoleInfo, 0, len(roles))
+	for _, role := range roles {
+		infos = append(infos, toRoleInfo(role))
+	}
+	return infos, nil
+}
+
+// Returns a role the user can see (a default role or an own role)
+func GetRole(ctx context.Context, userID, roleID uuid.UUID) (RoleInfo, error) {
+	var role database.Role
+	err := database.DB.WithContext(ctx).Where("id = ? AND (user_id IS NULL OR user_id = ?)", roleID, userID).First(&role).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return RoleInfo{}, ErrRoleNotFound
+		}
+		return RoleInfo{}, err
+	}
+	return toRoleInfo(role), nil
+}
+
+// Creates an own role of the user, or a default role if an admin asks for it
+func CreateRole(ctx context.Context, userID uuid.UUID, input RoleInput) (RoleInfo, error) {
+	if input.Name == nil {
+		return RoleInfo{}, &ValidationError{Field: "name", Message: "is required"}
+	}
+
+	role := database.Role{ID: uuid.New(), UserID: &userID, CreatedAt: time.Now()}
+	if input.Default {
+		admin, err := users.IsAdmin(ctx, userID)
+		if err != nil {
+			return RoleInfo{}, err
+		}
+		if !admin {
+			return RoleInfo{}, ErrNotAllowed
+		}
+		role.UserID = nil
+	}
+
+	if err := applyInput(&role, input); err != nil {
+		return RoleInfo{}, err
+	}
+	if err := database.DB.WithContext(ctx).Create(&role).Error; err != nil {
+		return RoleInfo{}, uniqueError(err)
+	}
+	return toRoleInfo(role), nil
+}
+
+// Changes a role. Users can only change their own roles, default roles can only be changed by admins.
+// Chats keep the role snapshots they already have, so the change only affects new messages
+func UpdateRole(ctx context.Context, userID, roleID uuid.UUID, input RoleInput) (RoleInfo, error) {
+	role, err := getEditableRole(ctx, userID, roleID)
+	if err != nil {
+		return RoleInfo{}, err
+	}
+
+	if err := applyInput(&role, input); err != nil {
+		return RoleInfo{}, err
+	}
+	err = database.DB.WithContext(ctx).Model(&role).
+		Select("name", "system_prompt", "fallback_models", "tools", "output_schema", "parameters").
+		Updates(&role).Error
+	if err != nil {
+		return RoleInfo{}, uniqueError(err)
+	}
+	return toRoleInfo(role), nil
+}
+
+// Deletes a role with the same rules as UpdateRole. The role snapshots stay so old messages still show which role wrote them
+func DeleteRole(ctx context.Context, userID, roleID uuid.UUID) error {
+	role, err := getEditableRole(ctx, userID, roleID)
+	if err != nil {
+		return err
+	}
+	return database.DB.WithContext(ctx).Delete(&role).Error
+}
+
+// Returns the role if the user is allowed to change it
+func getEditableRole(ctx context.Context, userID, roleID uuid.UUID) (database.Role, error) {
+	var role database.Role
+	err := database.DB.WithContext(ctx).Where("id = ? AND (user_id IS NULL OR user_id = ?)", roleID, userID).First(&role).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return role, ErrRoleNotFound
+		}
+		return role, err
+	}
+
+	if role.UserID == nil {
+		admin, err := users.IsAdmin(ctx, userID)
+		if err != nil {
+			return role, err
+		}
+		if !admin {
+			return role, ErrNotAllowed
+		}
+	}
+	return role, nil
+}
+
+// Validates the input and copies it into the role
+func applyInput(role *database.Role, input RoleInput) error {
+	if input.Name != nil {
+		name := strings.TrimSpace(*input.Name)
+		if name == "" {
+			return &ValidationError{Field: "name", Message: "must not be empty"}
+		}
+		if len([]rune(name)) > config.MaxRoleNameLength {
+			return &ValidationError{Field: "name", Message: fmt.Sprintf("must not be longer than %d characters", config.MaxRoleNameLength)}
+		}
+		role.Name = name
+	}
+
+	if input.SystemPrompt != nil {
+		if len([]rune(*input.SystemPrompt)) > config.MaxSystemPromptLength {
+			return &ValidationError{Field: "system_prompt", Message: fmt.Sprintf("must not be longer than %d characters", config.MaxSystemPromptLength)}
+		}
+		role.SystemPrompt = *input.SystemPrompt
+	}
+
+	if input.FallbackModels != nil {
+		for _, model := range *input.FallbackModels {
+			if !ai.IsAvailableModel(model) {
+				return &ValidationError{Field: "fallback_models", Message: fmt.Sprintf("model %q is not available", model)}
+			}
+		}
+		role.FallbackModels = *input.FallbackModels
+	}
+
+	if input.Tools != nil {
+		for _, name := range *input.Tools {
+			if _, ok := ai.GetTool(name); !ok {
+				return &ValidationError{Field: "tools", Message: fmt.Sprintf("tool %q does not exist", name)}
+			}
+		}
+		role.Tools = *input.Tools
+	}
+
+	if input.OutputSchema != nil {
+		if *input.OutputSchema != "" {
+			if _, err := ai.ParseSchema(*input.OutputSchema); err != nil {
+				return &ValidationError{Field: "output_schema", Message: err.Error()}
+			}
+		}
+		role.OutputSchema = *input.OutputSchema
+	}
+
+	if input.Parameters != nil {
+		if err := validateParameters(*input.Parameters); err != nil {
+			return err
+		}
+		role.Parameters = *input.Parameters
+	}
+
+	// The placeholders of the system prompt have to match the parameters, no matter which of them changed
+	if input.SystemPrompt != nil || input.Parameters != nil {
+		return validateTemplate(role.SystemPrompt, role.Parameters)
+	}
+	return nil
+}
+
+// Converts the unique constraint error of the role name
+func uniqueError(err error) error {
+	if strings.Contains(err.Error(), "duplicate key") || strings.Contains(err.Error(), "unique constraint") {
+		return ErrNameTaken
+	}
+	return err
+}
+
+func emptyIfNil(values []string) []string {
+	if values == nil {
+		return []string{}
+	}
+	return values
+}
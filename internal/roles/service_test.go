@@ -0,0 +1,33 @@
+package roles
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/roly-backend/internal/database"
+)
+
+func TestApplyInput(t *testing.T) {
+	ptr := func(value string) *string { return &value }
+
+	role := database.Role{Name: "Pirate", SystemPrompt: "Talk like a pirate"}
+	if err := applyInput(&role, RoleInput{Name: ptr("  Captain  "), Tools: &[]string{"current_time"}}); err != nil {
+		t.Fatal(err)
+	}
+	if role.Name != "Captain" || role.SystemPrompt != "Talk like a pirate" || len(role.Tools) != 1 {
+		t.Errorf("unexpected role after update: %+v", role)
+	}
+
+	invalid := []RoleInput{
+		{Name: ptr(" ")},
+		{Tools: &[]string{"does_not_exist"}},
+		{FallbackModels: &[]string{"unknown-model"}},
+		{OutputSchema: ptr(`{"type": "text"}`)},
+	}
+	for _, input := range invalid {
+		var validationErr *ValidationError
+		if err := applyInput(&role, input); !errors.As(err, &validationErr) {
+			t.Errorf("expected a validation error for %+v, got %v", input, err)
+		}
+	}
+}
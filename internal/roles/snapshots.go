@@ -0,0 +1,79 @@
+package roles
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/roly-backend/internal/database"
+	"gorm.io/gorm"
+)
+
+// Database access of ResolveSnapshot. The functions are only replaced by the tests
+type snapshotStore struct {
+	role   func(ctx context.Context, roleID uuid.UUID) (database.Role, error)
+	newest func(ctx context.Context, roleID uuid.UUID, name, systemPrompt string) (database.RoleSnapshot, error) // gorm.ErrRecordNotFound if no snapshot matches
+	create func(ctx context.Context, snapshot *database.RoleSnapshot) error
+}
+
+var snapshots = snapshotStore{role: loadSnapshotRole, newest: newestSnapshot, create: createSnapshot}
+
+// Returns a snapshot of the current name and the system prompt of the role, rendered with the variables of the chat (see ChatVariables).
+// The newest snapshot of the role is reused if nothing changed since it was taken, so a chat doesn't get a new snapshot for every message
+func ResolveSnapshot(ctx context.Context, roleID uuid.UUID, variables map[string]string) (database.RoleSnapshot, error) {
+	return snapshots.resolve(ctx, roleID, variables)
+}
+
+func (s snapshotStore) resolve(ctx context.Context, roleID uuid.UUID, variables map[string]string) (database.RoleSnapshot, error) {
+	role, err := s.role(ctx, roleID)
+	if err != nil {
+		return database.RoleSnapshot{}, err
+	}
+
+	systemPrompt := RenderPrompt(role.SystemPrompt, role.Parameters, variables)
+
+	snapshot, err := s.newest(ctx, role.ID, role.Name, systemPrompt)
+	if err == nil {
+		return snapshot, nil
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return snapshot, err
+	}
+
+	snapshot = database.RoleSnapshot{
+		ID:           uuid.New(),
+		RoleID:       role.ID,
+		Name:         role.Name,
+		SystemPrompt: systemPrompt,
+		CreatedAt:    time.Now(),
+	}
+	err = s.create(ctx, &snapshot)
+	return snapshot, err
+}
+
+// Returns the role a snapshot is taken of
+func loadSnapshotRole(ctx context.Context, roleID uuid.UUID) (database.Role, error) {
+	var role database.Role
+	if err := database.DB.WithContext(ctx).First(&role, "id = ?", roleID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return role, ErrRoleNotFound
+		}
+		return role, err
+	}
+	return role, nil
+}
+
+// Returns the newest snapshot of the role with the name and the system prompt
+func newestSnapshot(ctx context.Context, roleID uuid.UUID, name, systemPrompt string) (database.RoleSnapshot, error) {
+	var snapshot database.RoleSnapshot
+	err := database.DB.WithContext(ctx).
+		Where("role_id = ? AND name = ? AND system_prompt = ?", roleID, name, systemPrompt).
+		Order("created_at DESC").
+		First(&snapshot).Error
+	return snapshot, err
+}
+
+func createSnapshot(ctx context.Context, snapshot *database.RoleSnapshot) error {
+	return database.DB.WithContext(ctx).Create(snapshot).Error
+}
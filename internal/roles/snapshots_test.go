@@ -0,0 +1,84 @@
+package roles
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/roly-backend/internal/database"
+	"gorm.io/gorm"
+)
+
+// Keeps the role and its snapshots in memory, the newest snapshot last
+func memorySnapshots(role *database.Role, saved *[]database.RoleSnapshot) snapshotStore {
+	return snapshotStore{
+		role: func(ctx context.Context, roleID uuid.UUID) (database.Role, error) {
+			if roleID != role.ID {
+				return database.Role{}, ErrRoleNotFound
+			}
+			return *role, nil
+		},
+		newest: func(ctx context.Context, roleID uuid.UUID, name, systemPrompt string) (database.RoleSnapshot, error) {
+			for i := len(*saved) - 1; i >= 0; i-- {
+				snapshot := (*saved)[i]
+				if snapshot.RoleID == roleID && snapshot.Name == name && snapshot.SystemPrompt == systemPrompt {
+					return snapshot, nil
+				}
+			}
+			return database.RoleSnapshot{}, gorm.ErrRecordNotFound
+		},
+		create: func(ctx context.Context, snapshot *database.RoleSnapshot) error {
+			*saved = append(*saved, *snapshot)
+			return nil
+		},
+	}
+}
+
+func TestResolveSnapshotReusesUnchangedRoles(t *testing.T) {
+	role := database.Role{ID: uuid.New(), Name: "Guide", SystemPrompt: "Show {{user_name}} around {{city}}", Parameters: []database.RoleParameter{{Name: "city", Default: "Berlin"}}}
+	var saved []database.RoleSnapshot
+	store := memorySnapshots(&role, &saved)
+	ctx := context.Background()
+	variables := map[string]string{"user_name": "Ada"}
+
+	first, err := store.resolve(ctx, role.ID, variables)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.SystemPrompt != "Show Ada around Berlin" || first.Name != "Guide" {
+		t.Errorf("expected the rendered prompt, got %+v", first)
+	}
+	again, _ := store.resolve(ctx, role.ID, variables)
+	if again.ID != first.ID || len(saved) != 1 {
+		t.Errorf("expected the snapshot to be reused, got %d snapshots", len(saved))
+	}
+
+	// Other variables of the chat render another prompt
+	other, _ := store.resolve(ctx, role.ID, map[string]string{"user_name": "Ada", "city": "Paris"})
+	if other.ID == first.ID || other.SystemPrompt != "Show Ada around Paris" {
+		t.Errorf("expected a new snapshot for the other city, got %+v", other)
+	}
+
+	// A renamed role gets a new snapshot, renaming it back reuses the old one
+	role.Name = "Tour guide"
+	renamed, _ := store.resolve(ctx, role.ID, variables)
+	if renamed.ID == first.ID || renamed.Name != "Tour guide" {
+		t.Errorf("expected a new snapshot after the rename, got %+v", renamed)
+	}
+	role.Name = "Guide"
+	if back, _ := store.resolve(ctx, role.ID, variables); back.ID != first.ID {
+		t.Errorf("expected the first snapshot to be reused, got %+v", back)
+	}
+	if len(saved) != 3 {
+		t.Errorf("expected three snapshots, got %d", len(saved))
+	}
+}
+
+func TestResolveSnapshotOfDeletedRole(t *testing.T) {
+	role := database.Role{ID: uuid.New()}
+	var saved []database.RoleSnapshot
+	if _, err := memorySnapshots(&role, &saved).resolve(context.Background(), uuid.New(), nil); !errors.Is(err, ErrRoleNotFound) || len(saved) != 0 {
+		t.Errorf("expected ErrRoleNotFound without a snapshot, got %v", err)
+	}
+}
@@ -0,0 +1,149 @@
+package roles
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/roly-backend/internal/config"
+	"github.com/roly-backend/internal/database"
+)
+
+// Variables every system prompt can use. user_name and language can be set by the chat, date is always the current day
+const (
+	VariableUserName = "user_name"
+	VariableDate     = "date"
+	VariableLanguage = "language"
+)
+
+var builtinVariables = []string{VariableUserName, VariableDate, VariableLanguage}
+
+// Everything between {{ and }} is a placeholder. Only names are allowed inside, there are no expressions
+var (
+	placeholderPattern  = regexp.MustCompile(`\{\{([^{}]*)\}\}`)
+	variableNamePattern = regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+)
+
+// Returns the names of the placeholders in the system prompt. Invalid placeholders are returned as they are written
+func placeholders(systemPrompt string) []string {
+	var names []string
+	for _, match := range placeholderPattern.FindAllStringSubmatch(systemPrompt, -1) {
+		name := strings.TrimSpace(match[1])
+		if !slices.Contains(names, name) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// Checks that every placeholder of the system prompt is a built-in variable or a parameter of the role
+func validateTemplate(systemPrompt string, parameters []database.RoleParameter) error {
+	for _, name := range placeholders(systemPrompt) {
+		if !variableNamePattern.MatchString(name) {
+			return &ValidationError{Field: "system_prompt", Message: fmt.Sprintf("placeholder {{%s}} is not a valid variable name", name)}
+		}
+		known := slices.Contains(builtinVariables, name) || slices.ContainsFunc(parameters, func(parameter database.RoleParameter) bool {
+			return parameter.Name == name
+		})
+		if !known {
+			return &ValidationError{Field: "system_prompt", Message: fmt.Sprintf("placeholder {{%s}} is neither a built-in variable nor a parameter of the role", name)}
+		}
+	}
+	return nil
+}
+
+// Checks the names and default values of the parameters of a role
+func validateParameters(parameters []database.RoleParameter) error {
+	if len(parameters) > config.MaxRoleParameters {
+		return &ValidationError{Field: "parameters", Message: fmt.Sprintf("a role can have at most %d parameters", config.MaxRoleParameters)}
+	}
+	seen := map[string]bool{}
+	for _, parameter := range parameters {
+		if !variableNamePattern.MatchString(parameter.Name) {
+			return &ValidationError{Field: "parameters", Message: fmt.Sprintf("%q is not a valid name, use lowercase letters, digits and _", parameter.Name)}
+		}
+		if slices.Contains(builtinVariables, parameter.Name) {
+			return &ValidationError{Field: "parameters", Message: fmt.Sprintf("%q is a built-in variable", parameter.Name)}
+		}
+		if seen[parameter.Name] {
+			return &ValidationError{Field: "parameters", Message: fmt.Sprintf("%q is used twice", parameter.Name)}
+		}
+		seen[parameter.Name] = true
+		if len([]rune(parameter.Default)) > config.MaxVariableLength {
+			return &ValidationError{Field: "parameters", Message: fmt.Sprintf("the default of %q must not be longer than %d characters", parameter.Name, config.MaxVariableLength)}
+		}
+	}
+	return nil
+}
+
+// Checks the variables a chat sets. Every variable has to be a parameter of one of the roles or a built-in variable the chat can set
+func ValidateVariables(variables map[string]string, parameters []database.RoleParameter) error {
+	for name, value := range variables {
+		known := name == VariableUserName || name == VariableLanguage || slices.ContainsFunc(parameters, func(parameter database.RoleParameter) bool {
+			return parameter.Name == name
+		})
+		if !known {
+			return &ValidationError{Field: "variables", Message: fmt.Sprintf("%q is not a parameter of the roles of the chat", name)}
+		}
+		if len([]rune(value)) > config.MaxVariableLength {
+			return &ValidationError{Field: "variables", Message: fmt.Sprintf("%q must not be longer than %d characters", name, config.MaxVariableLength)}
+		}
+	}
+	return nil
+}
+
+// Returns the values of the variables of a chat: the variables the chat sets, completed by the built-in variables
+func ChatVariables(ctx context.Context, chat database.Chat) (map[string]string, error) {
+	values := map[string]string{
+		VariableDate:     time.Now().Format(time.DateOnly),
+		VariableLanguage: config.DefaultLanguage,
+	}
+	for name, value := range chat.Variables {
+		values[name] = value
+	}
+
+	// Users don't have a name, so the beginning of the email address is the best guess
+	if values[VariableUserName] == "" {
+		var user database.User
+		if err := database.DB.WithContext(ctx).Select("email").First(&user, "id = ?", chat.UserID).Error; err != nil {
+			return nil, err
+		}
+		name, _, _ := strings.Cut(user.Email, "@")
+		values[VariableUserName] = name
+	}
+	return values, nil
+}
+
+// Replaces the placeholders of the system prompt with the values. Parameters without value get their default.
+// The values are inserted as plain text in a single pass, so a value that contains a placeholder is never rendered itself.
+// Values are set by the user, so they are reduced to a single line that can't start new sections of the prompt
+func RenderPrompt(systemPrompt string, parameters []database.RoleParameter, values map[string]string) string {
+	return placeholderPattern.ReplaceAllStringFunc(systemPrompt, func(placeholder string) string {
+		name := strings.TrimSpace(placeholder[2 : len(placeholder)-2])
+		if value, ok := values[name]; ok {
+			return singleLine(value)
+		}
+		for _, parameter := range parameters {
+			if parameter.Name == name {
+				return parameter.Default
+			}
+		}
+		// Placeholders that aren't variables stay as they are written
+		return placeholder
+	})
+}
+
+// Joins the lines of the value with spaces and removes control characters
+func singleLine(value string) string {
+	value = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) && !unicode.IsSpace(r) {
+			return -1
+		}
+		return r
+	}, value)
+	return strings.Join(strings.Fields(value), " ")
+}
@@ -2,6 +2,11 @@ package server
 
 import (
 	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/roly-backend/internal/chats"
+	"github.com/roly-backend/internal/messages"
+	"github.com/roly-backend/internal/quotas"
+	"github.com/roly-backend/internal/roles"
 	"github.com/roly-backend/internal/users"
 	"github.com/roly-backend/internal/webSocket"
 )
@@ -10,6 +15,11 @@ import (
 func SetupRouter() *gin.Engine {
 	ginEngine := gin.Default()
 
+	// Changes of chats that happen in the background are pushed to the open websocket connections of the user
+	chats.OnChatUpdated = func(userID uuid.UUID, chat chats.ChatInfo) {
+		webSocket.SendEvent(userID.String(), webSocket.EventChatUpdated, chat)
+	}
+
 	// Defines the available REST-API-Routes
 	api := ginEngine.Group("/api")
 	{
@@ -17,13 +27,32 @@ func SetupRouter() *gin.Engine {
 		api.POST("/login", users.LoginHandler)
 	}
 
-	// If we ever need a JWT protected HTTP Route, here is an example how to do the authentication since it is already implemented
-	// authGroup := ginEngine.Group("/api")
-	// authGroup.Use(users.JWTAuthMiddleware())
-	// authGroup.GET("/profile", func(c *gin.Context) {
-	// 	claims, _ := c.Get(string(users.UserContextKey))
-	// 	c.JSON(200, gin.H{"user": claims})
-	// })
+	// Defines the REST-API-Routes that need a valid JWT
+	authGroup := ginEngine.Group("/api")
+	authGroup.Use(users.JWTAuthMiddleware())
+	{
+		authGroup.GET("/quota", quotas.GetQuotaHandler)
+
+		authGroup.GET("/chats", chats.ListChatsHandler)
+		authGroup.POST("/chats", chats.CreateChatHandler)
+		authGroup.PATCH("/chats/:id", chats.UpdateChatHandler)
+		authGroup.DELETE("/chats/:id", chats.DeleteChatHandler)
+		authGroup.GET("/chats/:id/messages", messages.HistoryHandler)
+		authGroup.POST("/chats/:id/messages", messages.SendMessageHandler)
+		authGroup.GET("/chats/:id/branches", messages.ListBranchesHandler)
+		authGroup.POST("/messages/:id/regenerate", messages.RegenerateHandler)
+		authGroup.POST("/messages/:id/edit", messages.EditMessageHandler)
+		authGroup.POST("/messages/:id/activate", messages.ActivateMessageHandler)
+		// Debates are started and resumed over the websocket, which streams their turns
+		authGroup.GET("/chats/:id/debate", messages.GetDebateHandler)
+		authGroup.POST("/chats/:id/debate/pause", messages.PauseDebateHandler)
+
+		authGroup.GET("/roles", roles.ListRolesHandler)
+		authGroup.GET("/roles/:id", roles.GetRoleHandler)
+		authGroup.POST("/roles", roles.CreateRoleHandler)
+		authGroup.PATCH("/roles/:id", roles.UpdateRoleHandler)
+		authGroup.DELETE("/roles/:id", roles.DeleteRoleHandler)
+	}
 
 	// WebSocket-Route Gin provides the http.ResponseWriter und *http.Request
 	ginEngine.GET("/ws", func(c *gin.Context) {
@@ -9,6 +9,7 @@ import (
 
 	"github.com/gin-gonic/gin"
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
 	"github.com/roly-backend/internal/config"
 )
 
@@ -52,6 +53,19 @@ func JWTAuthMiddleware() gin.HandlerFunc {
 	}
 }
 
+// Returns the id of the user that was authenticated by the JWTAuthMiddleware
+func GetUserID(c *gin.Context) (uuid.UUID, error) {
+	value, ok := c.Get(string(UserContextKey))
+	if !ok {
+		return uuid.Nil, errors.New("no authenticated user in the context")
+	}
+	claims, ok := value.(*Claims)
+	if !ok {
+		return uuid.Nil, errors.New("invalid user claims in the context")
+	}
+	return uuid.Parse(claims.UserID)
+}
+
 // Extracts the "Bearer <token>" from the header
 func extractTokenFromHeader(r *http.Request) (string, error) {
 	authHeader := r.Header.Get("Authorization")
@@ -1,9 +1,11 @@
 package users
 
 import (
+	"context"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
 	"github.com/roly-backend/internal/config"
 	"github.com/roly-backend/internal/database"
 	"golang.org/x/crypto/bcrypt"
@@ -44,3 +46,12 @@ func getNewJWTToken(user database.User) (string, time.Time, error) {
 
 	return tokenString, expirationTime, nil
 }
+
+// Returns true if the user is an admin. The flag is read from the database so it can't be faked with an old JWT
+func IsAdmin(ctx context.Context, userID uuid.UUID) (bool, error) {
+	var user database.User
+	if err := database.DB.WithContext(ctx).Select("is_admin").First(&user, "id = ?", userID).Error; err != nil {
+		return false, err
+	}
+	return user.IsAdmin, nil
+}
@@ -1,15 +1,563 @@
 package webSocket
 
-import "fmt"
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/roly-backend/internal/ai"
+	"github.com/roly-backend/internal/chats"
+	"github.com/roly-backend/internal/config"
+	"github.com/roly-backend/internal/database"
+	"github.com/roly-backend/internal/messages"
+	"github.com/roly-backend/internal/moderation"
+	"github.com/roly-backend/internal/quotas"
+	"github.com/roly-backend/internal/roles"
+)
+
+// Registers the message types that are available over the websocket connection
+func init() {
+	RegisterHandler("ping", handlePing)
+	RegisterHandler("send_message", handleSendMessage)
+	RegisterHandler("generate", handleGenerate)
+	RegisterHandler("regenerate", handleRegenerate)
+	RegisterHandler("edit_message", handleEditMessage)
+	RegisterHandler("activate_message", handleActivateMessage)
+	RegisterHandler("branches", handleBranches)
+	RegisterHandler("cancel", handleCancel)
+	RegisterHandler("history", handleHistory)
+	RegisterHandler("models", handleModels)
+	RegisterHandler("chat_cost", handleChatCost)
+	RegisterHandler("quota", handleQuota)
+	RegisterHandler("start_debate", handleStartDebate)
+	RegisterHandler("resume_debate", handleResumeDebate)
+	RegisterHandler("pause_debate", handlePauseDebate)
+	RegisterHandler("debate", handleDebate)
+}
 
 // Handles the incoming messages and what to do with them (basically like an api endpoint)
 func handleMessage(conn *Connection, msg []byte) {
+	env, err := decodeEnvelope(msg)
+	if err != nil {
+		conn.sendError(env.ID, err)
+		return
+	}
 
-	// Just as an example a echo
-	select {
-	case <-conn.ctx.Done():
+	handler, ok := getHandler(env.Type)
+	if !ok {
+		conn.sendError(env.ID, NewFrameErr(ErrCodeUnknownType, "unknown message type: "+env.Type))
 		return
-	case conn.sendChannel <- fmt.Appendf(nil, "%s", msg):
-		// everything is fine
 	}
+
+	result, err := handler(conn, env)
+	if err != nil {
+		// Only errors that aren't meant for the client are logged as errors
+		var frameErr *FrameErr
+		if !errors.As(err, &frameErr) {
+			slog.LogAttrs(context.Background(), slog.LevelError, "Error handling websocket message",
+				slog.String("user_id", conn.UserID),
+				slog.String("type", env.Type),
+				slog.String("id", env.ID),
+				slog.String("error", err.Error()),
+			)
+		}
+		conn.sendError(env.ID, err)
+		return
+	}
+
+	if result != nil {
+		conn.sendFrame(FrameResult, env.ID, result)
+	}
+}
+
+// Answers a ping so the client can check if the connection is still alive
+func handlePing(conn *Connection, env Envelope) (any, error) {
+	return map[string]string{"message": "pong"}, nil
+}
+
+// Saves a message of the user in a chat and streams the answer of the AI like handleGenerate.
+// As soon as the message is saved a message_saved frame with it is sent. In group chats every role that answers
+// gets its own answering, delta and done frames, one role after another
+func handleSendMessage(conn *Connection, env Envelope) (any, error) {
+	var payload struct {
+		ChatID  uuid.UUID `json:"chat_id"`
+		Content string    `json:"content"`
+		Model   string    `json:"model"`
+	}
+	if err := decodePayload(env, &payload); err != nil {
+		return nil, err
+	}
+
+	userID, err := uuid.Parse(conn.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, done, err := conn.startRequest(env.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	if _, err := messages.SendMessage(ctx, userID, payload.ChatID, payload.Content, payload.Model, conn.generationSink(env.ID)); err != nil {
+		return nil, messageError(err)
+	}
+	return nil, nil
+}
+
+// Lets the AI answer the last user message of a chat and streams the answer as delta frames to the client.
+// An answering frame with the role comes first. When the answer is saved the sink sends a done frame with the message and the token usage
+func handleGenerate(conn *Connection, env Envelope) (any, error) {
+	var payload struct {
+		ChatID uuid.UUID `json:"chat_id"`
+		Model  string    `json:"model"`
+	}
+	if err := decodePayload(env, &payload); err != nil {
+		return nil, err
+	}
+
+	userID, err := uuid.Parse(conn.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Every generation gets its own context so the client can cancel it with a cancel message
+	ctx, done, err := conn.startRequest(env.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	if _, err := messages.GenerateReply(ctx, userID, payload.ChatID, payload.Model, conn.generationSink(env.ID)); err != nil {
+		return nil, messageError(err)
+	}
+	return nil, nil
+}
+
+// Lets the AI answer again instead of an earlier answer and streams the new answer like handleGenerate.
+// The old answer stays as an alternative the client can switch back to
+func handleRegenerate(conn *Connection, env Envelope) (any, error) {
+	var payload struct {
+		MessageID uuid.UUID `json:"message_id"`
+		Model     string    `json:"model"`
+	}
+	if err := decodePayload(env, &payload); err != nil {
+		return nil, err
+	}
+
+	userID, err := uuid.Parse(conn.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, done, err := conn.startRequest(env.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	if _, err := messages.Regenerate(ctx, userID, payload.MessageID, payload.Model, conn.generationSink(env.ID)); err != nil {
+		return nil, messageError(err)
+	}
+	return nil, nil
+}
+
+// Saves a new version of an earlier message of the user as a new branch and streams the answer like handleSendMessage
+func handleEditMessage(conn *Connection, env Envelope) (any, error) {
+	var payload struct {
+		MessageID uuid.UUID `json:"message_id"`
+		Content   string    `json:"content"`
+		Model     string    `json:"model"`
+	}
+	if err := decodePayload(env, &payload); err != nil {
+		return nil, err
+	}
+
+	userID, err := uuid.Parse(conn.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, done, err := conn.startRequest(env.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	if _, err := messages.EditMessage(ctx, userID, payload.MessageID, payload.Content, payload.Model, conn.generationSink(env.ID)); err != nil {
+		return nil, messageError(err)
+	}
+	return nil, nil
+}
+
+// Returns the branches of a chat
+func handleBranches(conn *Connection, env Envelope) (any, error) {
+	var payload struct {
+		ChatID uuid.UUID `json:"chat_id"`
+	}
+	if err := decodePayload(env, &payload); err != nil {
+		return nil, err
+	}
+
+	userID, err := uuid.Parse(conn.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	branches, err := messages.ListBranches(conn.ctx, userID, payload.ChatID)
+	if err != nil {
+		return nil, messageError(err)
+	}
+	return map[string]any{"branches": branches}, nil
+}
+
+// Makes an alternative of a message the one that is shown in the chat. Activating the newest message of a branch switches to the branch
+func handleActivateMessage(conn *Connection, env Envelope) (any, error) {
+	var payload struct {
+		MessageID uuid.UUID `json:"message_id"`
+	}
+	if err := decodePayload(env, &payload); err != nil {
+		return nil, err
+	}
+
+	userID, err := uuid.Parse(conn.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := messages.ActivateMessage(conn.ctx, userID, payload.MessageID); err != nil {
+		return nil, messageError(err)
+	}
+	return map[string]any{"activated": payload.MessageID}, nil
+}
+
+// Starts a debate between two roles in a new chat. The topic is sent as message_saved frame (with the id of the new chat),
+// every turn is streamed like an answer of handleSendMessage. The result frame with the debate is sent when the debate is finished or paused.
+// Canceling the request pauses the debate too
+func handleStartDebate(conn *Connection, env Envelope) (any, error) {
+	var payload messages.NewDebate
+	if err := decodePayload(env, &payload); err != nil {
+		return nil, err
+	}
+
+	userID, err := uuid.Parse(conn.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, done, err := conn.startRequest(env.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	debate, err := messages.StartDebate(ctx, userID, payload, conn.generationSink(env.ID))
+	if err != nil {
+		return nil, messageError(err)
+	}
+	return debate, nil
+}
+
+// Continues a paused debate and streams the next turns like handleStartDebate
+func handleResumeDebate(conn *Connection, env Envelope) (any, error) {
+	var payload struct {
+		ChatID uuid.UUID `json:"chat_id"`
+		Model  string    `json:"model"`
+	}
+	if err := decodePayload(env, &payload); err != nil {
+		return nil, err
+	}
+
+	userID, err := uuid.Parse(conn.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, done, err := conn.startRequest(env.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	debate, err := messages.ResumeDebate(ctx, userID, payload.ChatID, payload.Model, conn.generationSink(env.ID))
+	if err != nil {
+		return nil, messageError(err)
+	}
+	return debate, nil
+}
+
+// Pauses a running debate, no matter which connection started it
+func handlePauseDebate(conn *Connection, env Envelope) (any, error) {
+	var payload struct {
+		ChatID uuid.UUID `json:"chat_id"`
+	}
+	if err := decodePayload(env, &payload); err != nil {
+		return nil, err
+	}
+
+	userID, err := uuid.Parse(conn.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	debate, err := messages.PauseDebate(conn.ctx, userID, payload.ChatID)
+	if err != nil {
+		return nil, messageError(err)
+	}
+	return debate, nil
+}
+
+// Returns the debate of a chat
+func handleDebate(conn *Connection, env Envelope) (any, error) {
+	var payload struct {
+		ChatID uuid.UUID `json:"chat_id"`
+	}
+	if err := decodePayload(env, &payload); err != nil {
+		return nil, err
+	}
+
+	userID, err := uuid.Parse(conn.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	debate, err := messages.GetDebate(conn.ctx, userID, payload.ChatID)
+	if err != nil {
+		return nil, messageError(err)
+	}
+	return debate, nil
+}
+
+// Payload of the done frame after an AI answer is finished
+type doneFrame struct {
+	MessageID      uuid.UUID       `json:"message_id"`
+	RoleSnapshotID uuid.UUID       `json:"role_snapshot_id"` // The role that answered
+	Kind           string          `json:"kind"`
+	Content        string          `json:"content"`
+	Data           json.RawMessage `json:"data,omitempty"` // Typed JSON answer of roles with an output schema
+	Truncated      bool            `json:"truncated"`
+	Flagged        bool            `json:"flagged"`         // The moderation annotated the answer
+	Model          string          `json:"model"`           // The model that answered
+	Requested      string          `json:"requested_model"` // Differs from model if a fallback model had to answer
+	Usage          ai.Usage        `json:"usage"`
+	Cost           float64         `json:"cost"`                           // US dollars
+	Excluded       []uuid.UUID     `json:"excluded_message_ids,omitempty"` // Old messages that didn't fit into the context of the AI
+}
+
+func newDoneFrame(reply messages.Reply) doneFrame {
+	return doneFrame{
+		MessageID:      reply.Message.ID,
+		RoleSnapshotID: reply.Message.RoleSnapshotID,
+		Kind:           reply.Message.Kind,
+		Content:        reply.Message.Content,
+		Data:           reply.Data,
+		Truncated:      reply.Message.Truncated,
+		Flagged:        reply.Message.Flagged,
+		Model:          reply.Model,
+		Requested:      reply.RequestedModel,
+		Usage:          reply.Usage,
+		Cost:           reply.Message.Cost,
+		Excluded:       reply.ExcludedMessageIDs,
+	}
+}
+
+// Cancels a running request (for example an AI generation) of this connection by its correlation id
+func handleCancel(conn *Connection, env Envelope) (any, error) {
+	var payload struct {
+		ID string `json:"id"`
+	}
+	if err := decodePayload(env, &payload); err != nil {
+		return nil, err
+	}
+	if payload.ID == "" {
+		return nil, NewFrameErr(ErrCodeInvalidPayload, "id of the request to cancel is missing")
+	}
+
+	if !conn.cancelRequest(payload.ID) {
+		return nil, NewFrameErr(ErrCodeNotFound, "No running request with this id")
+	}
+	return map[string]any{"canceled": payload.ID}, nil
+}
+
+// Returns a page of the messages of a chat, like GET /api/chats/:id/messages
+func handleHistory(conn *Connection, env Envelope) (any, error) {
+	var payload struct {
+		ChatID uuid.UUID `json:"chat_id"`
+		Before string    `json:"before"`
+		Limit  int       `json:"limit"`
+	}
+	if err := decodePayload(env, &payload); err != nil {
+		return nil, err
+	}
+
+	userID, err := uuid.Parse(conn.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	page, err := messages.LoadHistory(conn.ctx, userID, payload.ChatID, payload.Before, payload.Limit)
+	if err != nil {
+		return nil, messageError(err)
+	}
+	return page, nil
+}
+
+// Returns all models the client can choose from with their prices
+func handleModels(conn *Connection, env Envelope) (any, error) {
+	return map[string]any{
+		"default": ai.DefaultModel(),
+		"models":  ai.Models(),
+	}, nil
+}
+
+// Returns the token usage and costs of a chat
+func handleChatCost(conn *Connection, env Envelope) (any, error) {
+	var payload struct {
+		ChatID uuid.UUID `json:"chat_id"`
+	}
+	if err := decodePayload(env, &payload); err != nil {
+		return nil, err
+	}
+
+	userID, err := uuid.Parse(conn.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	cost, err := messages.GetChatCost(conn.ctx, userID, payload.ChatID)
+	if err != nil {
+		return nil, messageError(err)
+	}
+	return cost, nil
+}
+
+// Returns the usage limits of the user and how much of them is left
+func handleQuota(conn *Connection, env Envelope) (any, error) {
+	userID, err := uuid.Parse(conn.UserID)
+	if err != nil {
+		return nil, err
+	}
+	return quotas.GetStatus(conn.ctx, userID)
+}
+
+// Returns a sink that streams everything that happens while an answer is generated to the client
+func (conn *Connection) generationSink(id string) messages.Sink {
+	send := func(frameType string, payload any) error {
+		if !conn.sendFrame(frameType, id, payload) {
+			return errConnectionClosed
+		}
+		return nil
+	}
+
+	return messages.Sink{
+		UserMessage: func(message database.Message) error {
+			return send(FrameMessageSaved, messages.ToMessageInfo(message))
+		},
+		Answering: func(snapshot database.RoleSnapshot) error {
+			return send(FrameAnswering, messages.SnapshotInfo{ID: snapshot.ID, RoleID: snapshot.RoleID, Name: snapshot.Name})
+		},
+		Delta: func(delta string) error {
+			return send(FrameDelta, map[string]string{"content": delta})
+		},
+		ToolCall: func(message database.Message) error {
+			return send(FrameToolCall, toolFrame{MessageID: message.ID, CallID: message.ToolCallID, Name: message.ToolName, Content: message.Content})
+		},
+		ToolResult: func(message database.Message) error {
+			return send(FrameToolResult, toolFrame{MessageID: message.ID, CallID: message.ToolCallID, Name: message.ToolName, Content: message.Content})
+		},
+		Answered: func(reply messages.Reply) error {
+			return send(FrameDone, newDoneFrame(reply))
+		},
+	}
+}
+
+// Payload of the tool_call and tool_result frames
+type toolFrame struct {
+	MessageID uuid.UUID `json:"message_id"`
+	CallID    string    `json:"call_id"`
+	Name      string    `json:"name"`
+	Content   string    `json:"content"` // Arguments of the call or the result of the tool
+}
+
+var errConnectionClosed = errors.New("websocket connection was closed")
+
+// Converts the errors of the messages package into errors for the client
+func messageError(err error) error {
+	var quotaErr *quotas.ExceededError
+	var aiErr *ai.Error
+	var blockedErr *moderation.BlockedError
+	var validationErr *roles.ValidationError
+	switch {
+	case errors.As(err, &validationErr):
+		return NewFrameErr(ErrCodeInvalidPayload, validationErr.Error())
+	case errors.As(err, &blockedErr):
+		if blockedErr.Stage == moderation.StageOutput {
+			// The client already got parts of the answer as delta frames and has to remove them
+			return NewFrameErr(ErrCodeContentBlocked, "The answer of the AI was blocked by the moderation")
+		}
+		return NewFrameErr(ErrCodeContentBlocked, "Your message was blocked by the moderation")
+	case errors.As(err, &quotaErr):
+		return NewFrameErr(ErrCodeQuotaExceeded, fmt.Sprintf("Your %s %s limit is used up. It resets at %s",
+			quotaErr.Period, quotaErr.Limit, quotaErr.ResetAt.Format(time.RFC3339)))
+	case errors.Is(err, context.Canceled):
+		return NewFrameErr(ErrCodeCanceled, "Request was canceled before an answer was generated")
+	case errors.As(err, &aiErr):
+		return aiError(aiErr)
+	case errors.Is(err, messages.ErrChatNotFound):
+		return NewFrameErr(ErrCodeNotFound, "Chat not found")
+	case errors.Is(err, messages.ErrNothingToAnswer):
+		return NewFrameErr(ErrCodeBadRequest, "The last message of the chat is not a user message")
+	case errors.Is(err, messages.ErrModelUnavailable):
+		return NewFrameErr(ErrCodeBadRequest, "Model is not available")
+	case errors.Is(err, ai.ErrInvalidStructuredOutput):
+		return NewFrameErr(ErrCodeInvalidOutput, "The AI didn't manage to answer in the format of the role")
+	case errors.Is(err, messages.ErrContextTooLarge):
+		return NewFrameErr(ErrCodeBadRequest, "The message is too long for the model")
+	case errors.Is(err, messages.ErrMessageNotFound):
+		return NewFrameErr(ErrCodeNotFound, "Message not found")
+	case errors.Is(err, messages.ErrNotAnAnswer):
+		return NewFrameErr(ErrCodeBadRequest, "Only answers of the AI can be regenerated")
+	case errors.Is(err, messages.ErrNotAUserMessage):
+		return NewFrameErr(ErrCodeBadRequest, "Only messages of the user can be edited")
+	case errors.Is(err, messages.ErrInvalidCursor):
+		return NewFrameErr(ErrCodeInvalidPayload, "Invalid cursor")
+	case errors.Is(err, messages.ErrEmptyMessage):
+		return NewFrameErr(ErrCodeInvalidPayload, "Message is empty")
+	case errors.Is(err, messages.ErrMessageTooLong):
+		return NewFrameErr(ErrCodeInvalidPayload, fmt.Sprintf("Message must not be longer than %d characters", config.MaxMessageLength))
+	case errors.Is(err, messages.ErrChatHasNoRole):
+		return NewFrameErr(ErrCodeBadRequest, "The chat has no role")
+	case errors.Is(err, messages.ErrDebateNotFound):
+		return NewFrameErr(ErrCodeNotFound, "Debate not found")
+	case errors.Is(err, messages.ErrDebateRunning):
+		return NewFrameErr(ErrCodeBadRequest, "The debate is already running")
+	case errors.Is(err, messages.ErrDebateFinished):
+		return NewFrameErr(ErrCodeBadRequest, "The debate is already finished")
+	case errors.Is(err, messages.ErrDebateRoles):
+		return NewFrameErr(ErrCodeInvalidPayload, "A debate needs two different roles")
+	case errors.Is(err, messages.ErrDebateTurns):
+		return NewFrameErr(ErrCodeInvalidPayload, fmt.Sprintf("turns has to be between 1 and %d", config.MaxDebateTurns))
+	case errors.Is(err, chats.ErrRoleNotFound):
+		return NewFrameErr(ErrCodeNotFound, "Role not found")
+	}
+	return err
+}
+
+// Converts an error of the AI into an error for the client
+func aiError(err *ai.Error) error {
+	switch err.Kind {
+	case ai.ErrKindRateLimited:
+		return NewFrameErr(ErrCodeAIRateLimited, "The AI is busy right now, please try again in a moment")
+	case ai.ErrKindUnavailable, ai.ErrKindCircuitOpen:
+		return NewFrameErr(ErrCodeAIUnavailable, "The AI is not available right now, please try again later")
+	case ai.ErrKindInvalidRequest:
+		return NewFrameErr(ErrCodeAIRejected, "The AI rejected the request")
+	case ai.ErrKindCanceled:
+		return NewFrameErr(ErrCodeCanceled, "Request was canceled before an answer was generated")
+	}
+	return err
 }
@@ -0,0 +1,144 @@
+package webSocket
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/roly-backend/internal/ai"
+	"github.com/roly-backend/internal/database"
+	"github.com/roly-backend/internal/messages"
+	"github.com/roly-backend/internal/moderation"
+)
+
+// Returns the frames that were sent to the connection so far
+func sentFrames(t *testing.T, conn *Connection) []Envelope {
+	t.Helper()
+	var frames []Envelope
+	for {
+		select {
+		case msg := <-conn.sendChannel:
+			var env Envelope
+			if err := json.Unmarshal(msg, &env); err != nil {
+				t.Fatalf("frame is not a valid envelope: %s", msg)
+			}
+			frames = append(frames, env)
+		default:
+			return frames
+		}
+	}
+}
+
+func TestGenerationSinkStreamsFrames(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	conn := &Connection{ctx: ctx, cancel: cancel, UserID: "user-1", sendChannel: make(chan []byte, 16)}
+	sink := conn.generationSink("req-1")
+
+	// The answer is streamed like generateReply streams it
+	snapshot := database.RoleSnapshot{ID: uuid.New(), RoleID: uuid.New(), Name: "Pirate"}
+	if err := sink.Answering(snapshot); err != nil {
+		t.Fatal(err)
+	}
+	response, err := ai.NewFakeProvider("Ahoy there matey").Stream(ctx, ai.Request{Model: "gpt-4.1-nano"}, sink.Delta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply := messages.Reply{
+		Message: database.Message{ID: uuid.New(), RoleSnapshotID: snapshot.ID, Kind: database.MessageKindText, Content: response.Content},
+		Model:   "gpt-4.1-nano",
+		Usage:   response.Usage,
+	}
+	if err := sink.Answered(reply); err != nil {
+		t.Fatal(err)
+	}
+
+	frames := sentFrames(t, conn)
+	expectedTypes := []string{FrameAnswering, FrameDelta, FrameDelta, FrameDelta, FrameDone}
+	if len(frames) != len(expectedTypes) {
+		t.Fatalf("expected %d frames, got %+v", len(expectedTypes), frames)
+	}
+	content := ""
+	for i, frame := range frames {
+		if frame.Type != expectedTypes[i] || frame.ID != "req-1" {
+			t.Errorf("frame %d: expected %s for req-1, got %s for %s", i, expectedTypes[i], frame.Type, frame.ID)
+		}
+		if frame.Type == FrameDelta {
+			var delta map[string]string
+			json.Unmarshal(frame.Payload, &delta)
+			content += delta["content"]
+		}
+	}
+	if content != "Ahoy there matey" {
+		t.Errorf("expected the deltas to add up to the answer, got %q", content)
+	}
+
+	var done doneFrame
+	if err := json.Unmarshal(frames[4].Payload, &done); err != nil {
+		t.Fatal(err)
+	}
+	if done.MessageID != reply.Message.ID || done.RoleSnapshotID != snapshot.ID || done.Content != "Ahoy there matey" || done.Truncated || done.Usage != response.Usage {
+		t.Errorf("unexpected done frame %+v", done)
+	}
+}
+
+func TestGenerationSinkStopsOnClosedConnection(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	conn := &Connection{ctx: ctx, cancel: cancel, UserID: "user-1", sendChannel: make(chan []byte)}
+	cancel()
+
+	if err := conn.generationSink("req-1").Delta("Ahoy"); !errors.Is(err, errConnectionClosed) {
+		t.Errorf("expected errConnectionClosed, got %v", err)
+	}
+}
+
+func TestMessageErrorCodes(t *testing.T) {
+	tests := []struct {
+		err  error
+		code string
+	}{
+		{&moderation.BlockedError{Stage: moderation.StageOutput}, ErrCodeContentBlocked},
+		{context.Canceled, ErrCodeCanceled},
+		{&ai.Error{Kind: ai.ErrKindRateLimited}, ErrCodeAIRateLimited},
+		{messages.ErrChatNotFound, ErrCodeNotFound},
+		{messages.ErrEmptyMessage, ErrCodeInvalidPayload},
+	}
+	for _, test := range tests {
+		var frameErr *FrameErr
+		if err := messageError(test.err); !errors.As(err, &frameErr) || frameErr.Code != test.code {
+			t.Errorf("expected %s for %v, got %v", test.code, test.err, err)
+		}
+	}
+}
+
+func TestCancelRequest(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	conn := &Connection{ctx: ctx, cancel: cancel, UserID: "user-1", sendChannel: make(chan []byte, 1), requests: map[string]context.CancelFunc{}}
+
+	requestCtx, done, err := conn.startRequest("req-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer done()
+	if _, _, err := conn.startRequest("req-1"); err == nil {
+		t.Error("expected a second request with the same id to be rejected")
+	}
+
+	if _, err := handleCancel(conn, Envelope{Type: "cancel", Payload: json.RawMessage(`{"id": "req-1"}`)}); err != nil {
+		t.Fatal(err)
+	}
+	if requestCtx.Err() == nil {
+		t.Error("expected the request to be canceled")
+	}
+	if ctx.Err() != nil {
+		t.Error("expected the connection to stay open")
+	}
+
+	var frameErr *FrameErr
+	if _, err := handleCancel(conn, Envelope{Type: "cancel", Payload: json.RawMessage(`{"id": "req-1"}`)}); !errors.As(err, &frameErr) || frameErr.Code != ErrCodeNotFound {
+		t.Errorf("expected not_found for a request that isn't running anymore, got %v", err)
+	}
+}
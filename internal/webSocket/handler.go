@@ -28,6 +28,9 @@ type Connection struct {
 	cancel      context.CancelFunc
 	UserID      string
 	cleanupOnce sync.Once // Ensures that cleanup is only executed once, even if multiple goroutines call it concurrently on the same connection.
+
+	requestsMutex sync.Mutex
+	requests      map[string]context.CancelFunc // Cancel functions of the requests that are still running, stored by their correlation id
 }
 
 // Handles new incoming websocket connections
@@ -37,8 +40,6 @@ func HandleWebSocket(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		slog.LogAttrs(context.Background(), slog.LevelInfo, "Unauthorized websocket connection rejected",
 			slog.String("error", err.Error()),
-			slog.String("user_id", claims.UserID),
-			slog.String("email", claims.Email),
 		)
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
@@ -66,6 +67,7 @@ func HandleWebSocket(w http.ResponseWriter, r *http.Request) {
 		ctx:         ctx,
 		cancel:      cancel,
 		UserID:      claims.UserID,
+		requests:    make(map[string]context.CancelFunc),
 	}
 
 	slog.LogAttrs(context.Background(), slog.LevelInfo, "Websocket connection successfully established",
@@ -73,6 +75,8 @@ func HandleWebSocket(w http.ResponseWriter, r *http.Request) {
 		slog.String("email", claims.Email),
 	)
 
+	registerConnection(conn)
+
 	// Starts the Read and Write Loops
 	go readLoop(conn)
 	go writeLoop(conn)
@@ -135,12 +139,7 @@ func writeLoop(conn *Connection) {
 		select {
 		case <-conn.ctx.Done():
 			return
-		case msg, ok := <-conn.sendChannel:
-			// if "ok" is true, then the channel has received a message
-			// if "ok" is fale, then the channel was closed
-			if !ok {
-				return
-			}
+		case msg := <-conn.sendChannel:
 			if config.DebugMode {
 				slog.LogAttrs(context.Background(), slog.LevelDebug, "New outgoing websocket message",
 					slog.String("user_id", conn.UserID),
@@ -165,11 +164,50 @@ func writeLoop(conn *Connection) {
 // Closes and deletes connection correctly after client disconnected
 func cleanup(conn *Connection) {
 	conn.cleanupOnce.Do(func() {
+		unregisterConnection(conn)
 		conn.cancel()
 		conn.ws.Close()
-		close(conn.sendChannel)
+		// The send channel is never closed: requests that are still running can send their last frames at any time,
+		// and a send on a closed channel would crash the server. The write loop stops with the context instead
 		slog.LogAttrs(context.Background(), slog.LevelInfo, "Websocket connection was closed",
 			slog.String("user_id", conn.UserID),
 		)
 	})
 }
+
+// Creates a context for a single request so it can be canceled without closing the whole connection.
+// The returned function has to be called when the request is finished
+func (conn *Connection) startRequest(id string) (context.Context, func(), error) {
+	ctx, cancel := context.WithCancel(conn.ctx)
+	if id == "" {
+		// Requests without correlation id can't be canceled by the client
+		return ctx, cancel, nil
+	}
+
+	conn.requestsMutex.Lock()
+	defer conn.requestsMutex.Unlock()
+	if _, exists := conn.requests[id]; exists {
+		cancel()
+		return nil, nil, NewFrameErr(ErrCodeBadRequest, "a request with this id is already running")
+	}
+	conn.requests[id] = cancel
+
+	return ctx, func() {
+		conn.requestsMutex.Lock()
+		delete(conn.requests, id)
+		conn.requestsMutex.Unlock()
+		cancel()
+	}, nil
+}
+
+// Cancels the running request with the given correlation id. Returns false if no such request is running
+func (conn *Connection) cancelRequest(id string) bool {
+	conn.requestsMutex.Lock()
+	defer conn.requestsMutex.Unlock()
+	cancel, ok := conn.requests[id]
+	if ok {
+		cancel()
+		delete(conn.requests, id)
+	}
+	return ok
+}
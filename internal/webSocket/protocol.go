@@ -0,0 +1,186 @@
+package webSocket
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+)
+
+// Version of the JSON envelope protocol. Clients have to send this version (or leave it out) in every message
+const ProtocolVersion = 1
+
+// Frame types the server sends back to the client
+const (
+	FrameResult = "result"
+	FrameError  = "error"
+	FrameDelta  = "delta" // A piece of an AI answer that is still generated
+	FrameDone   = "done"  // The AI answer is finished
+
+	FrameAnswering = "answering" // A role starts to answer, the following delta frames belong to it (several roles answer one after another in group chats)
+
+	FrameMessageSaved = "message_saved" // The message of the user was saved
+
+	FrameToolCall   = "tool_call"   // The AI called a server side tool
+	FrameToolResult = "tool_result" // The tool returned its result
+
+	EventChatUpdated = "chat_updated" // Pushed to every connection of the user when a chat changed (for example a generated title)
+)
+
+// Error codes that are sent to the client inside an error frame
+const (
+	ErrCodeBadRequest     = "bad_request"
+	ErrCodeUnsupported    = "unsupported_version"
+	ErrCodeUnknownType    = "unknown_type"
+	ErrCodeInternal       = "internal_error"
+	ErrCodeNotFound       = "not_found"
+	ErrCodeInvalidPayload = "invalid_payload"
+	ErrCodeNotAllowed     = "not_allowed"
+	ErrCodeCanceled       = "canceled"
+	ErrCodeQuotaExceeded  = "quota_exceeded"
+	ErrCodeAIRateLimited  = "ai_rate_limited"
+	ErrCodeAIUnavailable  = "ai_unavailable"
+	ErrCodeAIRejected     = "ai_rejected"
+	ErrCodeInvalidOutput  = "invalid_output"
+	ErrCodeContentBlocked = "content_blocked"
+)
+
+// Envelope is the JSON structure of every message that goes over the websocket connection.
+// The ID is chosen by the client and sent back in every frame that belongs to that request (correlation id)
+type Envelope struct {
+	Version int             `json:"v"`
+	Type    string          `json:"type"`
+	ID      string          `json:"id,omitempty"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// Payload of an error frame
+type ErrorPayload struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// FrameErr can be returned by a handler so the client gets a specific error code instead of a generic internal error
+type FrameErr struct {
+	Code    string
+	Message string
+}
+
+func (e *FrameErr) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+// Creates a new FrameErr
+func NewFrameErr(code, message string) *FrameErr {
+	return &FrameErr{Code: code, Message: message}
+}
+
+// HandlerFunc handles one message type. The returned value is sent as payload of the result frame.
+// If the handler already sent everything it wanted to send it can return nil as result
+type HandlerFunc func(conn *Connection, env Envelope) (any, error)
+
+var (
+	handlersMutex sync.RWMutex
+	handlers      = map[string]HandlerFunc{}
+)
+
+// Registers a handler for a message type. Registering the same type twice overwrites the old handler
+func RegisterHandler(msgType string, handler HandlerFunc) {
+	handlersMutex.Lock()
+	defer handlersMutex.Unlock()
+	handlers[msgType] = handler
+}
+
+// Returns the handler that is registered for the message type
+func getHandler(msgType string) (HandlerFunc, bool) {
+	handlersMutex.RLock()
+	defer handlersMutex.RUnlock()
+	handler, ok := handlers[msgType]
+	return handler, ok
+}
+
+// Decodes an incoming message into an envelope and checks that it is valid
+func decodeEnvelope(msg []byte) (Envelope, error) {
+	var env Envelope
+	if err := json.Unmarshal(msg, &env); err != nil {
+		return env, NewFrameErr(ErrCodeBadRequest, "message is not a valid JSON envelope")
+	}
+	// A missing version is treated as the current version
+	if env.Version == 0 {
+		env.Version = ProtocolVersion
+	}
+	if env.Version != ProtocolVersion {
+		return env, NewFrameErr(ErrCodeUnsupported, fmt.Sprintf("protocol version %d is not supported", env.Version))
+	}
+	if env.Type == "" {
+		return env, NewFrameErr(ErrCodeBadRequest, "message type is missing")
+	}
+	return env, nil
+}
+
+// Decodes the payload of an envelope into the given struct
+func decodePayload(env Envelope, target any) error {
+	if len(env.Payload) == 0 {
+		return NewFrameErr(ErrCodeInvalidPayload, "payload is missing")
+	}
+	if err := json.Unmarshal(env.Payload, target); err != nil {
+		return NewFrameErr(ErrCodeInvalidPayload, err.Error())
+	}
+	return nil
+}
+
+// Builds an outgoing frame with the given type, correlation id and payload
+func encodeFrame(frameType, id string, payload any) ([]byte, error) {
+	frame := struct {
+		Version int    `json:"v"`
+		Type    string `json:"type"`
+		ID      string `json:"id,omitempty"`
+		Payload any    `json:"payload,omitempty"`
+	}{
+		Version: ProtocolVersion,
+		Type:    frameType,
+		ID:      id,
+		Payload: payload,
+	}
+	return json.Marshal(frame)
+}
+
+// Converts any error into the payload of an error frame. Errors that are not a FrameErr are hidden from the client
+func errorPayload(err error) ErrorPayload {
+	var frameErr *FrameErr
+	if errors.As(err, &frameErr) {
+		return ErrorPayload{Code: frameErr.Code, Message: frameErr.Message}
+	}
+	return ErrorPayload{Code: ErrCodeInternal, Message: "Internal server error"}
+}
+
+// Encodes a frame and puts it into the send channel of the connection
+func (conn *Connection) sendFrame(frameType, id string, payload any) bool {
+	msg, err := encodeFrame(frameType, id, payload)
+	if err != nil {
+		slog.LogAttrs(context.Background(), slog.LevelError, "Error encoding websocket frame",
+			slog.String("user_id", conn.UserID),
+			slog.String("type", frameType),
+			slog.String("error", err.Error()),
+		)
+		return false
+	}
+
+	// Nothing is queued anymore once the connection is closed
+	if conn.ctx.Err() != nil {
+		return false
+	}
+	select {
+	case <-conn.ctx.Done():
+		return false
+	case conn.sendChannel <- msg:
+		return true
+	}
+}
+
+// Sends an error frame with the given correlation id to the client
+func (conn *Connection) sendError(id string, err error) bool {
+	return conn.sendFrame(FrameError, id, errorPayload(err))
+}
@@ -0,0 +1,43 @@
+package webSocket
+
+import "sync"
+
+// Open connections of every user, so events can be pushed to all devices of a user
+var (
+	connectionsMutex sync.RWMutex
+	connections      = map[string]map[*Connection]bool{}
+)
+
+// Adds the connection to the open connections of its user
+func registerConnection(conn *Connection) {
+	connectionsMutex.Lock()
+	defer connectionsMutex.Unlock()
+	if connections[conn.UserID] == nil {
+		connections[conn.UserID] = map[*Connection]bool{}
+	}
+	connections[conn.UserID][conn] = true
+}
+
+// Removes a closed connection
+func unregisterConnection(conn *Connection) {
+	connectionsMutex.Lock()
+	defer connectionsMutex.Unlock()
+	delete(connections[conn.UserID], conn)
+	if len(connections[conn.UserID]) == 0 {
+		delete(connections, conn.UserID)
+	}
+}
+
+// Sends an event frame to every open connection of the user. Events don't belong to a request, so they have no correlation id
+func SendEvent(userID, eventType string, payload any) {
+	connectionsMutex.RLock()
+	userConnections := make([]*Connection, 0, len(connections[userID]))
+	for conn := range connections[userID] {
+		userConnections = append(userConnections, conn)
+	}
+	connectionsMutex.RUnlock()
+
+	for _, conn := range userConnections {
+		go conn.sendFrame(eventType, "", payload)
+	}
+}
@@ -0,0 +1,37 @@
+package webSocket
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSendEvent(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	conn := &Connection{ctx: ctx, cancel: cancel, UserID: "user-1", sendChannel: make(chan []byte, 1)}
+	other := &Connection{ctx: ctx, cancel: cancel, UserID: "user-2", sendChannel: make(chan []byte, 1)}
+
+	registerConnection(conn)
+	registerConnection(other)
+	defer unregisterConnection(conn)
+	defer unregisterConnection(other)
+
+	SendEvent("user-1", EventChatUpdated, map[string]string{"title": "Pirates"})
+
+	select {
+	case msg := <-conn.sendChannel:
+		if !strings.Contains(string(msg), `"type":"chat_updated"`) || !strings.Contains(string(msg), "Pirates") {
+			t.Errorf("unexpected event frame: %s", msg)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("event was not sent to the connection of the user")
+	}
+
+	select {
+	case msg := <-other.sendChannel:
+		t.Errorf("event was sent to another user: %s", msg)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
@@ -1,42 +1,153 @@
 package webSocket
 
 import (
-	"log"
+	"encoding/json"
 	"net/http"
-	"net/url"
+	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/golang-jwt/jwt/v5"
 	"github.com/gorilla/websocket"
+	"github.com/roly-backend/internal/ai"
+	"github.com/roly-backend/internal/config"
+	"github.com/roly-backend/internal/users"
 )
 
-func TestWebsocket(t *testing.T) {
-	u := url.URL{Scheme: "ws", Host: "localhost:8080", Path: "/ws"}
+// Starts a test server with the websocket handler and connects an authorized client to it
+func dialTestServer(t *testing.T) *websocket.Conn {
+	t.Helper()
+
+	config.Env.JWTSecret = "test-secret"
+	claims := &users.Claims{
+		UserID: "00000000-0000-0000-0000-000000000001",
+		Email:  "test@roly.ai",
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+		},
+	}
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(config.Env.JWTSecret))
+	if err != nil {
+		t.Fatalf("Error signing test JWT: %v", err)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(HandleWebSocket))
+	t.Cleanup(server.Close)
 
 	header := http.Header{}
-	header.Set("Origin", "http://localhost:3000")
+	header.Set("Origin", "https://roly.ai")
+	header.Set("Authorization", "Bearer "+token)
 
-	c, _, err := websocket.DefaultDialer.Dial(u.String(), header)
+	c, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), header)
 	if err != nil {
 		t.Fatalf("Error while connecting to websocket: %v", err)
 	}
-	defer c.Close()
+	t.Cleanup(func() { c.Close() })
+	return c
+}
 
-	// Sends a message
-	err = c.WriteMessage(websocket.TextMessage, []byte("ping"))
-	if err != nil {
+// Sends a message and returns the decoded answer
+func roundTrip(t *testing.T, c *websocket.Conn, msg string) Envelope {
+	t.Helper()
+
+	if err := c.WriteMessage(websocket.TextMessage, []byte(msg)); err != nil {
 		t.Fatalf("Error sending message to websocket: %v", err)
 	}
 
-	// Reads the answer
-	_, message, err := c.ReadMessage()
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, answer, err := c.ReadMessage()
 	if err != nil {
 		t.Fatalf("Error reading websocket answer: %v", err)
 	}
 
-	log.Printf("Answer from the server: %s", message)
+	var env Envelope
+	if err := json.Unmarshal(answer, &env); err != nil {
+		t.Fatalf("Answer is not a valid envelope: %s", answer)
+	}
+	return env
+}
+
+func TestWebsocketPing(t *testing.T) {
+	c := dialTestServer(t)
+
+	env := roundTrip(t, c, `{"v":1,"type":"ping","id":"req-1"}`)
+	if env.Type != FrameResult || env.ID != "req-1" {
+		t.Errorf("Unexpected answer from server: %+v", env)
+	}
+}
+
+func TestWebsocketErrors(t *testing.T) {
+	c := dialTestServer(t)
+
+	tests := []struct {
+		msg  string
+		code string
+	}{
+		{`ping`, ErrCodeBadRequest},
+		{`{"v":2,"type":"ping","id":"req-2"}`, ErrCodeUnsupported},
+		{`{"v":1,"type":"does_not_exist","id":"req-3"}`, ErrCodeUnknownType},
+	}
+
+	for _, test := range tests {
+		env := roundTrip(t, c, test.msg)
+		if env.Type != FrameError {
+			t.Errorf("Expected error frame for %s, got %+v", test.msg, env)
+			continue
+		}
+		var payload ErrorPayload
+		json.Unmarshal(env.Payload, &payload)
+		if payload.Code != test.code {
+			t.Errorf("Expected error code %s for %s, got %s", test.code, test.msg, payload.Code)
+		}
+	}
+}
+
+// A client that disconnects while an answer is streamed must not crash the server with a send on a closed channel
+func TestWebsocketDisconnectDuringStream(t *testing.T) {
+	finished := make(chan bool)
+	RegisterHandler("test_stream", func(conn *Connection, env Envelope) (any, error) {
+		ctx, done, err := conn.startRequest(env.ID)
+		if err != nil {
+			return nil, err
+		}
+		defer done()
+		defer close(finished)
+
+		sink := conn.generationSink(env.ID)
+		answer := strings.Repeat("word ", 200)
+		_, err = ai.NewFakeProvider(answer).Stream(ctx, ai.Request{Model: "fake"}, func(delta string) error {
+			time.Sleep(time.Millisecond)
+			return sink.Delta(delta)
+		})
+		// The frames after the stream (like the done frame of a truncated answer) are sent after the client is gone
+		for range 50 {
+			conn.sendFrame(FrameDone, env.ID, map[string]string{})
+			SendEvent(conn.UserID, EventChatUpdated, map[string]string{})
+		}
+		return nil, err
+	})
+	t.Cleanup(func() {
+		handlersMutex.Lock()
+		delete(handlers, "test_stream")
+		handlersMutex.Unlock()
+	})
+
+	c := dialTestServer(t)
+	if err := c.WriteMessage(websocket.TextMessage, []byte(`{"v":1,"type":"test_stream","id":"req-1"}`)); err != nil {
+		t.Fatal(err)
+	}
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, _, err := c.ReadMessage(); err != nil {
+		t.Fatalf("expected the first delta, got %v", err)
+	}
+	c.Close()
 
-	// Checks if answer was as expected
-	if string(message) != "ping" {
-		t.Errorf("Unexpected answer from server: %s", message)
+	select {
+	case <-finished:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the stream didn't stop after the client disconnected")
 	}
+	// The last frames are sent by the handler after it returned
+	time.Sleep(50 * time.Millisecond)
 }